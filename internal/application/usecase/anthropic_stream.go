@@ -0,0 +1,618 @@
+package usecase
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/domain/model"
+	"api-conver/internal/domain/service"
+)
+
+type anthropicStreamState struct {
+	messageID string
+	model     string
+	started   bool
+	nextIndex int
+	textIndex int
+	textOpen  bool
+	// thinkingIndex and thinkingOpen track the block receiving upstream
+	// reasoning_content deltas.
+	thinkingIndex int
+	thinkingOpen  bool
+	toolBlocks    map[int]*anthropicToolBlock
+	finishReason  string
+	usage         *model.OpenAIUsage
+	// outputTokens estimates the emitted text, reasoning and tool
+	// arguments; it enforces the output cap and stands in for upstream
+	// usage when the stream was cut short or carried none.
+	outputTokens service.OutputTokenCounter
+	capped       bool
+	// pendingText holds coalesced text deltas not yet written; flushDue
+	// fires when the window ends, so a stalled upstream does not hold
+	// back text already received.
+	pendingText  strings.Builder
+	pendingSince time.Time
+	flushDue     <-chan time.Time
+	// stopSequences, stopReason and textTail identify the stop sequence
+	// that ended the stream: stopReason is the upstream's report of it,
+	// textTail the end of the emitted text, kept only as long as the
+	// longest sequence.
+	stopSequences []string
+	stopReason    interface{}
+	textTail      string
+	// systemFingerprint is reported on message_start when the first chunk
+	// carries it, otherwise on message_delta.
+	systemFingerprint string
+	fingerprintSent   bool
+	// promptFilterResults and contentFilterResults carry Azure OpenAI
+	// content filtering verdicts; the prompt verdict goes on message_start
+	// when known by then, otherwise on message_delta.
+	promptFilterResults  interface{}
+	promptFilterSent     bool
+	contentFilterResults interface{}
+	// converter built the request and restores its tool names
+	converter *service.Converter
+}
+
+type anthropicToolBlock struct {
+	index int
+	id    string
+	name  string
+	// started is set once content_block_start went out. It is deferred
+	// until the name is known; arguments arriving earlier wait in
+	// pendingArgs.
+	started     bool
+	pendingArgs strings.Builder
+	// hasArguments records whether any input_json_delta was emitted
+	hasArguments bool
+}
+
+// streamOpenAIToAnthropic converts an OpenAI chat completions SSE stream into
+// Anthropic Messages streaming events. converter is the one that built the
+// request, so sanitized tool names are restored.
+func (u *ProxyUseCase) streamOpenAIToAnthropic(c *gin.Context, resp *http.Response, req model.AnthropicRequest, alias string, converter *service.Converter, opts streamOptions) error {
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	state := &anthropicStreamState{
+		toolBlocks:    map[int]*anthropicToolBlock{},
+		stopSequences: req.StopSequences,
+		converter:     converter,
+	}
+	parseErrors := 0
+	watchdog := newStreamWatchdog(opts.idleTimeout, resp.Body)
+	defer watchdog.stop()
+	done := make(chan struct{})
+	defer close(done)
+	results := readSSEAsync(reader, done)
+
+stream:
+	for {
+		var result sseResult
+		select {
+		case result = <-results:
+		case <-state.flushDue:
+			if err := state.flushText(c); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := result.data, result.err
+		if err != nil {
+			if watchdog.timedOut() {
+				if flushErr := state.flushText(c); flushErr != nil {
+					return flushErr
+				}
+				message := fmt.Sprintf("upstream stream timed out after %s without data", opts.idleTimeout)
+				if writeErr := writeAnthropicStreamError(c, "overloaded_error", message); writeErr != nil {
+					return writeErr
+				}
+				return errors.New(message)
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if flushErr := state.flushText(c); flushErr != nil {
+				return flushErr
+			}
+			if writeErr := writeAnthropicStreamError(c, "api_error", "upstream stream interrupted: "+err.Error()); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+		watchdog.reset()
+		if data == "[DONE]" {
+			break
+		}
+
+		if upstreamErr, ok := parseStreamError(data); ok {
+			if err := state.flushText(c); err != nil {
+				return err
+			}
+			errType := u.converter.MapErrorType(upstreamErr.Type, 0)
+			return writeAnthropicStreamError(c, errType, upstreamErr.Message)
+		}
+
+		var chunk model.OpenAIStreamResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			parseErrors++
+			log.Printf("skipping unparseable stream chunk (%d consecutive): %v", parseErrors, err)
+			if opts.maxParseErrors > 0 && parseErrors >= opts.maxParseErrors {
+				if err := state.flushText(c); err != nil {
+					return err
+				}
+				return writeAnthropicStreamError(c, "api_error", fmt.Sprintf("upstream stream aborted after %d unparseable chunks", parseErrors))
+			}
+			continue
+		}
+		parseErrors = 0
+
+		if chunk.Usage != nil {
+			state.usage = chunk.Usage
+		}
+		if chunk.SystemFingerprint != "" {
+			state.systemFingerprint = chunk.SystemFingerprint
+		}
+		if chunk.PromptFilterResults != nil {
+			state.promptFilterResults = chunk.PromptFilterResults
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.ContentFilterResults != nil {
+				state.contentFilterResults = choice.ContentFilterResults
+			}
+		}
+		// message_start goes out on the first chunk even when it is the usual
+		// role-only delta; content blocks only open once text or tool calls
+		// arrive, so no empty text block is emitted for it.
+		if !state.started {
+			state.messageID = chunk.ID
+			if state.messageID == "" {
+				state.messageID = synthesizeID(u.clock, u.idPrefix)
+			}
+			state.model = responseModel(alias, req.Model, chunk.Model)
+			if err := writeAnthropicMessageStart(c, state); err != nil {
+				return err
+			}
+			state.started = true
+		}
+
+		// Anthropic messages carry a single candidate, so with n > 1 only
+		// the first choice is converted; merging interleaved candidates
+		// would corrupt the text and tool calls.
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			delta := choice.Delta
+			text := deltaText(delta.Content)
+			if delta.ReasoningContent != "" {
+				if err := state.writeThinkingDelta(c, delta.ReasoningContent); err != nil {
+					return err
+				}
+			}
+			if text != "" {
+				var logprobs interface{}
+				if opts.logprobs {
+					logprobs = choice.Logprobs
+				}
+				if err := u.writeCoalescedText(c, state, text, logprobs, opts.coalesceWindow); err != nil {
+					return err
+				}
+			}
+			for _, call := range delta.ToolCalls {
+				if err := state.writeToolCallDelta(c, call.Index, call.ID, call.Function.Name, call.Function.Arguments); err != nil {
+					return err
+				}
+			}
+			state.outputTokens.Add(text)
+			state.outputTokens.Add(delta.ReasoningContent)
+			for _, call := range delta.ToolCalls {
+				state.outputTokens.Add(call.Function.Arguments)
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				state.finishReason = *choice.FinishReason
+			}
+			if choice.StopReason != nil {
+				state.stopReason = choice.StopReason
+			}
+		}
+
+		if opts.maxOutputTokens > 0 && state.outputTokens.Tokens() >= opts.maxOutputTokens {
+			state.finishReason = "length"
+			state.capped = true
+			break stream
+		}
+	}
+
+	if !state.started {
+		state.messageID = synthesizeID(u.clock, u.idPrefix)
+		state.model = responseModel(alias, req.Model, "")
+		if err := writeAnthropicMessageStart(c, state); err != nil {
+			return err
+		}
+	}
+	return u.finishAnthropicStream(c, state)
+}
+
+func writeAnthropicMessageStart(c *gin.Context, state *anthropicStreamState) error {
+	inputTokens := 0
+	if state.usage != nil {
+		inputTokens = state.usage.PromptTokens
+	}
+	message := map[string]interface{}{
+		"id":            state.messageID,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         state.model,
+		"content":       []interface{}{},
+		"stop_reason":   nil,
+		"stop_sequence": nil,
+		"usage": map[string]interface{}{
+			"input_tokens":  inputTokens,
+			"output_tokens": 0,
+		},
+	}
+	if state.systemFingerprint != "" {
+		message["system_fingerprint"] = state.systemFingerprint
+		state.fingerprintSent = true
+	}
+	if state.promptFilterResults != nil {
+		message["prompt_filter_results"] = state.promptFilterResults
+		state.promptFilterSent = true
+	}
+	payload := map[string]interface{}{
+		"type":    "message_start",
+		"message": message,
+	}
+	return writeSSE(c, "message_start", payload)
+}
+
+// writeCoalescedText buffers text deltas until the coalescing window has
+// elapsed, then writes them as one content_block_delta. The window is
+// checked on each delta and, while the upstream is quiet, by the flushDue
+// timer of the read loop. Deltas carrying logprobs are never merged.
+func (u *ProxyUseCase) writeCoalescedText(c *gin.Context, state *anthropicStreamState, text string, logprobs interface{}, window time.Duration) error {
+	if window <= 0 || logprobs != nil {
+		if err := state.flushText(c); err != nil {
+			return err
+		}
+		return state.writeTextDelta(c, text, logprobs)
+	}
+	now := u.clock.Now()
+	if state.pendingText.Len() == 0 {
+		state.pendingSince = now
+		state.flushDue = after(u.clock, window)
+	}
+	state.pendingText.WriteString(text)
+	if now.Sub(state.pendingSince) < window {
+		return nil
+	}
+	return state.flushText(c)
+}
+
+// flushText writes any coalesced text that is still pending
+func (s *anthropicStreamState) flushText(c *gin.Context) error {
+	if s.pendingText.Len() == 0 {
+		return nil
+	}
+	text := s.pendingText.String()
+	s.pendingText.Reset()
+	s.flushDue = nil
+	return s.writeTextDelta(c, text, nil)
+}
+
+func (s *anthropicStreamState) writeTextDelta(c *gin.Context, text string, logprobs interface{}) error {
+	s.trackTail(text)
+	if err := s.closeThinkingBlock(c); err != nil {
+		return err
+	}
+	if !s.textOpen {
+		s.textIndex = s.nextIndex
+		s.nextIndex++
+		s.textOpen = true
+		payload := map[string]interface{}{
+			"type":  "content_block_start",
+			"index": s.textIndex,
+			"content_block": map[string]interface{}{
+				"type": "text",
+				"text": "",
+			},
+		}
+		if err := writeSSE(c, "content_block_start", payload); err != nil {
+			return err
+		}
+	}
+	payload := map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.textIndex,
+		"delta": map[string]interface{}{
+			"type": "text_delta",
+			"text": text,
+		},
+	}
+	if logprobs != nil {
+		payload["logprobs"] = logprobs
+	}
+	return writeSSE(c, "content_block_delta", payload)
+}
+
+// writeThinkingDelta streams upstream reasoning as a thinking block,
+// closing any open text block first.
+func (s *anthropicStreamState) writeThinkingDelta(c *gin.Context, thinking string) error {
+	if err := s.closeTextBlock(c); err != nil {
+		return err
+	}
+	if !s.thinkingOpen {
+		s.thinkingIndex = s.nextIndex
+		s.nextIndex++
+		s.thinkingOpen = true
+		payload := map[string]interface{}{
+			"type":  "content_block_start",
+			"index": s.thinkingIndex,
+			"content_block": map[string]interface{}{
+				"type":     "thinking",
+				"thinking": "",
+			},
+		}
+		if err := writeSSE(c, "content_block_start", payload); err != nil {
+			return err
+		}
+	}
+	payload := map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.thinkingIndex,
+		"delta": map[string]interface{}{
+			"type":     "thinking_delta",
+			"thinking": thinking,
+		},
+	}
+	return writeSSE(c, "content_block_delta", payload)
+}
+
+func (s *anthropicStreamState) closeThinkingBlock(c *gin.Context) error {
+	if !s.thinkingOpen {
+		return nil
+	}
+	s.thinkingOpen = false
+	return writeContentBlockStop(c, s.thinkingIndex)
+}
+
+// trackTail appends text to the stop sequence window
+func (s *anthropicStreamState) trackTail(text string) {
+	longest := 0
+	for _, seq := range s.stopSequences {
+		if len(seq) > longest {
+			longest = len(seq)
+		}
+	}
+	if longest == 0 {
+		return
+	}
+	tail := s.textTail + text
+	if len(tail) > longest {
+		tail = tail[len(tail)-longest:]
+	}
+	s.textTail = tail
+}
+
+func (s *anthropicStreamState) closeTextBlock(c *gin.Context) error {
+	if err := s.flushText(c); err != nil {
+		return err
+	}
+	if !s.textOpen {
+		return nil
+	}
+	s.textOpen = false
+	return writeContentBlockStop(c, s.textIndex)
+}
+
+// writeToolCallDelta streams one tool call fragment. The block starts once
+// the call's name is known, so upstreams sending arguments before the name
+// still produce a correctly named tool_use block.
+func (s *anthropicStreamState) writeToolCallDelta(c *gin.Context, callIndex int, id, name, arguments string) error {
+	block := s.toolBlocks[callIndex]
+	if block == nil {
+		block = &anthropicToolBlock{}
+		s.toolBlocks[callIndex] = block
+	}
+	if block.id == "" {
+		block.id = id
+	}
+	if block.name == "" && strings.TrimSpace(name) != "" {
+		block.name, _ = s.converter.ResolveToolName(name, "")
+	}
+	if !block.started {
+		block.pendingArgs.WriteString(arguments)
+		if block.name == "" {
+			return nil
+		}
+		if err := s.startToolBlock(c, block); err != nil {
+			return err
+		}
+		arguments = block.pendingArgs.String()
+		block.pendingArgs.Reset()
+	}
+	if arguments == "" {
+		return nil
+	}
+	block.hasArguments = true
+	return writeInputJSONDelta(c, block.index, arguments)
+}
+
+// startToolBlock closes any open text or thinking block and emits the
+// content_block_start of a tool call.
+func (s *anthropicStreamState) startToolBlock(c *gin.Context, block *anthropicToolBlock) error {
+	if err := s.closeTextBlock(c); err != nil {
+		return err
+	}
+	if err := s.closeThinkingBlock(c); err != nil {
+		return err
+	}
+	block.index = s.nextIndex
+	s.nextIndex++
+	if block.id == "" {
+		block.id = service.GenerateToolCallID()
+	}
+	block.started = true
+	payload := map[string]interface{}{
+		"type":  "content_block_start",
+		"index": block.index,
+		"content_block": map[string]interface{}{
+			"type":  "tool_use",
+			"id":    block.id,
+			"name":  block.name,
+			"input": map[string]interface{}{},
+		},
+	}
+	return writeSSE(c, "content_block_start", payload)
+}
+
+// startNamelessToolBlocks flushes calls whose name never arrived, in call
+// order. Like complete responses, they are dropped unless a placeholder
+// name is configured and they carry arguments.
+func (s *anthropicStreamState) startNamelessToolBlocks(c *gin.Context) error {
+	callIndexes := make([]int, 0, len(s.toolBlocks))
+	for callIndex, block := range s.toolBlocks {
+		if !block.started {
+			callIndexes = append(callIndexes, callIndex)
+		}
+	}
+	sort.Ints(callIndexes)
+	for _, callIndex := range callIndexes {
+		block := s.toolBlocks[callIndex]
+		name, ok := s.converter.ResolveToolName("", block.pendingArgs.String())
+		if !ok {
+			delete(s.toolBlocks, callIndex)
+			continue
+		}
+		block.name = name
+		if err := s.writeToolCallDelta(c, callIndex, "", "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeInputJSONDelta(c *gin.Context, index int, partialJSON string) error {
+	payload := map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": partialJSON,
+		},
+	}
+	return writeSSE(c, "content_block_delta", payload)
+}
+
+func (u *ProxyUseCase) finishAnthropicStream(c *gin.Context, state *anthropicStreamState) error {
+	if err := state.closeTextBlock(c); err != nil {
+		return err
+	}
+	if err := state.closeThinkingBlock(c); err != nil {
+		return err
+	}
+	if err := state.startNamelessToolBlocks(c); err != nil {
+		return err
+	}
+	// Close tool blocks in ascending content block index so the event
+	// order does not depend on map iteration or on the order in which the
+	// upstream first mentioned each call.
+	blocks := make([]*anthropicToolBlock, 0, len(state.toolBlocks))
+	for _, block := range state.toolBlocks {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].index < blocks[j].index })
+	for _, block := range blocks {
+		// A call that never streamed arguments still needs a valid input
+		if !block.hasArguments {
+			if err := writeInputJSONDelta(c, block.index, "{}"); err != nil {
+				return err
+			}
+		}
+		if err := writeContentBlockStop(c, block.index); err != nil {
+			return err
+		}
+	}
+
+	usage := map[string]interface{}{
+		"output_tokens": state.outputTokens.Tokens(),
+	}
+	if state.usage != nil {
+		usage["input_tokens"] = state.usage.PromptTokens
+		// Usage reported before the cap fired does not cover the output
+		// the client actually received.
+		if !state.capped {
+			usage["output_tokens"] = state.usage.CompletionTokens
+			if state.usage.TotalTokens > 0 {
+				usage["total_tokens"] = state.usage.TotalTokens
+			}
+		}
+	}
+	stopReason := u.converter.MapStopReason(state.finishReason, len(state.toolBlocks) > 0)
+	var stopSequence interface{}
+	if state.finishReason == "stop" {
+		if seq := u.converter.ResolveStopSequence(state.stopReason, state.textTail, state.stopSequences); seq != "" {
+			stopReason = "stop_sequence"
+			stopSequence = seq
+		}
+	}
+	delta := map[string]interface{}{
+		"stop_reason":   stopReason,
+		"stop_sequence": stopSequence,
+	}
+	if state.systemFingerprint != "" && !state.fingerprintSent {
+		delta["system_fingerprint"] = state.systemFingerprint
+	}
+	if state.promptFilterResults != nil && !state.promptFilterSent {
+		delta["prompt_filter_results"] = state.promptFilterResults
+	}
+	if state.finishReason == "content_filter" && state.contentFilterResults != nil {
+		delta["content_filter_results"] = state.contentFilterResults
+	}
+	payload := map[string]interface{}{
+		"type":  "message_delta",
+		"delta": delta,
+		"usage": usage,
+	}
+	if err := writeSSE(c, "message_delta", payload); err != nil {
+		return err
+	}
+	return writeSSE(c, "message_stop", map[string]interface{}{"type": "message_stop"})
+}
+
+func writeContentBlockStop(c *gin.Context, index int) error {
+	return writeSSE(c, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": index,
+	})
+}
+
+// writeAnthropicStreamError terminates an Anthropic stream with an error
+// event followed by message_stop.
+func writeAnthropicStreamError(c *gin.Context, errType, message string) error {
+	payload := map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": message,
+		},
+	}
+	if err := writeSSE(c, "error", payload); err != nil {
+		return err
+	}
+	return writeSSE(c, "message_stop", map[string]interface{}{"type": "message_stop"})
+}
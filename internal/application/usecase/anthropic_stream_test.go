@@ -0,0 +1,844 @@
+package usecase
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestAnthropicStreamEchoesRequestModel(t *testing.T) {
+	for _, tc := range []struct {
+		echo string
+		want string
+	}{
+		{echo: "true", want: "claude-3-5-sonnet"},
+		{echo: "false", want: "upstream-model-0613"},
+	} {
+		loadConfig(t, fmt.Sprintf(echoModelConfig, tc.echo))
+		upstream := newStubUpstream(replySSE(textChunk("upstream-model-0613", "hi"), finishChunk("upstream-model-0613", "stop"), "[DONE]"))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hello"}]}`)
+		events := parseSSE(t, resp.Body.String())
+		message, _ := findEvent(t, events, "message_start").data["message"].(map[string]interface{})
+		if got := message["model"]; got != tc.want {
+			t.Errorf("echo=%s: message_start model = %v, want %s", tc.echo, got, tc.want)
+		}
+	}
+}
+
+const parseErrorsConfig = `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    max_stream_parse_errors: 2
+`
+
+func TestAnthropicStreamAbortsAfterConsecutiveParseErrors(t *testing.T) {
+	loadConfig(t, parseErrorsConfig)
+	upstream := newStubUpstream(replySSE(textChunk("m", "hello"), "{bad", "{worse", textChunk("m", " never"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	errEvent := findEvent(t, events, "error")
+	detail, _ := errEvent.data["error"].(map[string]interface{})
+	if detail["type"] != "api_error" || !strings.Contains(detail["message"].(string), "2 unparseable chunks") {
+		t.Errorf("error event = %v", errEvent.data)
+	}
+	if text := streamText(events); text != "hello" {
+		t.Errorf("text = %q, want only the text before the bad chunks", text)
+	}
+	if names := eventNames(events); names[len(names)-1] != "message_stop" {
+		t.Errorf("events = %v, want message_stop last", names)
+	}
+}
+
+func TestAnthropicStreamSkipsParseErrorsBelowThreshold(t *testing.T) {
+	loadConfig(t, parseErrorsConfig)
+	// Bad chunks separated by a good one never reach two in a row
+	upstream := newStubUpstream(replySSE(textChunk("m", "a"), "{bad", textChunk("m", "b"), "{bad", textChunk("m", "c"), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	for _, event := range events {
+		if event.name == "error" {
+			t.Fatalf("unexpected error event: %v", event.data)
+		}
+	}
+	if text := streamText(events); text != "abc" {
+		t.Errorf("text = %q, want abc", text)
+	}
+	delta := findEvent(t, events, "message_delta").data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "end_turn" {
+		t.Errorf("stop_reason = %v", delta["stop_reason"])
+	}
+}
+
+func TestAnthropicStreamSynthesizesIDFromClock(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	clock := &fakeClock{now: time.Unix(1700000000, 42)}
+	chunk := `{"object":"chat.completion.chunk","model":"m","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`
+	upstream := newStubUpstream(replySSE(chunk, "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream, WithClock(clock), WithIDPrefix("test_")))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	message := findEvent(t, parseSSE(t, resp.Body.String()), "message_start").data["message"].(map[string]interface{})
+	if message["id"] != "test_1700000000000000042" {
+		t.Errorf("id = %v, want test_1700000000000000042", message["id"])
+	}
+}
+
+// logprobsChunk renders a text chunk carrying one token logprob
+func logprobsChunk(text string) string {
+	return `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"content":"` + text +
+		`"},"logprobs":{"content":[{"token":"` + text + `","logprob":-0.5}]}}]}`
+}
+
+func TestAnthropicStreamForwardsLogprobs(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    stream_logprobs: %t
+`, enabled))
+		upstream := newStubUpstream(replySSE(logprobsChunk("hi"), finishChunk("m", "stop"), "[DONE]"))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		delta := findEvent(t, parseSSE(t, resp.Body.String()), "content_block_delta").data
+		logprobs, ok := delta["logprobs"].(map[string]interface{})
+		if ok != enabled {
+			t.Fatalf("stream_logprobs=%t: delta = %v", enabled, delta)
+		}
+		if enabled {
+			token := logprobs["content"].([]interface{})[0].(map[string]interface{})
+			if token["token"] != "hi" || token["logprob"] != -0.5 {
+				t.Errorf("logprobs = %v", logprobs)
+			}
+		}
+	}
+}
+
+func TestAnthropicStreamHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: %q
+    stream_header_timeout: 1
+`, server.URL))
+	u := NewProxyUseCase()
+	defer u.client.Close()
+
+	start := time.Now()
+	resp := serve(testEngine(u), "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", resp.Code, resp.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %s, want it bounded by the header timeout", elapsed)
+	}
+}
+
+func TestAnthropicStreamMultiTurnToolConversation(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(textChunk("m", "It is sunny."), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":64,"stream":true,
+		"tools":[{"name":"weather","description":"Look up weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}],
+		"messages":[
+			{"role":"user","content":"Weather in Paris?"},
+			{"role":"assistant","content":[{"type":"text","text":"Checking."},{"type":"tool_use","id":"toolu_1","name":"weather","input":{"city":"Paris"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"sunny"}]},
+			{"role":"assistant","content":"It is sunny in Paris."},
+			{"role":"user","content":[{"type":"text","text":"And Rome?"}]},
+			{"role":"assistant","content":[{"type":"tool_use","id":"toolu_2","name":"weather","input":{"city":"Rome"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_2","content":[{"type":"text","text":"sunny"}]}]}
+		]}`)
+	if text := streamText(parseSSE(t, resp.Body.String())); text != "It is sunny." {
+		t.Fatalf("streamed text = %q: %s", text, resp.Body.String())
+	}
+
+	body := upstream.last(t).json(t)
+	if body["stream"] != true {
+		t.Errorf("stream = %v, want true", body["stream"])
+	}
+	messages := body["messages"].([]interface{})
+	var roles []string
+	for _, m := range messages {
+		roles = append(roles, m.(map[string]interface{})["role"].(string))
+	}
+	if want := []string{"user", "assistant", "tool", "assistant", "user", "assistant", "tool"}; !reflect.DeepEqual(roles, want) {
+		t.Fatalf("roles = %v, want %v", roles, want)
+	}
+	for i, id := range map[int]string{1: "toolu_1", 5: "toolu_2"} {
+		calls := messages[i].(map[string]interface{})["tool_calls"].([]interface{})
+		call := calls[0].(map[string]interface{})
+		function := call["function"].(map[string]interface{})
+		if call["id"] != id || function["name"] != "weather" {
+			t.Errorf("message %d tool call = %v", i, call)
+		}
+	}
+	for i, id := range map[int]string{2: "toolu_1", 6: "toolu_2"} {
+		result := messages[i].(map[string]interface{})
+		if result["tool_call_id"] != id || result["content"] != "sunny" {
+			t.Errorf("message %d tool result = %v", i, result)
+		}
+	}
+}
+
+func TestAnthropicStreamStopsAtOutputTokenCap(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    max_stream_output_tokens: 5
+`)
+	// Eight ASCII characters estimate as two tokens per chunk
+	chunks := []string{}
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, textChunk("m", "abcdefgh"))
+	}
+	upstream := newStubUpstream(replySSE(append(chunks, finishChunk("m", "stop"), "[DONE]")...))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	if text := streamText(events); text != strings.Repeat("abcdefgh", 3) {
+		t.Errorf("text = %q, want three chunks", text)
+	}
+	messageDelta := findEvent(t, events, "message_delta").data
+	if reason := messageDelta["delta"].(map[string]interface{})["stop_reason"]; reason != "max_tokens" {
+		t.Errorf("stop_reason = %v, want max_tokens", reason)
+	}
+	if tokens := messageDelta["usage"].(map[string]interface{})["output_tokens"]; tokens != float64(6) {
+		t.Errorf("output_tokens = %v, want 6", tokens)
+	}
+	if names := eventNames(events); names[len(names)-1] != "message_stop" {
+		t.Errorf("events = %v, want message_stop last", names)
+	}
+}
+
+func TestAnthropicStreamEstimatesUsageWithoutUpstreamUsage(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(textChunk("m", "Hello, "), textChunk("m", "world!"), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	usage := findEvent(t, parseSSE(t, resp.Body.String()), "message_delta").data["usage"].(map[string]interface{})
+	// "Hello, world!" is 13 ASCII characters
+	if usage["output_tokens"] != float64(4) {
+		t.Errorf("output_tokens = %v, want 4", usage["output_tokens"])
+	}
+}
+
+// toolCallChunk renders a stream chunk carrying a tool call delta for choice 0
+func toolCallChunk(index int, id, name, arguments string) string {
+	call := map[string]interface{}{
+		"index":    index,
+		"function": map[string]interface{}{"arguments": arguments},
+	}
+	if id != "" {
+		call["id"] = id
+		call["type"] = "function"
+	}
+	if name != "" {
+		call["function"].(map[string]interface{})["name"] = name
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-1",
+		"object":  "chat.completion.chunk",
+		"created": 1700000000,
+		"model":   "m",
+		"choices": []interface{}{map[string]interface{}{
+			"index": 0,
+			"delta": map[string]interface{}{"tool_calls": []interface{}{call}},
+		}},
+	})
+	return string(body)
+}
+
+func TestAnthropicStreamConvertsTextAndToolCalls(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(
+		`{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		textChunk("m", "Let me check."),
+		toolCallChunk(0, "call_1", "weather", `{"city":`),
+		toolCallChunk(0, "", "", `"Paris"}`),
+		finishChunk("m", "tool_calls"),
+		`{"id":"chatcmpl-1","model":"m","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":7,"total_tokens":16}}`,
+		"[DONE]",
+	))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"Weather?"}]}`)
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	events := parseSSE(t, resp.Body.String())
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if names := eventNames(events); !reflect.DeepEqual(names, want) {
+		t.Fatalf("events = %v\nwant %v", names, want)
+	}
+
+	message := events[0].data["message"].(map[string]interface{})
+	if message["id"] != "chatcmpl-1" || message["role"] != "assistant" || message["model"] != "m" {
+		t.Errorf("message_start = %v", message)
+	}
+	text := events[1].data["content_block"].(map[string]interface{})
+	if text["type"] != "text" || events[1].data["index"] != float64(0) {
+		t.Errorf("text block start = %v", events[1].data)
+	}
+	tool := events[4].data["content_block"].(map[string]interface{})
+	if tool["type"] != "tool_use" || tool["id"] != "call_1" || tool["name"] != "weather" || events[4].data["index"] != float64(1) {
+		t.Errorf("tool block start = %v", events[4].data)
+	}
+	var arguments string
+	for _, event := range events[5:7] {
+		delta := event.data["delta"].(map[string]interface{})
+		if delta["type"] != "input_json_delta" {
+			t.Errorf("tool delta = %v", delta)
+		}
+		arguments += delta["partial_json"].(string)
+	}
+	if arguments != `{"city":"Paris"}` {
+		t.Errorf("arguments = %s", arguments)
+	}
+	messageDelta := events[8].data
+	if reason := messageDelta["delta"].(map[string]interface{})["stop_reason"]; reason != "tool_use" {
+		t.Errorf("stop_reason = %v, want tool_use", reason)
+	}
+	if usage := messageDelta["usage"].(map[string]interface{}); usage["input_tokens"] != float64(9) || usage["output_tokens"] != float64(7) {
+		t.Errorf("usage = %v", usage)
+	}
+}
+
+// tickingClock advances by step on every reading
+type tickingClock struct {
+	fakeClock
+	step time.Duration
+}
+
+func (c *tickingClock) Now() time.Time {
+	now := c.fakeClock.Now()
+	c.Advance(c.step)
+	return now
+}
+
+// After never fires, so batches are cut by the per-delta window check alone
+func (c *tickingClock) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+func TestAnthropicStreamCoalescesTextDeltas(t *testing.T) {
+	chars := []string{}
+	for _, r := range "Hello, streaming world!" {
+		chars = append(chars, textChunk("m", string(r)))
+	}
+	data := append(chars, finishChunk("m", "stop"), "[DONE]")
+	for _, tc := range []struct {
+		name   string
+		window int
+		clock  Clock
+		deltas int
+	}{
+		{name: "uncoalesced", window: 0, clock: &fakeClock{}, deltas: len(chars)},
+		{name: "single window", window: 50, clock: &fakeClock{}, deltas: 1},
+		// Each reading advances 20ms, so a pending batch flushes on its
+		// fourth delta (60ms >= 50ms): 23 characters make 6 batches.
+		{name: "window elapses", window: 50, clock: &tickingClock{step: 20 * time.Millisecond}, deltas: 6},
+	} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    stream_coalesce_ms: %d
+`, tc.window))
+		upstream := newStubUpstream(replySSE(data...))
+		engine := testEngine(newTestUseCase(t, upstream, WithClock(tc.clock)))
+
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		events := parseSSE(t, resp.Body.String())
+		if text := streamText(events); text != "Hello, streaming world!" {
+			t.Errorf("%s: text = %q", tc.name, text)
+		}
+		deltas := 0
+		for _, event := range events {
+			if event.name == "content_block_delta" {
+				deltas++
+			}
+		}
+		if deltas != tc.deltas {
+			t.Errorf("%s: %d text deltas, want %d", tc.name, deltas, tc.deltas)
+		}
+	}
+}
+
+func TestAnthropicStreamFailsOnUpstreamErrorChunk(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	errChunk := `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`
+	upstream := newStubUpstream(replySSE(textChunk("m", "partial"), errChunk, textChunk("m", " ignored"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	names := eventNames(events)
+	if names[0] != "message_start" || names[len(names)-2] != "error" || names[len(names)-1] != "message_stop" {
+		t.Fatalf("events = %v, want message_start first and error, message_stop last", names)
+	}
+	detail := findEvent(t, events, "error").data["error"].(map[string]interface{})
+	if detail["type"] != "rate_limit_error" || detail["message"] != "Rate limit reached" {
+		t.Errorf("error = %v", detail)
+	}
+	if text := streamText(events); text != "partial" {
+		t.Errorf("text = %q, want only the text before the error", text)
+	}
+}
+
+func TestAnthropicStreamFailsOnBrokenConnection(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		resp := sseResponse(textChunk("m", "partial"))
+		resp.Body = io.NopCloser(io.MultiReader(resp.Body, iotest.ErrReader(errors.New("connection reset"))))
+		return resp, nil
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	detail := findEvent(t, events, "error").data["error"].(map[string]interface{})
+	if detail["type"] != "api_error" || !strings.Contains(detail["message"].(string), "connection reset") {
+		t.Errorf("error = %v", detail)
+	}
+	if names := eventNames(events); names[len(names)-1] != "message_stop" {
+		t.Errorf("events = %v, want message_stop last", names)
+	}
+	if text := streamText(events); text != "partial" {
+		t.Errorf("text = %q, want the text before the break", text)
+	}
+}
+
+func TestAnthropicReasoningContentBecomesThinking(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	body := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"message":{"role":"assistant","reasoning_content":"Let me think.","content":"42"},"finish_reason":"stop"}]}`
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body))))
+	message := decodeJSON(t, serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	content, _ := message["content"].([]interface{})
+	if len(content) != 2 {
+		t.Fatalf("content = %v, want thinking then text", message["content"])
+	}
+	thinking, text := content[0].(map[string]interface{}), content[1].(map[string]interface{})
+	if thinking["type"] != "thinking" || thinking["thinking"] != "Let me think." || text["type"] != "text" || text["text"] != "42" {
+		t.Errorf("content = %v", content)
+	}
+
+	reasoning := func(text string) string {
+		return `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"reasoning_content":"` + text + `"}}]}`
+	}
+	upstream := newStubUpstream(replySSE(reasoning("Let me "), reasoning("think."), textChunk("m", "42"), finishChunk("m", "stop"), "[DONE]"))
+	engine = testEngine(newTestUseCase(t, upstream))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if names := eventNames(events); !reflect.DeepEqual(names, want) {
+		t.Fatalf("events = %v\nwant %v", names, want)
+	}
+	block := events[1].data["content_block"].(map[string]interface{})
+	if block["type"] != "thinking" || events[1].data["index"] != float64(0) {
+		t.Errorf("first block = %v", events[1].data)
+	}
+	var thought strings.Builder
+	for _, event := range events[2:4] {
+		delta := event.data["delta"].(map[string]interface{})
+		if delta["type"] != "thinking_delta" {
+			t.Errorf("delta = %v, want thinking_delta", delta)
+		}
+		thought.WriteString(fmt.Sprint(delta["thinking"]))
+	}
+	if thought.String() != "Let me think." {
+		t.Errorf("thinking = %q", thought.String())
+	}
+	if events[5].data["index"] != float64(1) || streamText(events) != "42" {
+		t.Errorf("text block = %v, text = %q", events[5].data, streamText(events))
+	}
+}
+
+func TestAnthropicStreamClosesToolBlocksInOrder(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	chunks := []string{
+		toolCallChunk(2, "call_c", "third", `{"n":`),
+		toolCallChunk(0, "call_a", "first", `{"n":`),
+		toolCallChunk(1, "call_b", "second", `{"n":`),
+		toolCallChunk(0, "", "", `1}`),
+		toolCallChunk(2, "", "", `3}`),
+		toolCallChunk(1, "", "", `2}`),
+		finishChunk("m", "tool_calls"),
+		"[DONE]",
+	}
+	// Map iteration order varies between runs, so repeat to catch it
+	for run := 0; run < 20; run++ {
+		engine := testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunks...))))
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		events := parseSSE(t, resp.Body.String())
+
+		var started, stopped []interface{}
+		args := map[float64]string{}
+		names := map[float64]interface{}{}
+		for _, event := range events {
+			index, _ := event.data["index"].(float64)
+			switch event.name {
+			case "content_block_start":
+				started = append(started, index)
+				names[index] = event.data["content_block"].(map[string]interface{})["name"]
+			case "content_block_delta":
+				args[index] += event.data["delta"].(map[string]interface{})["partial_json"].(string)
+			case "content_block_stop":
+				stopped = append(stopped, index)
+			}
+		}
+		want := []interface{}{float64(0), float64(1), float64(2)}
+		if !reflect.DeepEqual(started, want) || !reflect.DeepEqual(stopped, want) {
+			t.Fatalf("run %d: started %v, stopped %v, want ascending indexes", run, started, stopped)
+		}
+		wantNames := map[float64]interface{}{0: "third", 1: "first", 2: "second"}
+		wantArgs := map[float64]string{0: `{"n":3}`, 1: `{"n":1}`, 2: `{"n":2}`}
+		if !reflect.DeepEqual(names, wantNames) || !reflect.DeepEqual(args, wantArgs) {
+			t.Fatalf("run %d: names %v, args %v", run, names, args)
+		}
+	}
+}
+
+func TestAnthropicStreamsToolArgumentsIncrementally(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(
+		toolCallChunk(0, "call_1", "search", `{"query":`),
+		toolCallChunk(0, "", "", `"golang`),
+		toolCallChunk(0, "", "", ` generics"}`),
+		toolCallChunk(1, "call_2", "now", ""),
+		finishChunk("m", "tool_calls"),
+		"[DONE]",
+	))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	deltas := map[float64][]string{}
+	for _, event := range events {
+		if event.name != "content_block_delta" {
+			continue
+		}
+		delta := event.data["delta"].(map[string]interface{})
+		if delta["type"] != "input_json_delta" {
+			t.Errorf("delta = %v, want input_json_delta", delta)
+		}
+		index := event.data["index"].(float64)
+		deltas[index] = append(deltas[index], delta["partial_json"].(string))
+	}
+	want := map[float64][]string{
+		0: {`{"query":`, `"golang`, ` generics"}`},
+		// A call that never streams arguments still gets a valid input
+		1: {"{}"},
+	}
+	if !reflect.DeepEqual(deltas, want) {
+		t.Errorf("input_json_delta fragments = %v\nwant %v", deltas, want)
+	}
+}
+
+func TestAnthropicStreamRoleOnlyFirstChunk(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	roleOnly := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`
+	upstream := newStubUpstream(replySSE(roleOnly, textChunk("m", "hi"), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	if names := eventNames(events); !reflect.DeepEqual(names, want) {
+		t.Fatalf("events = %v\nwant %v", names, want)
+	}
+	if text := events[2].data["delta"].(map[string]interface{})["text"]; text != "hi" {
+		t.Errorf("first text delta = %q, want no empty delta from the role-only chunk", text)
+	}
+
+	// A stream that never carries content still opens the message
+	upstream = newStubUpstream(replySSE(roleOnly, finishChunk("m", "stop"), "[DONE]"))
+	engine = testEngine(newTestUseCase(t, upstream))
+	resp = serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	names := eventNames(parseSSE(t, resp.Body.String()))
+	if names[0] != "message_start" {
+		t.Errorf("events = %v, want message_start first", names)
+	}
+	for _, name := range names {
+		if name == "content_block_delta" {
+			t.Errorf("events = %v, want no empty text delta", names)
+		}
+	}
+}
+
+func TestAnthropicStreamIdleTimeoutMidStream(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    stream_idle_timeout: 1
+`)
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		reader, writer := io.Pipe()
+		go func() {
+			// Send one chunk, then stall until the proxy gives up
+			io.WriteString(writer, "data: "+textChunk("m", "partial")+"\n\n")
+		}()
+		resp := sseResponse()
+		resp.Body = reader
+		return resp, nil
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	start := time.Now()
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stream took %s, want it cut after the 1s idle timeout", elapsed)
+	}
+	if resp.Code != http.StatusOK {
+		t.Errorf("status = %d, want the committed 200", resp.Code)
+	}
+	events := parseSSE(t, resp.Body.String())
+	names := eventNames(events)
+	if names[len(names)-2] != "error" || names[len(names)-1] != "message_stop" {
+		t.Fatalf("events = %v, want error then message_stop last", names)
+	}
+	detail := findEvent(t, events, "error").data["error"].(map[string]interface{})
+	if detail["type"] != "overloaded_error" || !strings.Contains(detail["message"].(string), "timed out") {
+		t.Errorf("error = %v", detail)
+	}
+	if text := streamText(events); text != "partial" {
+		t.Errorf("text = %q, want the text sent before the stall", text)
+	}
+}
+
+func TestAnthropicStreamToolNameAfterArguments(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(
+		textChunk("m", "Checking."),
+		toolCallChunk(0, "call_1", "", `{"city":`),
+		toolCallChunk(0, "", "", `"Paris"}`),
+		toolCallChunk(0, "", "weather", ""),
+		// A call whose name never arrives is dropped
+		toolCallChunk(1, "call_2", "", `{"x":1}`),
+		finishChunk("m", "tool_calls"),
+		"[DONE]",
+	))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+
+	var tools []map[string]interface{}
+	var args string
+	for _, event := range events {
+		switch event.name {
+		case "content_block_start":
+			if block := event.data["content_block"].(map[string]interface{}); block["type"] == "tool_use" {
+				tools = append(tools, block)
+			}
+		case "content_block_delta":
+			if delta := event.data["delta"].(map[string]interface{}); delta["type"] == "input_json_delta" {
+				if len(tools) == 0 {
+					t.Fatalf("input_json_delta before the tool block started: %v", eventNames(events))
+				}
+				args += delta["partial_json"].(string)
+			}
+		}
+	}
+	if len(tools) != 1 || tools[0]["name"] != "weather" || tools[0]["id"] != "call_1" {
+		t.Fatalf("tool_use blocks = %v, want one weather call_1 block", tools)
+	}
+	if args != `{"city":"Paris"}` {
+		t.Errorf("arguments = %q, want the fragments buffered before the name", args)
+	}
+	delta := findEvent(t, events, "message_delta").data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "tool_use" {
+		t.Errorf("stop_reason = %v, want tool_use", delta["stop_reason"])
+	}
+}
+
+func TestAnthropicStreamIgnoresOtherChoices(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	choice := func(index int, delta, finish string) string {
+		if finish != "" {
+			finish = `,"finish_reason":"` + finish + `"`
+		}
+		return fmt.Sprintf(`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"m","choices":[{"index":%d,"delta":%s%s}]}`, index, delta, finish)
+	}
+	upstream := newStubUpstream(replySSE(
+		choice(0, `{"role":"assistant","content":"Hel"}`, ""),
+		choice(1, `{"role":"assistant","content":"Bon"}`, ""),
+		choice(1, `{"content":"jour"}`, ""),
+		choice(0, `{"content":"lo"}`, ""),
+		choice(1, `{"tool_calls":[{"index":0,"id":"call_x","type":"function","function":{"name":"other","arguments":"{}"}}]}`, ""),
+		// Both candidates in one chunk
+		`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"m","choices":[`+
+			`{"index":1,"delta":{},"finish_reason":"tool_calls"},{"index":0,"delta":{"content":"!"},"finish_reason":"stop"}]}`,
+		"[DONE]",
+	))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	if text := streamText(events); text != "Hello!" {
+		t.Errorf("text = %q, want only choice 0", text)
+	}
+	for _, event := range events {
+		if event.name == "content_block_start" {
+			if block := event.data["content_block"].(map[string]interface{}); block["type"] != "text" {
+				t.Errorf("unexpected block from another choice: %v", block)
+			}
+		}
+	}
+	delta := findEvent(t, events, "message_delta").data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "end_turn" {
+		t.Errorf("stop_reason = %v, want choice 0's end_turn", delta["stop_reason"])
+	}
+}
+
+func TestAnthropicStreamFlushesCoalescedTextWhenUpstreamStalls(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    stream_coalesce_ms: 50
+`)
+	body, upstreamWriter := io.Pipe()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/event-stream"}},
+			Body:       body,
+		}, nil
+	})
+	server := httptest.NewServer(testEngine(newTestUseCase(t, upstream, WithClock(clock))))
+	defer server.Close()
+	// Ending the upstream lets the handler finish before the server closes.
+	defer upstreamWriter.Close()
+
+	go func() {
+		fmt.Fprintf(upstreamWriter, "data: %s\n\ndata: %s\n\n", textChunk("m", "Hel"), textChunk("m", "lo"))
+	}()
+	resp, err := http.Post(server.URL+"/a/v1/messages", "application/json",
+		strings.NewReader(`{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The upstream now stalls with the text buffered; only the window
+	// ending on the clock may release it.
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.pendingTimers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("coalescing window never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(50 * time.Millisecond)
+
+	deltas := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.Contains(line, `"text_delta"`) {
+				deltas <- line
+				return
+			}
+		}
+		close(deltas)
+	}()
+	select {
+	case line := <-deltas:
+		if !strings.Contains(line, `"text":"Hello"`) {
+			t.Errorf("first text delta = %s, want the buffered Hello", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffered text was not flushed while the upstream stalled")
+	}
+}
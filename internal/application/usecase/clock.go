@@ -0,0 +1,85 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"api-conver/internal/domain/service"
+	"api-conver/internal/infrastructure/proxy"
+)
+
+// Clock supplies the current time for synthesized ids and timestamps.
+// Clocks that also implement After drive stream timers, such as the
+// coalescing flush, instead of the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// timerClock is implemented by clocks that also drive timers
+type timerClock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// after returns a channel that receives once d has elapsed on clock
+func after(clock Clock, d time.Duration) <-chan time.Time {
+	if timers, ok := clock.(timerClock); ok {
+		return timers.After(d)
+	}
+	return time.After(d)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Option configures a ProxyUseCase
+type Option func(*ProxyUseCase)
+
+// WithClock overrides the clock used for synthesized ids and timestamps
+func WithClock(clock Clock) Option {
+	return func(u *ProxyUseCase) {
+		if clock != nil {
+			u.clock = clock
+		}
+	}
+}
+
+// WithIDPrefix overrides the prefix of synthesized message ids
+func WithIDPrefix(prefix string) Option {
+	return func(u *ProxyUseCase) {
+		u.idPrefix = prefix
+	}
+}
+
+// WithTokenEstimator replaces the heuristic used by count_tokens, e.g.
+// with a real tokenizer
+func WithTokenEstimator(estimator service.TokenEstimator) Option {
+	return func(u *ProxyUseCase) {
+		if estimator != nil {
+			u.estimator = estimator
+		}
+	}
+}
+
+// WithClient replaces the upstream client, e.g. with one built on a mock
+// transport via proxy.WithTransport
+func WithClient(client *proxy.Client) Option {
+	return func(u *ProxyUseCase) {
+		if client != nil {
+			u.client = client
+		}
+	}
+}
+
+func synthesizeID(clock Clock, prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, clock.Now().UnixNano())
+}
+
+func ensureCreated(clock Clock, created int64) int64 {
+	if created != 0 {
+		return created
+	}
+	return clock.Now().Unix()
+}
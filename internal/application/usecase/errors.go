@@ -0,0 +1,26 @@
+package usecase
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// writeOpenAIError writes an OpenAI-style error body.
+func writeOpenAIError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
+
+// writeAnthropicError writes an Anthropic-style error body.
+func writeAnthropicError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
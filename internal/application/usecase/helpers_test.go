@@ -0,0 +1,379 @@
+package usecase
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+	"api-conver/internal/infrastructure/proxy"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// loadConfig makes yaml the active config for the rest of the test. Tests
+// share the global config, so they must not run in parallel.
+func loadConfig(t *testing.T, yaml string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := config.Load(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+}
+
+// upstreamRequest is an outbound request captured by stubUpstream
+type upstreamRequest struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// json decodes the captured body
+func (r upstreamRequest) json(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var payload map[string]interface{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatalf("upstream body is not JSON: %v: %s", err, r.body)
+	}
+	return payload
+}
+
+// stubUpstream is a mock upstream transport recording every request and
+// answering through respond.
+type stubUpstream struct {
+	mu       sync.Mutex
+	requests []upstreamRequest
+	respond  func(req *http.Request) (*http.Response, error)
+}
+
+func newStubUpstream(respond func(req *http.Request) (*http.Response, error)) *stubUpstream {
+	return &stubUpstream{respond: respond}
+}
+
+func (s *stubUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, upstreamRequest{
+		method: req.Method,
+		url:    req.URL.String(),
+		header: req.Header.Clone(),
+		body:   body,
+	})
+	s.mu.Unlock()
+	resp, err := s.respond(req)
+	if resp != nil && resp.Request == nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// last returns the most recent captured request
+func (s *stubUpstream) last(t *testing.T) upstreamRequest {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("upstream received no request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func (s *stubUpstream) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// replyJSON answers every request with status and body
+func replyJSON(status int, body string) func(*http.Request) (*http.Response, error) {
+	return func(*http.Request) (*http.Response, error) {
+		return jsonResponse(status, body), nil
+	}
+}
+
+// replySSE answers every request with an event stream of the given data
+// payloads
+func replySSE(data ...string) func(*http.Request) (*http.Response, error) {
+	return func(*http.Request) (*http.Response, error) {
+		return sseResponse(data...), nil
+	}
+}
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func sseResponse(data ...string) *http.Response {
+	var b strings.Builder
+	for _, item := range data {
+		b.WriteString("data: " + item + "\n\n")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(b.String())),
+	}
+}
+
+// completion renders a minimal chat.completion with one text choice
+func completion(model, content, finishReason string) string {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-1",
+		"object":  "chat.completion",
+		"created": 1700000000,
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       map[string]interface{}{"role": "assistant", "content": content},
+			"finish_reason": finishReason,
+		}},
+		"usage": map[string]interface{}{"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5},
+	})
+	return string(body)
+}
+
+// textChunk renders a stream chunk carrying a text delta for choice 0
+func textChunk(model, text string) string {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-1",
+		"object":  "chat.completion.chunk",
+		"created": 1700000000,
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index": 0,
+			"delta": map[string]interface{}{"content": text},
+		}},
+	})
+	return string(body)
+}
+
+// finishChunk renders a stream chunk closing choice 0 with reason
+func finishChunk(model, reason string) string {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-1",
+		"object":  "chat.completion.chunk",
+		"created": 1700000000,
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"delta":         map[string]interface{}{},
+			"finish_reason": reason,
+		}},
+	})
+	return string(body)
+}
+
+// newTestUseCase builds a use case whose upstream is the stub
+func newTestUseCase(t *testing.T, upstream http.RoundTripper, opts ...Option) *ProxyUseCase {
+	t.Helper()
+	client := proxy.NewClient(proxy.WithTransport(upstream))
+	t.Cleanup(client.Close)
+	return NewProxyUseCase(append([]Option{WithClient(client)}, opts...)...)
+}
+
+// testEngine routes the use case like the production router, with and
+// without an alias prefix.
+func testEngine(u *ProxyUseCase) *gin.Engine {
+	engine := gin.New()
+	routes := []struct {
+		method string
+		path   string
+		handle func(*gin.Context, string)
+	}{
+		{http.MethodPost, "/v1/chat/completions", u.HandleOpenAI},
+		{http.MethodPost, "/v1/responses", u.HandleResponses},
+		{http.MethodGet, "/v1/responses/:id", u.HandleGetResponse},
+		{http.MethodDelete, "/v1/responses/:id", u.HandleDeleteResponse},
+		{http.MethodPost, "/v1/messages", u.HandleAnthropic},
+		{http.MethodPost, "/v1/messages/count_tokens", u.HandleCountTokens},
+		{http.MethodGet, "/v1/models", u.HandleModels},
+		{http.MethodGet, "/v1/models/*id", u.HandleModel},
+	}
+	for _, route := range routes {
+		handle := route.handle
+		engine.Handle(route.method, route.path, func(c *gin.Context) { handle(c, "") })
+		engine.Handle(route.method, "/:alias"+route.path, func(c *gin.Context) { handle(c, c.Param("alias")) })
+	}
+	return engine
+}
+
+// serve sends one request through engine; headers are name, value pairs
+func serve(engine http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// decodeJSON decodes a JSON response body
+func decodeJSON(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var payload map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, recorder.Body.String())
+	}
+	return payload
+}
+
+// sseEvent is one event of a converted stream
+type sseEvent struct {
+	name string
+	data map[string]interface{}
+	raw  string
+}
+
+// parseSSE splits a stream body into events; [DONE] and other non-JSON
+// payloads are kept raw.
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			current.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			current.raw = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			var data map[string]interface{}
+			if json.Unmarshal([]byte(current.raw), &data) == nil {
+				current.data = data
+			}
+		case line == "":
+			if current.raw != "" || current.name != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		}
+	}
+	if current.raw != "" || current.name != "" {
+		events = append(events, current)
+	}
+	return events
+}
+
+// eventNames lists the names of events, using the raw payload for unnamed
+// ones such as [DONE].
+func eventNames(events []sseEvent) []string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		if event.name == "" {
+			names = append(names, event.raw)
+			continue
+		}
+		names = append(names, event.name)
+	}
+	return names
+}
+
+// findEvent returns the first event named name
+func findEvent(t *testing.T, events []sseEvent, name string) sseEvent {
+	t.Helper()
+	for _, event := range events {
+		if event.name == name {
+			return event
+		}
+	}
+	t.Fatalf("no %s event in %v", name, eventNames(events))
+	return sseEvent{}
+}
+
+// streamText concatenates the text deltas of an Anthropic stream
+func streamText(events []sseEvent) string {
+	var b strings.Builder
+	for _, event := range events {
+		if event.name != "content_block_delta" {
+			continue
+		}
+		delta, _ := event.data["delta"].(map[string]interface{})
+		if text, ok := delta["text"].(string); ok {
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+// fakeClock is a Clock frozen at now until advanced; its timers fire
+// when Advance reaches them
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+// pendingTimers reports how many timers wait for Advance
+func (c *fakeClock) pendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
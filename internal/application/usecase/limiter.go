@@ -0,0 +1,68 @@
+package usecase
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+	"api-conver/internal/infrastructure/metrics"
+)
+
+// concurrencyLimiter bounds in-flight requests per alias. Requests beyond
+// max_concurrent wait in a queue until a slot frees up or the client goes
+// away.
+type concurrencyLimiter struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{slots: map[string]chan struct{}{}}
+}
+
+// slotsFor returns the semaphore for alias, replacing it when the
+// configured limit changed. Requests holding a slot of a replaced
+// semaphore release into it harmlessly.
+func (l *concurrencyLimiter) slotsFor(alias string, limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots := l.slots[alias]
+	if slots == nil || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		l.slots[alias] = slots
+	}
+	return slots
+}
+
+// acquireSlot waits for a concurrency slot for alias and returns the
+// function releasing it. It reports false when the client disconnected
+// while queued.
+func (u *ProxyUseCase) acquireSlot(c *gin.Context, alias string) (func(), bool) {
+	name := resolveAlias(alias)
+	cfg := config.GetAliasConfig(name)
+	if cfg == nil || cfg.MaxConcurrent <= 0 {
+		return func() {}, true
+	}
+	slots := u.limiter.slotsFor(name, cfg.MaxConcurrent)
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		metrics.Default().ObserveQueueWait(name, 0, false)
+		return release, true
+	default:
+	}
+
+	registry := metrics.Default()
+	registry.AddQueueDepth(name, 1)
+	defer registry.AddQueueDepth(name, -1)
+	start := u.clock.Now()
+	select {
+	case slots <- struct{}{}:
+		registry.ObserveQueueWait(name, u.clock.Now().Sub(start), true)
+		return release, true
+	case <-c.Request.Context().Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,170 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"api-conver/internal/config"
+	"api-conver/internal/domain/model"
+	"api-conver/internal/infrastructure/metrics"
+)
+
+const (
+	maxMessagesModeReject = "reject"
+	maxMessagesModeWindow = "window"
+)
+
+// messageLimit returns the alias's max_messages and whether overflowing
+// conversations are rejected rather than windowed.
+func messageLimit(alias string) (int, bool) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || cfg.MaxMessages <= 0 {
+		return 0, false
+	}
+	mode := strings.ToLower(strings.TrimSpace(cfg.MaxMessagesMode))
+	return cfg.MaxMessages, mode != maxMessagesModeWindow
+}
+
+func tooManyMessagesMessage(count, limit int) string {
+	return fmt.Sprintf("too many messages: %d exceeds the limit of %d", count, limit)
+}
+
+// countNonSystem counts the messages that are subject to max_messages.
+// System prompts are never counted or dropped.
+func countNonSystem[T any](messages []T, role func(T) string) int {
+	count := 0
+	for _, msg := range messages {
+		if !isSystemRole(role(msg)) {
+			count++
+		}
+	}
+	return count
+}
+
+// windowMessages keeps system messages plus the most recent limit other
+// messages. Leading messages whose role is not "user" are dropped from the
+// window so the conversation never starts with an orphaned assistant turn
+// or tool result; role reports "tool" for messages that only answer tool
+// calls, whatever their protocol role.
+func windowMessages[T any](messages []T, limit int, role func(T) string) []T {
+	if limit <= 0 || countNonSystem(messages, role) <= limit {
+		return messages
+	}
+
+	system := make([]T, 0)
+	rest := make([]T, 0, len(messages))
+	for _, msg := range messages {
+		if isSystemRole(role(msg)) {
+			system = append(system, msg)
+			continue
+		}
+		rest = append(rest, msg)
+	}
+
+	rest = rest[len(rest)-limit:]
+	for len(rest) > 1 && role(rest[0]) != "user" {
+		rest = rest[1:]
+	}
+	return append(system, rest...)
+}
+
+// countToolRounds counts tool call round trips in a conversation history,
+// one per assistant turn that requests tools.
+func countToolRounds[T any](messages []T, callsTools func(T) bool) int {
+	rounds := 0
+	for _, msg := range messages {
+		if callsTools(msg) {
+			rounds++
+		}
+	}
+	return rounds
+}
+
+// trackToolRounds records the tool call rounds of a request and logs
+// conversations that exceed the alias's max_tool_rounds.
+func trackToolRounds(alias string, rounds int) {
+	limit := 0
+	if cfg := config.GetAliasConfig(resolveAlias(alias)); cfg != nil {
+		limit = cfg.MaxToolRounds
+	}
+	exceeded := limit > 0 && rounds > limit
+	if exceeded {
+		log.Printf("alias %q: conversation has %d tool call rounds, exceeding max_tool_rounds %d", resolveAlias(alias), rounds, limit)
+	}
+	metrics.Default().ObserveToolRounds(resolveAlias(alias), rounds, exceeded)
+}
+
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
+
+func chatMessageRole(msg map[string]interface{}) string {
+	role, _ := msg["role"].(string)
+	return role
+}
+
+func rawMessageRole(msg interface{}) string {
+	if m, ok := msg.(map[string]interface{}); ok {
+		return chatMessageRole(m)
+	}
+	return ""
+}
+
+// anthropicMessageRole reports user messages holding only tool_result
+// blocks as "tool": they convert to OpenAI tool messages and must follow
+// the assistant turn that made the calls.
+func anthropicMessageRole(msg model.AnthropicMessage) string {
+	if msg.Role != "user" {
+		return msg.Role
+	}
+	blocks, ok := msg.Content.([]interface{})
+	if !ok || len(blocks) == 0 {
+		return msg.Role
+	}
+	for _, block := range blocks {
+		if b, ok := block.(map[string]interface{}); !ok || b["type"] != "tool_result" {
+			return msg.Role
+		}
+	}
+	return "tool"
+}
+
+func chatMessageCallsTools(msg map[string]interface{}) bool {
+	if role, _ := msg["role"].(string); role != "assistant" {
+		return false
+	}
+	if msg["function_call"] != nil {
+		return true
+	}
+	switch calls := msg["tool_calls"].(type) {
+	case []interface{}:
+		return len(calls) > 0
+	case []map[string]interface{}:
+		return len(calls) > 0
+	}
+	return false
+}
+
+func rawMessageCallsTools(msg interface{}) bool {
+	if m, ok := msg.(map[string]interface{}); ok {
+		return chatMessageCallsTools(m)
+	}
+	return false
+}
+
+func anthropicMessageCallsTools(msg model.AnthropicMessage) bool {
+	if msg.Role != "assistant" {
+		return false
+	}
+	blocks, ok := msg.Content.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, block := range blocks {
+		if b, ok := block.(map[string]interface{}); ok && b["type"] == "tool_use" {
+			return true
+		}
+	}
+	return false
+}
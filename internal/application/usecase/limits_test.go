@@ -0,0 +1,264 @@
+package usecase
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"api-conver/internal/domain/model"
+	"api-conver/internal/infrastructure/metrics"
+)
+
+const maxMessagesConfig = `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    max_messages: 2
+    max_messages_mode: %s
+`
+
+func TestMaxMessagesRejectMode(t *testing.T) {
+	for _, mode := range []string{`"reject"`, `""`} {
+		loadConfig(t, fmt.Sprintf(maxMessagesConfig, mode))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/v1/messages", `{"model":"m","max_tokens":16,"messages":[
+			{"role":"user","content":"one"},
+			{"role":"assistant","content":"two"},
+			{"role":"user","content":"three"}]}`)
+		if resp.Code != 400 {
+			t.Fatalf("mode %s: status = %d, want 400: %s", mode, resp.Code, resp.Body)
+		}
+		body := decodeJSON(t, resp)
+		detail, _ := body["error"].(map[string]interface{})
+		if body["type"] != "error" || detail["type"] != "invalid_request_error" {
+			t.Errorf("mode %s: not an Anthropic invalid_request_error: %s", mode, resp.Body)
+		}
+		if message, _ := detail["message"].(string); !strings.Contains(message, "3 exceeds the limit of 2") {
+			t.Errorf("mode %s: message = %q", mode, message)
+		}
+		if upstream.count() != 0 {
+			t.Errorf("mode %s: rejected request reached the upstream", mode)
+		}
+	}
+}
+
+func TestMaxMessagesRejectModeOpenAI(t *testing.T) {
+	loadConfig(t, fmt.Sprintf(maxMessagesConfig, `"reject"`))
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	// System messages do not count towards the limit
+	resp := serve(engine, "POST", "/v1/chat/completions", `{"model":"m","messages":[
+		{"role":"system","content":"s"},
+		{"role":"user","content":"one"},
+		{"role":"assistant","content":"two"}]}`)
+	if resp.Code != 200 {
+		t.Fatalf("within limit: status = %d: %s", resp.Code, resp.Body)
+	}
+
+	resp = serve(engine, "POST", "/v1/chat/completions", `{"model":"m","messages":[
+		{"role":"system","content":"s"},
+		{"role":"user","content":"one"},
+		{"role":"assistant","content":"two"},
+		{"role":"user","content":"three"}]}`)
+	if resp.Code != 400 {
+		t.Fatalf("over limit: status = %d, want 400: %s", resp.Code, resp.Body)
+	}
+	detail, _ := decodeJSON(t, resp)["error"].(map[string]interface{})
+	if detail["type"] != "invalid_request_error" {
+		t.Errorf("error = %v, want an OpenAI invalid_request_error", detail)
+	}
+	if upstream.count() != 1 {
+		t.Errorf("upstream requests = %d, want only the one within the limit", upstream.count())
+	}
+}
+
+func TestMaxMessagesWindowDropsOrphanedToolResults(t *testing.T) {
+	loadConfig(t, fmt.Sprintf(maxMessagesConfig, `"window"`))
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	// The last two messages start with tool results whose tool_use falls
+	// outside the window.
+	resp := serve(engine, "POST", "/v1/messages", `{"model":"m","max_tokens":16,"messages":[
+		{"role":"user","content":"weather?"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"weather","input":{}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"sunny"}]},
+		{"role":"user","content":"thanks"}]}`)
+	if resp.Code != 200 {
+		t.Fatalf("status = %d: %s", resp.Code, resp.Body)
+	}
+	messages, _ := upstream.last(t).json(t)["messages"].([]interface{})
+	if len(messages) != 1 {
+		t.Fatalf("upstream messages = %v, want only the plain user turn", messages)
+	}
+	if msg := messages[0].(map[string]interface{}); msg["role"] != "user" || msg["content"] != "thanks" {
+		t.Errorf("upstream message = %v", msg)
+	}
+}
+
+func TestWindowMessagesKeepsSystemAndRecentTurns(t *testing.T) {
+	messages := []model.AnthropicMessage{
+		{Role: "user", Content: "one"},
+		{Role: "assistant", Content: "two"},
+		{Role: "user", Content: "three"},
+		{Role: "assistant", Content: "four"},
+	}
+	got := windowMessages(messages, 3, anthropicMessageRole)
+	// The window [two, three, four] starts on an assistant turn
+	if len(got) != 2 || got[0].Content != "three" || got[1].Content != "four" {
+		t.Errorf("window = %v", got)
+	}
+
+	chat := []map[string]interface{}{
+		{"role": "system", "content": "s"},
+		{"role": "user", "content": "one"},
+		{"role": "assistant", "content": "two"},
+		{"role": "user", "content": "three"},
+	}
+	windowed := windowMessages(chat, 1, chatMessageRole)
+	if len(windowed) != 2 || windowed[0]["role"] != "system" || windowed[1]["content"] != "three" {
+		t.Errorf("chat window = %v", windowed)
+	}
+}
+
+func TestCountToolRounds(t *testing.T) {
+	toolUse := func(id string) map[string]interface{} {
+		return map[string]interface{}{"type": "tool_use", "id": id, "name": "search", "input": map[string]interface{}{}}
+	}
+	toolResult := func(id string) map[string]interface{} {
+		return map[string]interface{}{"type": "tool_result", "tool_use_id": id, "content": "ok"}
+	}
+	anthropic := []model.AnthropicMessage{
+		{Role: "user", Content: "find it"},
+		{Role: "assistant", Content: []interface{}{toolUse("t1")}},
+		{Role: "user", Content: []interface{}{toolResult("t1")}},
+		{Role: "assistant", Content: []interface{}{map[string]interface{}{"type": "text", "text": "again"}, toolUse("t2"), toolUse("t3")}},
+		{Role: "user", Content: []interface{}{toolResult("t2"), toolResult("t3")}},
+		{Role: "assistant", Content: "plain answer"},
+		{Role: "user", Content: "and now?"},
+		{Role: "assistant", Content: []interface{}{toolUse("t4")}},
+		{Role: "user", Content: []interface{}{toolResult("t4")}},
+	}
+	if got := countToolRounds(anthropic, anthropicMessageCallsTools); got != 3 {
+		t.Errorf("anthropic rounds = %d, want 3", got)
+	}
+
+	call := []interface{}{map[string]interface{}{"id": "c1", "type": "function", "function": map[string]interface{}{"name": "search", "arguments": "{}"}}}
+	chat := []map[string]interface{}{
+		{"role": "user", "content": "find it"},
+		{"role": "assistant", "tool_calls": call},
+		{"role": "tool", "tool_call_id": "c1", "content": "ok"},
+		{"role": "assistant", "content": nil, "function_call": map[string]interface{}{"name": "search", "arguments": "{}"}},
+		{"role": "function", "name": "search", "content": "ok"},
+		{"role": "assistant", "tool_calls": []interface{}{}},
+		{"role": "user", "tool_calls": call},
+	}
+	if got := countToolRounds(chat, chatMessageCallsTools); got != 2 {
+		t.Errorf("chat rounds = %d, want 2", got)
+	}
+}
+
+func TestToolRoundsMetrics(t *testing.T) {
+	alias := fmt.Sprintf("rounds%d", time.Now().UnixNano())
+	loadConfig(t, fmt.Sprintf(`
+aliases:
+  %s:
+    base_url: "http://upstream.test/v1"
+    max_tool_rounds: 1
+`, alias))
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	serve(engine, "POST", "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"messages":[
+		{"role":"user","content":"go"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"s","input":{}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"ok"}]},
+		{"role":"assistant","content":[{"type":"tool_use","id":"t2","name":"s","input":{}}]},
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"t2","content":"ok"}]}]}`)
+
+	scraped := scrapeMetrics(t)
+	for _, line := range []string{
+		fmt.Sprintf(`api_conver_tool_call_rounds_sum{alias="%s"} 2`, alias),
+		fmt.Sprintf(`api_conver_tool_call_rounds_count{alias="%s"} 1`, alias),
+		fmt.Sprintf(`api_conver_tool_call_rounds_exceeded_total{alias="%s"} 1`, alias),
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+// scrapeMetrics renders the default registry
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	var b strings.Builder
+	if err := metrics.Default().WritePrometheus(&b); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	return b.String()
+}
+
+func TestQueueMetricsUnderLoad(t *testing.T) {
+	alias := fmt.Sprintf("queue%d", time.Now().UnixNano())
+	loadConfig(t, fmt.Sprintf(`
+aliases:
+  %s:
+    base_url: "http://upstream.test/v1"
+    max_concurrent: 1
+`, alias))
+	arrived := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		arrived <- struct{}{}
+		<-unblock
+		return jsonResponse(200, completion("m", "hi", "stop")), nil
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	var wg sync.WaitGroup
+	send := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(engine, "POST", "/"+alias+"/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+		}()
+	}
+	send()
+	<-arrived
+	send()
+	send()
+
+	depth := fmt.Sprintf(`api_conver_queue_depth{alias="%s"} `, alias)
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(scrapeMetrics(t), depth+"2\n") {
+		if time.Now().After(deadline) {
+			close(unblock)
+			t.Fatalf("queue depth never reached 2:\n%s", scrapeMetrics(t))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if upstream.count() != 1 {
+		t.Errorf("upstream requests = %d while queued, want 1", upstream.count())
+	}
+	close(unblock)
+	wg.Wait()
+
+	scraped := scrapeMetrics(t)
+	for _, line := range []string{
+		depth + "0",
+		fmt.Sprintf(`api_conver_queue_admitted_total{alias="%s"} 3`, alias),
+		fmt.Sprintf(`api_conver_queue_wait_seconds_count{alias="%s"} 2`, alias),
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package usecase
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+)
+
+// publishedModels returns the model ids an alias advertises to clients
+func publishedModels(alias string) []string {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil {
+		return nil
+	}
+	models := []string{}
+	seen := map[string]struct{}{}
+	add := func(id string) {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return
+		}
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		models = append(models, id)
+	}
+	add(cfg.DefaultModel)
+	mapped := make([]string, 0, len(cfg.ModelMap))
+	for id := range cfg.ModelMap {
+		mapped = append(mapped, id)
+	}
+	sort.Strings(mapped)
+	for _, id := range mapped {
+		add(id)
+	}
+	for _, id := range cfg.AllowedModels {
+		if id != allowAllModels {
+			add(id)
+		}
+	}
+	return models
+}
+
+// allowAllModels is the allowed_models entry permitting any model
+const allowAllModels = "*"
+
+// modelAllowed reports whether the alias whitelist permits the requested
+// model. Matching is case-sensitive; an empty list allows every model.
+func modelAllowed(alias, requested string) bool {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || len(cfg.AllowedModels) == 0 {
+		return true
+	}
+	for _, id := range cfg.AllowedModels {
+		if id == allowAllModels || id == requested {
+			return true
+		}
+	}
+	return false
+}
+
+func modelNotAllowedMessage(requested string) string {
+	return "The model '" + requested + "' is not allowed for this endpoint"
+}
+
+func modelObject(alias, id string) gin.H {
+	owner := resolveAlias(alias)
+	if owner == "" {
+		owner = "api-conver"
+	}
+	return gin.H{
+		"id":       id,
+		"object":   "model",
+		"created":  0,
+		"owned_by": owner,
+	}
+}
+
+// HandleModels handles GET /v1/models. The list is synthesized from the
+// alias config; aliases without configured models proxy upstream.
+func (u *ProxyUseCase) HandleModels(c *gin.Context, alias string) {
+	models := publishedModels(alias)
+	if len(models) == 0 {
+		u.handleAuxProxy(c, alias)
+		return
+	}
+
+	data := make([]gin.H, 0, len(models))
+	for _, id := range models {
+		data = append(data, modelObject(alias, id))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// HandleModel handles GET /v1/models/*id; the catch-all keeps ids with
+// slashes, such as org/model, in one parameter.
+func (u *ProxyUseCase) HandleModel(c *gin.Context, alias string) {
+	models := publishedModels(alias)
+	if len(models) == 0 {
+		u.handleAuxProxy(c, alias)
+		return
+	}
+
+	id := strings.TrimPrefix(c.Param("id"), "/")
+	for _, model := range models {
+		if model == id {
+			c.JSON(http.StatusOK, modelObject(alias, id))
+			return
+		}
+	}
+	writeOpenAIError(c, http.StatusNotFound, "invalid_request_error", "The model '"+id+"' does not exist")
+}
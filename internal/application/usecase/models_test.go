@@ -0,0 +1,203 @@
+package usecase
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"api-conver/internal/infrastructure/proxy"
+)
+
+func TestHandleModel(t *testing.T) {
+	loadConfig(t, `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    default_model: "gpt-4o"
+    model_map:
+      org/model: "upstream-model"
+`)
+	upstream := newStubUpstream(replyJSON(500, `{}`))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for _, path := range []string{"/v1/models/", "/a/v1/models/"} {
+		for _, id := range []string{"gpt-4o", "org/model"} {
+			resp := serve(engine, http.MethodGet, path+id, "")
+			if resp.Code != http.StatusOK {
+				t.Fatalf("GET %s%s: status = %d: %s", path, id, resp.Code, resp.Body.String())
+			}
+			if model := decodeJSON(t, resp); model["id"] != id || model["object"] != "model" {
+				t.Errorf("GET %s%s = %v", path, id, model)
+			}
+		}
+		for _, id := range []string{"missing", "org/missing"} {
+			resp := serve(engine, http.MethodGet, path+id, "")
+			if resp.Code != http.StatusNotFound {
+				t.Fatalf("GET %s%s: status = %d, want 404", path, id, resp.Code)
+			}
+			detail := decodeJSON(t, resp)["error"].(map[string]interface{})
+			if detail["message"] != "The model '"+id+"' does not exist" {
+				t.Errorf("GET %s%s error = %v", path, id, detail)
+			}
+		}
+	}
+	if upstream.count() != 0 {
+		t.Errorf("upstream received %d requests, want none for published models", upstream.count())
+	}
+}
+
+func TestHandleModelsSynthesized(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    default_model: "gpt-4o"
+    model_map:
+      claude-3-5-sonnet: "qwen2.5-72b"
+      claude-3-haiku: "qwen2.5-7b"
+    allowed_models: ["gpt-4o", "o1-mini", "*"]
+`)
+	upstream := newStubUpstream(replyJSON(500, `{}`))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, http.MethodGet, "/a/v1/models", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.Code, resp.Body.String())
+	}
+	list := decodeJSON(t, resp)
+	var ids []string
+	for _, item := range list["data"].([]interface{}) {
+		model := item.(map[string]interface{})
+		if model["object"] != "model" || model["owned_by"] != "a" {
+			t.Errorf("model = %v", model)
+		}
+		ids = append(ids, model["id"].(string))
+	}
+	want := []string{"gpt-4o", "claude-3-5-sonnet", "claude-3-haiku", "o1-mini"}
+	if list["object"] != "list" || !reflect.DeepEqual(ids, want) {
+		t.Errorf("object = %v, ids = %v, want %v", list["object"], ids, want)
+	}
+	if upstream.count() != 0 {
+		t.Errorf("upstream received %d requests, want none", upstream.count())
+	}
+}
+
+func TestHandleModelsPassthrough(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	const upstreamList = `{"object":"list","data":[{"id":"upstream-model","object":"model","owned_by":"upstream"}]}`
+	upstream := newStubUpstream(replyJSON(200, upstreamList))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, http.MethodGet, "/a/v1/models", "")
+	if resp.Code != http.StatusOK || resp.Body.String() != upstreamList {
+		t.Errorf("status = %d, body = %s, want the upstream list", resp.Code, resp.Body.String())
+	}
+	request := upstream.last(t)
+	if request.method != http.MethodGet || request.url != "http://upstream.test/v1/models" {
+		t.Errorf("upstream request = %s %s", request.method, request.url)
+	}
+
+	serve(engine, http.MethodGet, "/a/v1/models/upstream-model", "")
+	if request := upstream.last(t); request.url != "http://upstream.test/v1/models/upstream-model" {
+		t.Errorf("upstream request = %s %s", request.method, request.url)
+	}
+}
+
+func TestAllowedModels(t *testing.T) {
+	requests := []struct{ path, body string }{
+		{"/a/v1/chat/completions", `{"model":"%s","messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/messages", `{"model":"%s","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/responses", `{"model":"%s","input":"hi"}`},
+	}
+	for _, tc := range []struct {
+		name    string
+		allowed string
+		model   string
+		allow   bool
+	}{
+		{name: "allowed", allowed: `["gpt-4o", "claude-3-5-sonnet"]`, model: "gpt-4o", allow: true},
+		{name: "denied", allowed: `["gpt-4o"]`, model: "gpt-4o-mini"},
+		{name: "case-sensitive", allowed: `["gpt-4o"]`, model: "GPT-4o"},
+		{name: "wildcard", allowed: `["gpt-4o", "*"]`, model: "anything", allow: true},
+		{name: "empty list", allowed: `[]`, model: "anything", allow: true},
+	} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    allowed_models: %s
+`, tc.allowed))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		for _, req := range requests {
+			resp := serve(engine, "POST", req.path, fmt.Sprintf(req.body, tc.model))
+			if tc.allow {
+				if resp.Code != http.StatusOK {
+					t.Errorf("%s %s: status = %d: %s", tc.name, req.path, resp.Code, resp.Body.String())
+				}
+				continue
+			}
+			if resp.Code != http.StatusForbidden {
+				t.Errorf("%s %s: status = %d, want 403", tc.name, req.path, resp.Code)
+				continue
+			}
+			detail := decodeJSON(t, resp)["error"].(map[string]interface{})
+			if detail["type"] != "permission_error" || detail["message"] != "The model '"+tc.model+"' is not allowed for this endpoint" {
+				t.Errorf("%s %s: error = %v", tc.name, req.path, detail)
+			}
+		}
+		if want := map[bool]int{true: len(requests), false: 0}[tc.allow]; upstream.count() != want {
+			t.Errorf("%s: upstream requests = %d, want %d", tc.name, upstream.count(), want)
+		}
+	}
+}
+
+func TestModelsProxyUsesAuxTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		want   time.Duration
+	}{
+		{config: "timeout: 300\n    aux_timeout: 2", want: 2 * time.Second},
+		{config: "timeout: 300", want: proxy.DefaultAuxTimeout},
+	} {
+		loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    `+tc.config+`
+`)
+		var remaining []time.Duration
+		upstream := newStubUpstream(func(req *http.Request) (*http.Response, error) {
+			deadline, ok := req.Context().Deadline()
+			if !ok {
+				t.Errorf("%s: upstream request has no deadline", tc.config)
+			}
+			remaining = append(remaining, time.Until(deadline))
+			return jsonResponse(200, `{"object":"list","data":[]}`), nil
+		})
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		for _, path := range []string{"/a/v1/models", "/a/v1/models/m"} {
+			if resp := serve(engine, "GET", path, ""); resp.Code != 200 {
+				t.Fatalf("%s: GET %s: status %d: %s", tc.config, path, resp.Code, resp.Body)
+			}
+		}
+		if len(remaining) != 2 {
+			t.Fatalf("%s: upstream saw %d requests, want 2", tc.config, len(remaining))
+		}
+		for _, d := range remaining {
+			if d > tc.want || d < tc.want-time.Second {
+				t.Errorf("%s: deadline in %v, want about %v", tc.config, d, tc.want)
+			}
+		}
+	}
+}
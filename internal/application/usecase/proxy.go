@@ -1,10 +1,15 @@
 package usecase
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -12,23 +17,75 @@ import (
 	"api-conver/internal/domain/model"
 	"api-conver/internal/domain/service"
 	"api-conver/internal/infrastructure/proxy"
+	"api-conver/internal/infrastructure/repository"
 )
 
 // ProxyUseCase handles proxy requests
 type ProxyUseCase struct {
 	converter *service.Converter
 	client    *proxy.Client
+	clock     Clock
+	idPrefix  string
+	limiter   *concurrencyLimiter
+	estimator service.TokenEstimator
+	responses *repository.ResponseStore
 }
 
-func NewProxyUseCase() *ProxyUseCase {
-	return &ProxyUseCase{
+func NewProxyUseCase(opts ...Option) *ProxyUseCase {
+	u := &ProxyUseCase{
 		converter: service.NewConverter(),
-		client:    proxy.NewClient(),
+		clock:     systemClock{},
+		idPrefix:  "msg_",
+		limiter:   newConcurrencyLimiter(),
+		estimator: service.HeuristicEstimator{},
+		responses: repository.NewResponseStore(),
 	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.client == nil {
+		u.client = newUpstreamClient()
+	}
+	return u
+}
+
+// newUpstreamClient builds the upstream client, recording or replaying
+// interactions when a cassette is configured.
+func newUpstreamClient() *proxy.Client {
+	defaults := config.Get().Defaults
+	opts := []proxy.ClientOption{
+		proxy.WithStreamIdleConnTimeout(time.Duration(defaults.StreamIdleConnTimeout) * time.Second),
+	}
+	settings := defaults.Cassette
+	cassette, err := proxy.NewCassette(settings.Mode, settings.Dir)
+	if err != nil {
+		log.Printf("cassette disabled: %v", err)
+		return proxy.NewClient(opts...)
+	}
+	if cassette != nil {
+		log.Printf("cassette %s mode enabled", strings.ToLower(strings.TrimSpace(settings.Mode)))
+	}
+	return proxy.NewClient(append(opts, proxy.WithCassette(cassette))...)
+}
+
+// Warmup preconnects to every configured upstream
+func (u *ProxyUseCase) Warmup(ctx context.Context) {
+	cfg := config.Get()
+	baseURLs := make([]string, 0, len(cfg.Aliases))
+	for _, alias := range cfg.Aliases {
+		baseURLs = append(baseURLs, alias.BaseURL)
+	}
+	u.client.Warmup(ctx, baseURLs)
 }
 
 // HandleOpenAI handles OpenAI /v1/chat/completions request
 func (u *ProxyUseCase) HandleOpenAI(c *gin.Context, alias string) {
+	release, ok := u.acquireSlot(c, alias)
+	if !ok {
+		return
+	}
+	defer release()
+
 	var payload map[string]interface{}
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(400, gin.H{"error": "invalid json"})
@@ -39,27 +96,85 @@ func (u *ProxyUseCase) HandleOpenAI(c *gin.Context, alias string) {
 	if modelVal, ok := payload["model"].(string); !ok || modelVal == "" {
 		payload["model"] = getDefaultModel(alias)
 	}
+	if override := queryModelOverride(c); override != "" {
+		payload["model"] = override
+	}
+	if modelVal, ok := payload["model"].(string); ok {
+		if !modelAllowed(alias, modelVal) {
+			writeOpenAIError(c, 403, "permission_error", modelNotAllowedMessage(modelVal))
+			return
+		}
+		payload["model"] = mapModel(alias, modelVal)
+	}
 	if _, ok := payload["stream"]; !ok || payload["stream"] == nil {
 		payload["stream"] = false
 	}
+	if messages, ok := payload["messages"].([]interface{}); ok {
+		if limit, reject := messageLimit(alias); limit > 0 {
+			if count := countNonSystem(messages, rawMessageRole); count > limit {
+				if reject {
+					writeOpenAIError(c, 400, "invalid_request_error", tooManyMessagesMessage(count, limit))
+					return
+				}
+				payload["messages"] = windowMessages(messages, limit, rawMessageRole)
+			}
+		}
+		trackToolRounds(alias, countToolRounds(messages, rawMessageCallsTools))
+	}
 
-	out, _ := json.Marshal(payload)
+	stripNullFields(payload, alias)
+	redactPII(payload, alias)
+	setConvertedHeaders(c, payload, alias)
 
-	aliasCfg := getUpstreamConfig(alias)
 	upstreamPath := stripAliasPrefix(c.Request.URL.Path, alias)
-	respBody, statusCode, headers, err := u.client.ProxyRequest(c, out, "POST", upstreamPath, aliasCfg)
+	clientStream, _ := payload["stream"].(bool)
+	if clientStream && forcedStreamMode(alias) == streamModeNonStream {
+		resp, err := u.upstreamStream(c, payload, upstreamPath, alias)
+		if err != nil {
+			c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		defer resp.Body.Close()
+		copyHeaders(c, resp.Header)
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	var respBody []byte
+	var statusCode int
+	var headers http.Header
+	var err error
+	if clientStream {
+		out, _ := json.Marshal(payload)
+		respBody, statusCode, headers, err = u.client.ProxyRequest(c, out, "POST", upstreamPath, getUpstreamConfig(alias))
+		if fallback, ok := u.fallbackCompletion(alias, payload, statusCode, err); ok {
+			resp := u.fallbackStream(fallback)
+			copyHeaders(c, resp.Header)
+			c.Status(resp.StatusCode)
+			io.Copy(c.Writer, resp.Body)
+			return
+		}
+	} else {
+		respBody, statusCode, headers, err = u.upstreamComplete(c, payload, upstreamPath, alias)
+	}
 	if err != nil {
-		c.JSON(502, gin.H{"error": err.Error()})
+		c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	copyHeaders(c, headers)
-	c.Status(statusCode)
-	c.Data(http.StatusOK, "application/json", respBody)
+	c.Data(statusCode, "application/json", respBody)
 }
 
 // HandleResponses handles OpenAI /v1/responses request
 func (u *ProxyUseCase) HandleResponses(c *gin.Context, alias string) {
+	release, ok := u.acquireSlot(c, alias)
+	if !ok {
+		return
+	}
+	defer release()
+
 	var payload map[string]interface{}
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(400, gin.H{"error": "invalid json"})
@@ -71,16 +186,39 @@ func (u *ProxyUseCase) HandleResponses(c *gin.Context, alias string) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if override := queryModelOverride(c); override != "" {
+		chatReq["model"] = override
+	}
+	reqModel, _ := chatReq["model"].(string)
+	if !modelAllowed(alias, reqModel) {
+		writeOpenAIError(c, 403, "permission_error", modelNotAllowedMessage(reqModel))
+		return
+	}
+	chatReq["model"] = mapModel(alias, reqModel)
+	applyConvertedQueryPolicy(c, alias)
+	if messages, ok := chatReq["messages"].([]map[string]interface{}); ok {
+		if limit, reject := messageLimit(alias); limit > 0 {
+			if count := countNonSystem(messages, chatMessageRole); count > limit {
+				if reject {
+					writeOpenAIError(c, 400, "invalid_request_error", tooManyMessagesMessage(count, limit))
+					return
+				}
+				chatReq["messages"] = windowMessages(messages, limit, chatMessageRole)
+			}
+		}
+		trackToolRounds(alias, countToolRounds(messages, chatMessageCallsTools))
+	}
+	stripNullFields(chatReq, alias)
+	redactPII(chatReq, alias)
+	setConvertedHeaders(c, chatReq, alias)
 
-	out, _ := json.Marshal(chatReq)
-
-	aliasCfg := getUpstreamConfig(alias)
 	if stream {
-		resp, err := u.client.ProxyStream(c, out, "POST", "/v1/chat/completions", aliasCfg)
+		resp, err := u.upstreamStream(c, chatReq, "/v1/chat/completions", alias)
 		if err != nil {
-			c.JSON(502, gin.H{"error": err.Error()})
+			c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
+		defer resp.Body.Close()
 
 		if resp.StatusCode < 200 || resp.StatusCode > 299 {
 			copyHeaders(c, resp.Header)
@@ -95,23 +233,23 @@ func (u *ProxyUseCase) HandleResponses(c *gin.Context, alias string) {
 		c.Header("Connection", "keep-alive")
 		c.Header("X-Accel-Buffering", "no")
 		c.Status(http.StatusOK)
-		reqModel, _ := chatReq["model"].(string)
-		if err := u.streamOpenAIToResponses(c, resp, reqModel); err != nil {
-			c.JSON(502, gin.H{"error": err.Error()})
+		completed, err := u.streamOpenAIToResponses(c, resp, reqModel, streamOptionsFor(alias))
+		if err != nil {
+			log.Printf("responses stream aborted: %v", err)
 		}
+		u.storeResponse(alias, payload, completed)
 		return
 	}
 
-	respBody, statusCode, headers, err := u.client.ProxyRequest(c, out, "POST", "/v1/chat/completions", aliasCfg)
+	respBody, statusCode, headers, err := u.upstreamComplete(c, chatReq, "/v1/chat/completions", alias)
 	if err != nil {
-		c.JSON(502, gin.H{"error": err.Error()})
+		c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	if statusCode < 200 || statusCode > 299 {
 		copyHeaders(c, headers)
-		c.Status(statusCode)
-		c.Data(http.StatusOK, "application/json", respBody)
+		c.Data(statusCode, "application/json", respBody)
 		return
 	}
 
@@ -120,13 +258,20 @@ func (u *ProxyUseCase) HandleResponses(c *gin.Context, alias string) {
 		c.JSON(502, gin.H{"error": "invalid upstream response"})
 		return
 	}
-	reqModel, _ := chatReq["model"].(string)
+	openAIResp.Model = responseModel(alias, reqModel, openAIResp.Model)
 	response := u.convertOpenAIResponseToResponses(openAIResp, reqModel)
+	u.storeResponse(alias, payload, response)
 	c.JSON(200, response)
 }
 
 // HandleAnthropic handles Anthropic /v1/messages request
 func (u *ProxyUseCase) HandleAnthropic(c *gin.Context, alias string) {
+	release, ok := u.acquireSlot(c, alias)
+	if !ok {
+		return
+	}
+	defer release()
+
 	var req model.AnthropicRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "invalid json"})
@@ -137,202 +282,450 @@ func (u *ProxyUseCase) HandleAnthropic(c *gin.Context, alias string) {
 	if req.Model == "" {
 		req.Model = getDefaultModel(alias)
 	}
+	if override := queryModelOverride(c); override != "" {
+		req.Model = override
+	}
+	if !modelAllowed(alias, req.Model) {
+		writeAnthropicError(c, 403, "permission_error", modelNotAllowedMessage(req.Model))
+		return
+	}
+	applyConvertedQueryPolicy(c, alias)
+	if limit, reject := messageLimit(alias); limit > 0 && len(req.Messages) > limit {
+		if reject {
+			writeAnthropicError(c, 400, "invalid_request_error", tooManyMessagesMessage(len(req.Messages), limit))
+			return
+		}
+		req.Messages = windowMessages(req.Messages, limit, anthropicMessageRole)
+	}
+	trackToolRounds(alias, countToolRounds(req.Messages, anthropicMessageCallsTools))
 
 	if req.Stream {
 		u.handleAnthropicStream(c, req, alias)
 		return
 	}
 
-	openAIMessages, err := u.converter.ConvertAnthropicToOpenAIMessages(req.System, req.Messages)
+	openAIReq, converter, err := u.buildAnthropicChatRequest(req, alias, false)
 	if err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
+		writeAnthropicError(c, 400, "invalid_request_error", err.Error())
 		return
 	}
+	stripNullFields(openAIReq, alias)
+	redactPII(openAIReq, alias)
+	setConvertedHeaders(c, openAIReq, alias)
 
-	openAIReq := map[string]interface{}{
-		"model":    req.Model,
-		"messages": openAIMessages,
-		"stream":   false,
-	}
-	if req.MaxTokens > 0 {
-		openAIReq["max_tokens"] = req.MaxTokens
-	}
-	if req.Temperature != nil {
-		openAIReq["temperature"] = *req.Temperature
-	}
-	if req.TopP != nil {
-		openAIReq["top_p"] = *req.TopP
-	}
-	if len(req.StopSequences) > 0 {
-		openAIReq["stop"] = req.StopSequences
-	}
-	if tools := u.converter.ConvertAnthropicTools(req.Tools); len(tools) > 0 {
-		openAIReq["tools"] = tools
-	}
-	if req.ToolChoice != nil {
-		openAIReq["tool_choice"] = u.converter.ConvertAnthropicToolChoice(req.ToolChoice)
-	}
-
-	out, _ := json.Marshal(openAIReq)
-
-	aliasCfg := getUpstreamConfig(alias)
-	respBody, statusCode, headers, err := u.client.ProxyRequest(c, out, "POST", "/v1/chat/completions", aliasCfg)
+	respBody, statusCode, headers, err := u.upstreamComplete(c, openAIReq, "/v1/chat/completions", alias)
 	if err != nil {
-		c.JSON(502, gin.H{"error": err.Error()})
+		writeAnthropicError(c, upstreamErrorStatus(err), "api_error", err.Error())
 		return
 	}
 
 	if statusCode < 200 || statusCode > 299 {
 		copyHeaders(c, headers)
-		c.Status(statusCode)
-		c.Data(http.StatusOK, "application/json", respBody)
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(statusCode, u.converter.ConvertOpenAIError(statusCode, respBody))
 		return
 	}
 
 	var openAIResp model.OpenAIResponse
 	if err := json.Unmarshal(respBody, &openAIResp); err != nil {
-		c.JSON(502, gin.H{"error": "invalid upstream response"})
+		writeAnthropicError(c, http.StatusBadGateway, "api_error", "invalid upstream response")
 		return
 	}
 	if len(openAIResp.Choices) == 0 || openAIResp.Choices[0].Message == nil {
-		c.JSON(502, gin.H{"error": "no choices in response"})
+		writeAnthropicError(c, http.StatusBadGateway, "api_error", "no choices in response")
 		return
 	}
 
 	message := openAIResp.Choices[0].Message
-	contentBlocks := u.converter.BuildAnthropicContentBlocks(message)
+	contentBlocks := converter.BuildAnthropicContentBlocks(message)
 	anthropicResp := model.AnthropicResponse{
-		ID:      openAIResp.ID,
-		Type:    "message",
-		Role:    "assistant",
-		Model:   openAIResp.Model,
-		Content: contentBlocks,
-	}
-	if anthropicResp.Model == "" {
-		anthropicResp.Model = req.Model
-	}
+		ID:                openAIResp.ID,
+		Type:              "message",
+		Role:              "assistant",
+		Model:             openAIResp.Model,
+		Content:           contentBlocks,
+		SystemFingerprint: openAIResp.SystemFingerprint,
+	}
+	anthropicResp.Model = responseModel(alias, req.Model, anthropicResp.Model)
 	anthropicResp.Usage.InputTokens = openAIResp.Usage.PromptTokens
 	anthropicResp.Usage.OutputTokens = openAIResp.Usage.CompletionTokens
-	hasToolCalls := len(message.ToolCalls) > 0 || message.FunctionCall != nil
+	anthropicResp.Usage.TotalTokens = openAIResp.Usage.TotalTokens
+	anthropicResp.PromptFilterResults = openAIResp.PromptFilterResults
+	anthropicResp.ContentFilterResults = openAIResp.Choices[0].ContentFilterResults
+	hasToolCalls := false
+	for _, block := range contentBlocks {
+		if block.Type == "tool_use" {
+			hasToolCalls = true
+			break
+		}
+	}
 	anthropicResp.StopReason = u.converter.MapStopReason(openAIResp.Choices[0].FinishReason, hasToolCalls)
+	if openAIResp.Choices[0].FinishReason == "stop" {
+		text := u.converter.OpenAIContentToString(message.Content)
+		if seq := u.converter.ResolveStopSequence(openAIResp.Choices[0].StopReason, text, req.StopSequences); seq != "" {
+			anthropicResp.StopReason = "stop_sequence"
+			anthropicResp.StopSequence = seq
+		}
+	}
 
 	c.JSON(200, anthropicResp)
 }
 
+// HandleCountTokens handles Anthropic /v1/messages/count_tokens requests by
+// estimating the input tokens of the converted request locally.
+func (u *ProxyUseCase) HandleCountTokens(c *gin.Context, alias string) {
+	var req model.AnthropicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAnthropicError(c, 400, "invalid_request_error", "invalid json")
+		return
+	}
+
+	converter := u.converterFor(alias)
+	messages, err := converter.ConvertAnthropicToOpenAIMessages(req.System, req.Messages)
+	if err != nil {
+		writeAnthropicError(c, 400, "invalid_request_error", err.Error())
+		return
+	}
+	tools := converter.ConvertAnthropicTools(req.Tools)
+	c.JSON(http.StatusOK, gin.H{
+		"input_tokens": u.estimator.EstimateTokens(messages, tools),
+	})
+}
+
 func (u *ProxyUseCase) handleAnthropicStream(c *gin.Context, req model.AnthropicRequest, alias string) {
-	openAIMessages, err := u.converter.ConvertAnthropicToOpenAIMessages(req.System, req.Messages)
+	openAIReq, converter, err := u.buildAnthropicChatRequest(req, alias, true)
 	if err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
+		writeAnthropicError(c, 400, "invalid_request_error", err.Error())
+		return
+	}
+	stripNullFields(openAIReq, alias)
+	redactPII(openAIReq, alias)
+	setConvertedHeaders(c, openAIReq, alias)
+
+	resp, err := u.upstreamStream(c, openAIReq, "/v1/chat/completions", alias)
+	if err != nil {
+		writeAnthropicError(c, upstreamErrorStatus(err), "api_error", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		copyHeaders(c, resp.Header)
+		body, _ := io.ReadAll(resp.Body)
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(resp.StatusCode, u.converter.ConvertOpenAIError(resp.StatusCode, body))
 		return
 	}
 
+	c.Header("Content-Type", "text/event-stream; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if err := u.streamOpenAIToAnthropic(c, resp, req, alias, converter, streamOptionsFor(alias)); err != nil {
+		log.Printf("anthropic stream aborted: %v", err)
+	}
+}
+
+// buildAnthropicChatRequest converts an Anthropic request into the OpenAI
+// chat completions body shared by the streaming and non-streaming paths.
+// The returned converter holds the request's tool name mapping and must
+// convert the response.
+func (u *ProxyUseCase) buildAnthropicChatRequest(req model.AnthropicRequest, alias string, stream bool) (map[string]interface{}, *service.Converter, error) {
+	converter := u.converterFor(alias)
+	// Tools go first so their valid names are reserved before tool_use
+	// names in the history get sanitized.
+	tools := converter.ConvertAnthropicTools(req.Tools)
+	openAIMessages, err := converter.ConvertAnthropicToOpenAIMessages(req.System, req.Messages)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	openAIReq := map[string]interface{}{
-		"model":    req.Model,
+		"model":    mapModel(alias, req.Model),
 		"messages": openAIMessages,
-		"stream":   true,
-		"stream_options": map[string]interface{}{
+		"stream":   stream,
+	}
+	if stream {
+		openAIReq["stream_options"] = map[string]interface{}{
 			"include_usage": true,
-		},
+		}
 	}
 	if req.MaxTokens > 0 {
 		openAIReq["max_tokens"] = req.MaxTokens
 	}
 	if req.Temperature != nil {
-		openAIReq["temperature"] = *req.Temperature
+		openAIReq["temperature"] = converter.ConvertAnthropicTemperature(*req.Temperature)
 	}
 	if req.TopP != nil {
-		openAIReq["top_p"] = *req.TopP
+		topP, err := converter.ConvertAnthropicTopP(*req.TopP)
+		if err != nil {
+			return nil, nil, err
+		}
+		openAIReq["top_p"] = topP
+	}
+	if req.TopK != nil {
+		openAIReq["top_k"] = *req.TopK
 	}
 	if len(req.StopSequences) > 0 {
 		openAIReq["stop"] = req.StopSequences
 	}
-	if tools := u.converter.ConvertAnthropicTools(req.Tools); len(tools) > 0 {
+	if len(tools) > 0 {
 		openAIReq["tools"] = tools
+	} else if req.Tools != nil && len(req.Tools) == 0 && forwardEmptyTools(alias) {
+		// An explicit empty list disables tool use for upstreams that
+		// distinguish it from an omitted field.
+		openAIReq["tools"] = []interface{}{}
+		openAIReq["tool_choice"] = "none"
+	}
+	if effort, ok := converter.ConvertAnthropicThinking(req.Thinking); ok {
+		switch field := reasoningField(alias); field {
+		case "reasoning_effort":
+			openAIReq[field] = effort
+		case "reasoning":
+			openAIReq[field] = map[string]interface{}{"effort": effort}
+		default:
+			openAIReq[field] = req.Thinking
+		}
 	}
 	if req.ToolChoice != nil {
-		openAIReq["tool_choice"] = u.converter.ConvertAnthropicToolChoice(req.ToolChoice)
+		if _, ok := openAIReq["tool_choice"]; !ok {
+			openAIReq["tool_choice"] = converter.ConvertAnthropicToolChoice(req.ToolChoice)
+		}
+		// OpenAI rejects parallel_tool_calls on requests without tools
+		if tools, _ := openAIReq["tools"].([]map[string]interface{}); len(tools) > 0 && converter.DisableParallelToolUse(req.ToolChoice) {
+			openAIReq["parallel_tool_calls"] = false
+		}
 	}
 
-	out, _ := json.Marshal(openAIReq)
+	return openAIReq, converter, nil
+}
 
+// HandleProxy handles generic /v1/* proxy requests
+func (u *ProxyUseCase) HandleProxy(c *gin.Context, alias string) {
+	u.proxyPassthrough(c, alias, getUpstreamConfig(alias))
+}
+
+// handleAuxProxy proxies an auxiliary request such as a model lookup,
+// bounded by the alias aux_timeout instead of the chat timeout.
+func (u *ProxyUseCase) handleAuxProxy(c *gin.Context, alias string) {
 	aliasCfg := getUpstreamConfig(alias)
-	resp, err := u.client.ProxyStream(c, out, "POST", "/v1/chat/completions", aliasCfg)
-	if err != nil {
-		c.JSON(502, gin.H{"error": err.Error()})
-		return
+	if aliasCfg == nil {
+		aliasCfg = &proxy.UpstreamConfig{}
 	}
-	defer resp.Body.Close()
+	aliasCfg.Timeout = auxTimeout(alias)
+	u.proxyPassthrough(c, alias, aliasCfg)
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		copyHeaders(c, resp.Header)
-		c.Status(resp.StatusCode)
-		io.Copy(c.Writer, resp.Body)
-		return
+// auxTimeout returns the timeout for auxiliary endpoints of alias
+func auxTimeout(alias string) time.Duration {
+	if cfg := config.GetAliasConfig(resolveAlias(alias)); cfg != nil && cfg.AuxTimeout > 0 {
+		return time.Duration(cfg.AuxTimeout) * time.Second
 	}
-
-	c.Header("Content-Type", "text/event-stream; charset=utf-8")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
-	c.Status(http.StatusOK)
-
-	// Stream conversion would go here
-	// For simplicity, we passthrough the stream
-	io.Copy(c.Writer, resp.Body)
+	return proxy.DefaultAuxTimeout
 }
 
-// HandleProxy handles generic /v1/* proxy requests
-func (u *ProxyUseCase) HandleProxy(c *gin.Context, alias string) {
+func (u *ProxyUseCase) proxyPassthrough(c *gin.Context, alias string, aliasCfg *proxy.UpstreamConfig) {
+	release, ok := u.acquireSlot(c, alias)
+	if !ok {
+		return
+	}
+	defer release()
+
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(400, gin.H{"error": "read body failed"})
 		return
 	}
 
-	aliasCfg := getUpstreamConfig(alias)
 	upstreamPath := stripAliasPrefix(c.Request.URL.Path, alias)
 	respBody, statusCode, headers, err := u.client.ProxyRequest(c, body, c.Request.Method, upstreamPath, aliasCfg)
 	if err != nil {
-		c.JSON(502, gin.H{"error": err.Error()})
+		c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	copyHeaders(c, headers)
-	c.Status(statusCode)
-	c.Data(http.StatusOK, "application/json", respBody)
+	c.Data(statusCode, "application/json", respBody)
 }
 
 // Helpers
 
+// converterFor returns a new converter configured for the alias's upstream.
+// Converters track per-request tool names, so each request gets its own.
+func (u *ProxyUseCase) converterFor(alias string) *service.Converter {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil {
+		return service.NewConverter()
+	}
+	return service.NewConverterWithOptions(service.ConverterOptions{
+		DisableFileInputs:  cfg.DisableFileInputs,
+		RescaleTemperature: cfg.RescaleTemperature,
+		TextJoinSeparator:  cfg.TextJoinSeparator,
+
+		EmptyToolNamePlaceholder: cfg.EmptyToolNamePlaceholder,
+		ToolErrorMode:            cfg.ToolErrorMode,
+		StructuredSystem:         cfg.StructuredSystem,
+
+		RejectMisplacedToolResults: strings.EqualFold(strings.TrimSpace(cfg.MisplacedToolResults), "reject"),
+		ClampTopP:                  strings.EqualFold(strings.TrimSpace(cfg.TopPMode), "clamp"),
+	})
+}
+
 func getDefaultModel(alias string) string {
 	cfg := config.GetAliasConfig(resolveAlias(alias))
 	if cfg != nil && cfg.DefaultModel != "" {
 		return cfg.DefaultModel
 	}
+	if model := config.Get().Defaults.DefaultModel; model != "" {
+		return model
+	}
 	return "tstars2.0"
 }
 
+// mapModel translates a requested model through the alias model_map.
+// Unmapped models pass through unchanged.
+func mapModel(alias, requested string) string {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil {
+		return requested
+	}
+	if mapped, ok := cfg.ModelMap[requested]; ok && mapped != "" {
+		return mapped
+	}
+	return requested
+}
+
+// responseModel picks the model name reported back to the client. The
+// upstream name wins unless it is empty or the alias echoes the request model.
+func responseModel(alias, requested, upstream string) string {
+	if strings.TrimSpace(upstream) == "" {
+		return requested
+	}
+	if cfg := config.GetAliasConfig(resolveAlias(alias)); cfg != nil && cfg.EchoRequestModel && requested != "" {
+		return requested
+	}
+	return upstream
+}
+
+// reasoningField returns the upstream body field that carries Anthropic
+// thinking directives, defaulting to reasoning_effort.
+func reasoningField(alias string) string {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || strings.TrimSpace(cfg.ReasoningField) == "" {
+		return "reasoning_effort"
+	}
+	return strings.TrimSpace(cfg.ReasoningField)
+}
+
+func forwardEmptyTools(alias string) bool {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	return cfg != nil && cfg.ForwardEmptyTools
+}
+
+// queryModelOverride returns the ?model= query override, if any, and removes
+// it from the query string forwarded upstream.
+func queryModelOverride(c *gin.Context) string {
+	query := c.Request.URL.Query()
+	override := strings.TrimSpace(query.Get("model"))
+	if !query.Has("model") {
+		return ""
+	}
+	query.Del("model")
+	c.Request.URL.RawQuery = query.Encode()
+	return override
+}
+
+// applyConvertedQueryPolicy drops the client's query string before a
+// converted request is sent to the chat completions endpoint, unless the
+// alias forwards it (the default).
+func applyConvertedQueryPolicy(c *gin.Context, alias string) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg != nil && cfg.DropConvertedQuery {
+		c.Request.URL.RawQuery = ""
+	}
+}
+
 func getUpstreamConfig(alias string) *proxy.UpstreamConfig {
 	if cfg := config.GetAliasConfig(resolveAlias(alias)); cfg != nil {
 		return &proxy.UpstreamConfig{
-			BaseURL:    cfg.BaseURL,
-			APIKey:     cfg.APIKey,
-			AuthHeader: cfg.AuthHeader,
-			AuthPrefix: cfg.AuthPrefix,
+			BaseURL:             cfg.BaseURL,
+			APIKey:              cfg.APIKey,
+			APIKeys:             cfg.APIKeys,
+			FallbackBaseURL:     cfg.FallbackBaseURL,
+			Alias:               resolveAlias(alias),
+			Headers:             cfg.Headers,
+			RemoveHeaders:       cfg.RemoveHeaders,
+			AuthHeader:          cfg.AuthHeader,
+			AuthPrefix:          cfg.AuthPrefix,
+			Timeout:             time.Duration(cfg.Timeout) * time.Second,
+			StreamHeaderTimeout: time.Duration(cfg.StreamHeaderTimeout) * time.Second,
+			UserAgent:           cfg.UserAgent,
+			BasePathMode:        cfg.BasePathMode,
+			LogLevel:            cfg.LogLevel,
+			LogBodies:           config.Get().Defaults.LogBodies,
+			LogPrettyJSON:       config.Get().Defaults.LogPrettyJSON,
+			Provider:            cfg.Provider,
+			APIVersion:          cfg.APIVersion,
+			Deployment:          cfg.Deployment,
 		}
 	}
 	return nil
 }
 
+// upstreamErrorStatus maps a transport error to 504 for timeouts, else 502
+func upstreamErrorStatus(err error) int {
+	if proxy.IsTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 func copyHeaders(c *gin.Context, headers http.Header) {
 	for k, v := range headers {
 		if strings.EqualFold(k, "Content-Length") {
 			continue
 		}
+		// The proxy's request id wins over one the upstream generated
+		if strings.EqualFold(k, proxy.RequestIDHeader) && c.Writer.Header().Get(proxy.RequestIDHeader) != "" {
+			continue
+		}
 		for _, val := range v {
 			c.Header(k, val)
 		}
 	}
+	forwardRetryAfter(c, headers)
+}
+
+// forwardRetryAfter sets Retry-After on the client response, translating an
+// HTTP-date value into delta seconds so client backoff logic can use it.
+func forwardRetryAfter(c *gin.Context, headers http.Header) {
+	value := strings.TrimSpace(headers.Get("Retry-After"))
+	if value == "" {
+		return
+	}
+	if seconds, ok := retryAfterSeconds(value, time.Now()); ok {
+		c.Header("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
+func retryAfterSeconds(value string, now time.Time) (int, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return seconds, true
+	}
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	seconds := int(math.Ceil(when.Sub(now).Seconds()))
+	if seconds < 0 {
+		seconds = 0
+	}
+	return seconds, true
 }
 
 func stripAliasPrefix(path, alias string) string {
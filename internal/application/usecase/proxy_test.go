@@ -0,0 +1,1170 @@
+package usecase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"api-conver/internal/infrastructure/proxy"
+)
+
+const echoModelConfig = `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    echo_request_model: %s
+`
+
+func TestHandleAnthropicEchoesRequestModel(t *testing.T) {
+	for _, tc := range []struct {
+		echo string
+		want string
+	}{
+		{echo: "true", want: "claude-3-5-sonnet"},
+		{echo: "false", want: "upstream-model-0613"},
+	} {
+		loadConfig(t, fmt.Sprintf(echoModelConfig, tc.echo))
+		upstream := newStubUpstream(replyJSON(200, completion("upstream-model-0613", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":16,"messages":[{"role":"user","content":"hello"}]}`)
+		if resp.Code != 200 {
+			t.Fatalf("echo=%s: status %d: %s", tc.echo, resp.Code, resp.Body)
+		}
+		if got := decodeJSON(t, resp)["model"]; got != tc.want {
+			t.Errorf("echo=%s: model = %v, want %s", tc.echo, got, tc.want)
+		}
+	}
+}
+
+func TestHandleAnthropicRejectsUnsupportedDocument(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    disable_file_inputs: true
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":[
+		{"type":"document","source":{"type":"base64","media_type":"application/pdf","data":"JVBERi0x"}}]}]}`)
+	if resp.Code != 400 {
+		t.Fatalf("status = %d, want 400: %s", resp.Code, resp.Body)
+	}
+	detail, _ := decodeJSON(t, resp)["error"].(map[string]interface{})
+	if detail["type"] != "invalid_request_error" {
+		t.Errorf("error = %v", detail)
+	}
+	if upstream.count() != 0 {
+		t.Error("unsupported document reached the upstream")
+	}
+}
+
+func TestHandleAnthropicEmptyToolsModes(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		forward   bool
+		tools     string
+		wantTools bool
+	}{
+		{name: "forwarded", forward: true, tools: `"tools":[],`, wantTools: true},
+		{name: "dropped", forward: false, tools: `"tools":[],`},
+		{name: "omitted", forward: true},
+	} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    forward_empty_tools: %t
+`, tc.forward))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,`+tc.tools+`"messages":[{"role":"user","content":"hi"}]}`)
+		if resp.Code != 200 {
+			t.Fatalf("%s: status = %d: %s", tc.name, resp.Code, resp.Body.String())
+		}
+		body := upstream.last(t).json(t)
+		tools, hasTools := body["tools"].([]interface{})
+		if hasTools != tc.wantTools || len(tools) != 0 {
+			t.Errorf("%s: tools = %v, want present=%t and empty", tc.name, body["tools"], tc.wantTools)
+		}
+		if choice, hasChoice := body["tool_choice"]; hasChoice != tc.wantTools || (hasChoice && choice != "none") {
+			t.Errorf("%s: tool_choice = %v", tc.name, body["tool_choice"])
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{value: "30", want: 30, ok: true},
+		{value: "-5", want: 0, ok: true},
+		{value: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90, ok: true},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0, ok: true},
+		{value: "soon", ok: false},
+	} {
+		got, ok := retryAfterSeconds(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("retryAfterSeconds(%q) = %d, %t, want %d, %t", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestConvertedErrorsForwardRetryAfter(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, tc := range []struct {
+		name       string
+		retryAfter string
+		min, max   int
+	}{
+		{name: "numeric", retryAfter: "30", min: 30, max: 30},
+		{name: "http-date", retryAfter: time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat), min: 110, max: 121},
+	} {
+		upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+			resp := jsonResponse(http.StatusTooManyRequests, `{"error":{"message":"slow down","type":"rate_limit_error"}}`)
+			resp.Header.Set("Retry-After", tc.retryAfter)
+			return resp, nil
+		})
+		engine := testEngine(newTestUseCase(t, upstream))
+		for _, target := range []struct{ path, body string }{
+			{"/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+			{"/a/v1/responses", `{"model":"m","input":"hi"}`},
+			{"/a/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`},
+		} {
+			resp := serve(engine, "POST", target.path, target.body)
+			if resp.Code != http.StatusTooManyRequests {
+				t.Fatalf("%s %s: status = %d: %s", tc.name, target.path, resp.Code, resp.Body.String())
+			}
+			seconds, err := strconv.Atoi(resp.Header().Get("Retry-After"))
+			if err != nil || seconds < tc.min || seconds > tc.max {
+				t.Errorf("%s %s: Retry-After = %q, want %d..%d seconds", tc.name, target.path, resp.Header().Get("Retry-After"), tc.min, tc.max)
+			}
+		}
+	}
+}
+
+func TestHandleAnthropicRescalesTemperature(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    rescale_temperature: true
+  b:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for alias, want := range map[string]float64{"a": 1.4, "b": 0.7} {
+		serve(engine, "POST", "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`)
+		if got := upstream.last(t).json(t)["temperature"]; got != want {
+			t.Errorf("alias %s: upstream temperature = %v, want %g", alias, got, want)
+		}
+	}
+}
+
+func TestQueryModelOverride(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    allowed_models: ["body-model", "query-model"]
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for _, target := range []struct{ path, body string }{
+		{"/a/v1/messages?model=query-model&x=1", `{"model":"body-model","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/chat/completions?model=query-model&x=1", `{"model":"body-model","messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/responses?model=query-model&x=1", `{"model":"body-model","input":"hi"}`},
+	} {
+		resp := serve(engine, "POST", target.path, target.body)
+		if resp.Code != 200 {
+			t.Fatalf("%s: status = %d: %s", target.path, resp.Code, resp.Body.String())
+		}
+		sent := upstream.last(t)
+		if model := sent.json(t)["model"]; model != "query-model" {
+			t.Errorf("%s: upstream model = %v, want query-model", target.path, model)
+		}
+		if strings.Contains(sent.url, "model=") {
+			t.Errorf("%s: upstream url %s still carries the override", target.path, sent.url)
+		}
+	}
+
+	resp := serve(engine, "POST", "/a/v1/messages?model=other", `{"model":"body-model","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != 403 {
+		t.Errorf("disallowed override: status = %d, want 403", resp.Code)
+	}
+}
+
+func TestUpstreamUserAgent(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  custom:
+    base_url: "http://upstream.test/v1"
+    user_agent: "my-gateway/1.0"
+  plain:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for alias, want := range map[string]string{"custom": "my-gateway/1.0", "plain": proxy.DefaultUserAgent} {
+		serve(engine, "POST", "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`, "User-Agent", "client-sdk/9.9")
+		if got := upstream.last(t).header.Get("User-Agent"); got != want {
+			t.Errorf("alias %s: converted User-Agent = %q, want %q", alias, got, want)
+		}
+		serve(engine, "POST", "/"+alias+"/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, "User-Agent", "client-sdk/9.9")
+		if got := upstream.last(t).header.Get("User-Agent"); got != want {
+			t.Errorf("alias %s: passthrough User-Agent = %q, want %q", alias, got, want)
+		}
+	}
+}
+
+func TestWarmupPreconnectsEachAlias(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://one.test/v1"
+  b:
+    base_url: "https://two.test/api/v3"
+  c:
+    base_url: "http://three.test:8080"
+`)
+	upstream := newStubUpstream(replyJSON(200, `{}`))
+	u := newTestUseCase(t, upstream)
+
+	u.Warmup(context.Background())
+	hosts := map[string]string{}
+	for _, req := range upstream.requests {
+		hosts[req.url] = req.method
+	}
+	want := map[string]string{
+		"http://one.test/v1":      http.MethodHead,
+		"https://two.test/api/v3": http.MethodHead,
+		"http://three.test:8080":  http.MethodHead,
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("warmup requests = %v, want %v", hosts, want)
+	}
+}
+
+func TestHandleAnthropicTextJoinSeparator(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    text_join_separator: "\n---\n"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":[{"type":"text","text":"one"},{"type":"text","text":"two"}]}]}`)
+	messages := upstream.last(t).json(t)["messages"].([]interface{})
+	if content := messages[0].(map[string]interface{})["content"]; content != "one\n---\ntwo" {
+		t.Errorf("content = %q, want the configured separator", content)
+	}
+}
+
+func TestConvertedQueryForwarding(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  keep:
+    base_url: "http://upstream.test/v1"
+  drop:
+    base_url: "http://upstream.test/v1"
+    drop_converted_query: true
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for alias, want := range map[string]string{
+		"keep": "http://upstream.test/v1/chat/completions?beta=true",
+		"drop": "http://upstream.test/v1/chat/completions",
+	} {
+		serve(engine, "POST", "/"+alias+"/v1/messages?beta=true", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+		if got := upstream.last(t).url; got != want {
+			t.Errorf("alias %s messages: upstream url = %s, want %s", alias, got, want)
+		}
+		serve(engine, "POST", "/"+alias+"/v1/responses?beta=true", `{"model":"m","input":"hi"}`)
+		if got := upstream.last(t).url; got != want {
+			t.Errorf("alias %s responses: upstream url = %s, want %s", alias, got, want)
+		}
+	}
+}
+
+func TestHandleAnthropicForwardsTopK(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, stream := range []bool{false, true} {
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		if stream {
+			upstream = newStubUpstream(replySSE(textChunk("m", "hi"), finishChunk("m", "stop"), "[DONE]"))
+		}
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(`{"model":"m","max_tokens":16,"top_k":40,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream))
+		if topK := upstream.last(t).json(t)["top_k"]; topK != float64(40) {
+			t.Errorf("stream=%t: upstream top_k = %v, want 40", stream, topK)
+		}
+
+		serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(`{"model":"m","max_tokens":16,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream))
+		if _, ok := upstream.last(t).json(t)["top_k"]; ok {
+			t.Errorf("stream=%t: top_k sent without the client setting it", stream)
+		}
+	}
+}
+
+func TestEmptyToolNameWithArguments(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  drop:
+    base_url: "http://upstream.test/v1"
+  name:
+    base_url: "http://upstream.test/v1"
+    empty_tool_name_placeholder: "unknown_tool"
+`)
+	nonStream := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":null,
+		"tool_calls":[{"id":"call_1","type":"function","function":{"name":"","arguments":"{\"q\":1}"}},{"id":"call_2","type":"function","function":{"name":"lookup","arguments":"{}"}}]}}]}`
+	for alias, want := range map[string][]string{"drop": {"lookup"}, "name": {"unknown_tool", "lookup"}} {
+		upstream := newStubUpstream(replyJSON(200, nonStream))
+		engine := testEngine(newTestUseCase(t, upstream))
+		resp := serve(engine, "POST", "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+		var names []string
+		for _, block := range decodeJSON(t, resp)["content"].([]interface{}) {
+			if block := block.(map[string]interface{}); block["type"] == "tool_use" {
+				names = append(names, block["name"].(string))
+			}
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("alias %s: tool_use names = %v, want %v", alias, names, want)
+		}
+
+		upstream = newStubUpstream(replySSE(toolCallChunk(0, "call_1", "", `{"q":1}`), finishChunk("m", "tool_calls"), "[DONE]"))
+		engine = testEngine(newTestUseCase(t, upstream))
+		resp = serve(engine, "POST", "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		var streamed []string
+		for _, event := range parseSSE(t, resp.Body.String()) {
+			if event.name != "content_block_start" {
+				continue
+			}
+			if block := event.data["content_block"].(map[string]interface{}); block["type"] == "tool_use" {
+				streamed = append(streamed, block["name"].(string))
+			}
+		}
+		if wantStreamed := want[:len(want)-1]; !reflect.DeepEqual(streamed, wantStreamed) && !(len(streamed) == 0 && len(wantStreamed) == 0) {
+			t.Errorf("alias %s: streamed tool_use names = %v, want %v", alias, streamed, wantStreamed)
+		}
+	}
+}
+
+func TestUpstreamTimeoutStatus(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    timeout: 1
+`)
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		return nil, context.DeadlineExceeded
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for _, tc := range []struct{ path, body string }{
+		{"/a/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/a/v1/responses", `{"model":"m","input":"hi"}`},
+	} {
+		resp := serve(engine, "POST", tc.path, tc.body)
+		if resp.Code != http.StatusGatewayTimeout || !strings.Contains(resp.Body.String(), "deadline exceeded") {
+			t.Errorf("%s: status = %d, body = %s, want 504 with the timeout error", tc.path, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestStopSequenceFromUpstreamStopReason(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	request := `{"model":"m","max_tokens":16,"stop_sequences":["。完","(?i)end$"],%s"messages":[{"role":"user","content":"hi"}]}`
+	for _, tc := range []struct {
+		name         string
+		stopReason   string
+		wantReason   string
+		wantSequence interface{}
+	}{
+		{name: "unicode", stopReason: `,"stop_reason":"。完"`, wantReason: "stop_sequence", wantSequence: "。完"},
+		{name: "regex metacharacters", stopReason: `,"stop_reason":"(?i)end$"`, wantReason: "stop_sequence", wantSequence: "(?i)end$"},
+		{name: "not reported", wantReason: "end_turn"},
+	} {
+		body := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"done"},"finish_reason":"stop"` + tc.stopReason + `}]}`
+		engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body))))
+		message := decodeJSON(t, serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(request, "")))
+		if message["stop_reason"] != tc.wantReason || message["stop_sequence"] != tc.wantSequence {
+			t.Errorf("%s: stop_reason = %v, stop_sequence = %v", tc.name, message["stop_reason"], message["stop_sequence"])
+		}
+
+		chunk := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"` + tc.stopReason + `}]}`
+		engine = testEngine(newTestUseCase(t, newStubUpstream(replySSE(textChunk("m", "done"), chunk, "[DONE]"))))
+		resp := serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(request, `"stream":true,`))
+		delta := findEvent(t, parseSSE(t, resp.Body.String()), "message_delta").data["delta"].(map[string]interface{})
+		if delta["stop_reason"] != tc.wantReason || delta["stop_sequence"] != tc.wantSequence {
+			t.Errorf("%s stream: delta = %v", tc.name, delta)
+		}
+	}
+}
+
+func TestModelMapping(t *testing.T) {
+	loadConfig(t, `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    default_model: "claude-default"
+    model_map:
+      claude-3-5-sonnet: "qwen2.5-72b"
+      claude-default: "llama-3.1-8b"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	for _, tc := range []struct {
+		name  string
+		model string
+		want  string
+	}{
+		{name: "mapped", model: `"model":"claude-3-5-sonnet",`, want: "qwen2.5-72b"},
+		{name: "unmapped", model: `"model":"gpt-4o",`, want: "gpt-4o"},
+		{name: "default", want: "llama-3.1-8b"},
+	} {
+		for _, target := range []struct{ path, body string }{
+			{"/v1/messages", `{` + tc.model + `"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+			{"/v1/chat/completions", `{` + tc.model + `"messages":[{"role":"user","content":"hi"}]}`},
+			{"/v1/responses", `{` + tc.model + `"input":"hi"}`},
+		} {
+			serve(engine, "POST", target.path, target.body)
+			if got := upstream.last(t).json(t)["model"]; got != tc.want {
+				t.Errorf("%s %s: upstream model = %v, want %s", tc.name, target.path, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestHandleAnthropicConvertsUpstreamErrors(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, tc := range []struct {
+		name     string
+		respond  func(*http.Request) (*http.Response, error)
+		status   int
+		errType  string
+		message  string
+		stream   bool
+		noStream bool
+	}{
+		{
+			name:    "401",
+			respond: replyJSON(401, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`),
+			status:  401, errType: "invalid_request_error", message: "Incorrect API key provided",
+		},
+		{
+			name:    "401 untyped",
+			respond: replyJSON(401, `{"error":{"message":"unauthorized"}}`),
+			status:  401, errType: "authentication_error", message: "unauthorized",
+		},
+		{
+			name:    "429",
+			respond: replyJSON(429, `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`),
+			status:  429, errType: "rate_limit_error", message: "Rate limit reached",
+		},
+		{
+			name:    "unparseable body",
+			respond: replyJSON(503, `upstream unavailable`),
+			status:  503, errType: "api_error", message: "upstream unavailable",
+		},
+		{
+			name:    "transport error",
+			respond: func(*http.Request) (*http.Response, error) { return nil, errors.New("connection refused") },
+			status:  502, errType: "api_error", message: "connection refused",
+		},
+		{
+			name:    "invalid response",
+			respond: replyJSON(200, `not json`),
+			status:  502, errType: "api_error", message: "invalid upstream response", noStream: true,
+		},
+		{
+			name:    "no choices",
+			respond: replyJSON(200, `{"id":"chatcmpl-1","choices":[]}`),
+			status:  502, errType: "api_error", message: "no choices in response", noStream: true,
+		},
+	} {
+		engine := testEngine(newTestUseCase(t, newStubUpstream(tc.respond)))
+		for _, stream := range []bool{false, true} {
+			if stream && tc.noStream {
+				continue
+			}
+			resp := serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(`{"model":"m","max_tokens":16,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream))
+			if resp.Code != tc.status {
+				t.Errorf("%s stream=%t: status = %d, want %d: %s", tc.name, stream, resp.Code, tc.status, resp.Body.String())
+				continue
+			}
+			payload := decodeJSON(t, resp)
+			detail, _ := payload["error"].(map[string]interface{})
+			if payload["type"] != "error" || detail["type"] != tc.errType || !strings.Contains(fmt.Sprint(detail["message"]), tc.message) {
+				t.Errorf("%s stream=%t: body = %v", tc.name, stream, payload)
+			}
+		}
+	}
+}
+
+func TestSystemFingerprintSurvivesConversion(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	const fingerprint = "fp_44709d6fcb"
+	body := `{"id":"chatcmpl-1","model":"m","system_fingerprint":"` + fingerprint + `","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`
+	chunk := `{"id":"chatcmpl-1","model":"m","system_fingerprint":"` + fingerprint + `","choices":[{"index":0,"delta":{"content":"hi"}}]}`
+	complete := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body))))
+	stream := testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunk, finishChunk("m", "stop"), "[DONE]"))))
+
+	message := decodeJSON(t, serve(complete, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	if message["system_fingerprint"] != fingerprint {
+		t.Errorf("messages: system_fingerprint = %v", message["system_fingerprint"])
+	}
+	response := decodeJSON(t, serve(complete, "POST", "/a/v1/responses", `{"model":"m","input":"hi"}`))
+	if response["system_fingerprint"] != fingerprint {
+		t.Errorf("responses: system_fingerprint = %v", response["system_fingerprint"])
+	}
+
+	events := parseSSE(t, serve(stream, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`).Body.String())
+	started := findEvent(t, events, "message_start").data["message"].(map[string]interface{})
+	if started["system_fingerprint"] != fingerprint {
+		t.Errorf("messages stream: message_start = %v", started)
+	}
+	events = parseSSE(t, serve(stream, "POST", "/a/v1/responses", `{"model":"m","stream":true,"input":"hi"}`).Body.String())
+	completed := findEvent(t, events, "response.completed").data["response"].(map[string]interface{})
+	if completed["system_fingerprint"] != fingerprint {
+		t.Errorf("responses stream: response.completed = %v", completed)
+	}
+}
+
+func TestHandleAnthropicForwardsThinking(t *testing.T) {
+	thinking := `"thinking":{"type":"enabled","budget_tokens":8000},`
+	for _, tc := range []struct {
+		field    string
+		thinking string
+		key      string
+		want     interface{}
+	}{
+		{thinking: thinking, key: "reasoning_effort", want: "medium"},
+		{field: "reasoning_effort", thinking: `"thinking":{"type":"enabled","budget_tokens":32000},`, key: "reasoning_effort", want: "high"},
+		{field: "reasoning", thinking: thinking, key: "reasoning", want: map[string]interface{}{"effort": "medium"}},
+		{field: "thinking", thinking: thinking, key: "thinking", want: map[string]interface{}{"type": "enabled", "budget_tokens": float64(8000)}},
+		{field: "reasoning_effort", thinking: `"thinking":{"type":"disabled"},`, key: "reasoning_effort"},
+		{key: "reasoning_effort"},
+	} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    reasoning_field: "%s"
+`, tc.field))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,`+tc.thinking+`"messages":[{"role":"user","content":"hi"}]}`)
+		body := upstream.last(t).json(t)
+		if got, ok := body[tc.key]; !reflect.DeepEqual(got, tc.want) || ok != (tc.want != nil) {
+			t.Errorf("field %q, %s: upstream %s = %v", tc.field, tc.thinking, tc.key, got)
+		}
+	}
+}
+
+func TestHandleAnthropicArrayAssistantContent(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	body := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":[
+		{"type":"reasoning","text":"Compare the images."},
+		{"type":"text","text":"Here is the chart:"},
+		{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0K"}},
+		{"type":"output_text","text":"Done."},
+		{"type":"refusal","refusal":"I can't share more."}
+	]}}]}`
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body))))
+	message := decodeJSON(t, serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	want := []interface{}{
+		map[string]interface{}{"type": "thinking", "thinking": "Compare the images."},
+		map[string]interface{}{"type": "text", "text": "Here is the chart:"},
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": "iVBORw0K"}},
+		map[string]interface{}{"type": "text", "text": "Done."},
+		map[string]interface{}{"type": "text", "text": "I can't share more."},
+	}
+	if !reflect.DeepEqual(message["content"], want) {
+		t.Errorf("content = %#v\nwant %#v", message["content"], want)
+	}
+
+	chunk := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"content":[{"type":"text","text":"Hello"},{"type":"output_text","text":", world"}]}}]}`
+	engine = testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunk, finishChunk("m", "stop"), "[DONE]"))))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if text := streamText(parseSSE(t, resp.Body.String())); text != "Hello, world" {
+		t.Errorf("stream text = %q", text)
+	}
+}
+
+func TestHandleAnthropicReconcilesToolUseStopReason(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, tc := range []struct {
+		name  string
+		calls string
+		want  string
+	}{
+		{name: "nameless call dropped", calls: `[{"id":"call_1","type":"function","function":{"name":"","arguments":"{}"}}]`, want: "end_turn"},
+		{name: "no calls", calls: `[]`, want: "end_turn"},
+		{name: "valid call", calls: `[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]`, want: "tool_use"},
+	} {
+		body := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":"checking","tool_calls":` + tc.calls + `}}]}`
+		engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body))))
+		message := decodeJSON(t, serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+		if message["stop_reason"] != tc.want {
+			t.Errorf("%s: stop_reason = %v, want %s", tc.name, message["stop_reason"], tc.want)
+		}
+	}
+
+	upstream := newStubUpstream(replySSE(textChunk("m", "checking"), toolCallChunk(0, "call_1", "", `{}`), finishChunk("m", "tool_calls"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	delta := findEvent(t, parseSSE(t, resp.Body.String()), "message_delta").data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "end_turn" {
+		t.Errorf("stream: stop_reason = %v, want end_turn", delta["stop_reason"])
+	}
+}
+
+// recordingEstimator returns a fixed count and keeps what it was given
+type recordingEstimator struct {
+	messages []map[string]interface{}
+	tools    []map[string]interface{}
+}
+
+func (e *recordingEstimator) EstimateTokens(messages []map[string]interface{}, tools []map[string]interface{}) int {
+	e.messages, e.tools = messages, tools
+	return 1234
+}
+
+func TestHandleCountTokens(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replyJSON(500, `{}`))
+	engine := testEngine(newTestUseCase(t, upstream))
+	count := func(target, body string) float64 {
+		t.Helper()
+		resp := serve(engine, "POST", target, body)
+		if resp.Code != 200 {
+			t.Fatalf("POST %s: status = %d: %s", target, resp.Code, resp.Body.String())
+		}
+		tokens, ok := decodeJSON(t, resp)["input_tokens"].(float64)
+		if !ok {
+			t.Fatalf("POST %s: body = %s, want input_tokens", target, resp.Body.String())
+		}
+		return tokens
+	}
+
+	text := `{"model":"m","system":"Be brief.","messages":[{"role":"user","content":"What is the weather in Paris today?"}]}`
+	withTools := `{"model":"m","system":"Be brief.","messages":[{"role":"user","content":"What is the weather in Paris today?"}],
+		"tools":[{"name":"get_weather","description":"Get the current weather for a city","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}]}`
+	textTokens := count("/v1/messages/count_tokens", text)
+	if textTokens <= 0 {
+		t.Errorf("text-only input_tokens = %v, want > 0", textTokens)
+	}
+	if aliased := count("/a/v1/messages/count_tokens", text); aliased != textTokens {
+		t.Errorf("alias path input_tokens = %v, want %v", aliased, textTokens)
+	}
+	if toolTokens := count("/v1/messages/count_tokens", withTools); toolTokens <= textTokens {
+		t.Errorf("input_tokens with tools = %v, want more than %v", toolTokens, textTokens)
+	}
+	if upstream.count() != 0 {
+		t.Errorf("count_tokens reached the upstream %d times", upstream.count())
+	}
+	if resp := serve(engine, "POST", "/v1/messages/count_tokens", `{"messages":`); resp.Code != 400 {
+		t.Errorf("invalid JSON: status = %d, want 400", resp.Code)
+	}
+
+	estimator := &recordingEstimator{}
+	engine = testEngine(newTestUseCase(t, upstream, WithTokenEstimator(estimator)))
+	resp := serve(engine, "POST", "/v1/messages/count_tokens", withTools)
+	if tokens := decodeJSON(t, resp)["input_tokens"]; tokens != float64(1234) {
+		t.Errorf("custom estimator: input_tokens = %v", tokens)
+	}
+	if len(estimator.messages) != 2 || estimator.messages[0]["role"] != "system" || len(estimator.tools) != 1 {
+		t.Errorf("estimator got messages %v, tools %v", estimator.messages, estimator.tools)
+	}
+}
+
+func TestToolSchemaForwardedVerbatim(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	// Key order, $defs and $ref must reach the upstream untouched
+	const schema = `{"type":"object","properties":{"order":{"$ref":"#/$defs/Order"},"note":{"type":"string"}},"required":["order"],"$defs":{"Order":{"type":"object","properties":{"sku":{"type":"string"},"qty":{"type":"integer","minimum":1}}}}}`
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"tools":[{"name":"place_order","input_schema":`+schema+`}],"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.Code, resp.Body.String())
+	}
+	if body := string(upstream.last(t).body); !strings.Contains(body, `"parameters":`+schema) {
+		t.Errorf("upstream body does not carry the schema byte for byte:\n%s", body)
+	}
+
+	counted := decodeJSON(t, serve(engine, "POST", "/a/v1/messages/count_tokens", `{"model":"m","tools":[{"name":"place_order","input_schema":`+schema+`}],"messages":[{"role":"user","content":"hi"}]}`))
+	bare := decodeJSON(t, serve(engine, "POST", "/a/v1/messages/count_tokens", `{"model":"m","tools":[{"name":"place_order"}],"messages":[{"role":"user","content":"hi"}]}`))
+	if counted["input_tokens"].(float64) <= bare["input_tokens"].(float64)+20 {
+		t.Errorf("input_tokens with schema = %v, without = %v; want the schema counted", counted["input_tokens"], bare["input_tokens"])
+	}
+}
+
+func TestHandleAnthropicReportsTotalTokens(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))))
+	message := decodeJSON(t, serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	usage := message["usage"].(map[string]interface{})
+	if usage["input_tokens"] != float64(3) || usage["output_tokens"] != float64(2) || usage["total_tokens"] != float64(5) {
+		t.Errorf("usage = %v", usage)
+	}
+
+	withoutUsage := `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`
+	engine = testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, withoutUsage))))
+	message = decodeJSON(t, serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	if _, ok := message["usage"].(map[string]interface{})["total_tokens"]; ok {
+		t.Errorf("usage = %v, want no total_tokens without upstream usage", message["usage"])
+	}
+
+	usageChunk := `{"id":"chatcmpl-1","model":"m","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":7,"total_tokens":16}}`
+	engine = testEngine(newTestUseCase(t, newStubUpstream(replySSE(textChunk("m", "hi"), finishChunk("m", "stop"), usageChunk, "[DONE]"))))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	usage = findEvent(t, parseSSE(t, resp.Body.String()), "message_delta").data["usage"].(map[string]interface{})
+	if usage["total_tokens"] != float64(16) || usage["output_tokens"] != float64(7) {
+		t.Errorf("stream usage = %v", usage)
+	}
+}
+
+func TestConvertedRequestBodyReachesUpstream(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    api_key: "sk-test"
+`)
+	for _, tc := range []struct {
+		name, path, body string
+		want             map[string]interface{}
+	}{
+		{
+			name: "messages",
+			path: "/a/v1/messages",
+			body: `{"model":"m","max_tokens":64,"system":"Be brief.","temperature":1,"stop_sequences":["END"],"messages":[
+				{"role":"user","content":"weather?"},
+				{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"sunny"}]}]}`,
+			want: map[string]interface{}{
+				"model":       "m",
+				"max_tokens":  float64(64),
+				"stream":      false,
+				"temperature": float64(1),
+				"stop":        []interface{}{"END"},
+				"messages": []interface{}{
+					map[string]interface{}{"role": "system", "content": "Be brief."},
+					map[string]interface{}{"role": "user", "content": "weather?"},
+					map[string]interface{}{"role": "assistant", "content": "", "tool_calls": []interface{}{map[string]interface{}{
+						"id": "toolu_1", "type": "function",
+						"function": map[string]interface{}{"name": "get_weather", "arguments": `{"city":"Paris"}`},
+					}}},
+					map[string]interface{}{"role": "tool", "tool_call_id": "toolu_1", "content": "sunny"},
+				},
+			},
+		},
+		{
+			name: "chat",
+			path: "/a/v1/chat/completions",
+			body: `{"model":"m","messages":[{"role":"user","content":"hi"}],"seed":7}`,
+			want: map[string]interface{}{
+				"model":    "m",
+				"stream":   false,
+				"seed":     float64(7),
+				"messages": []interface{}{map[string]interface{}{"role": "user", "content": "hi"}},
+			},
+		},
+	} {
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+		if resp := serve(engine, "POST", tc.path, tc.body); resp.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tc.name, resp.Code, resp.Body.String())
+		}
+		sent := upstream.last(t)
+		if sent.method != http.MethodPost || sent.url != "http://upstream.test/v1/chat/completions" || sent.header.Get("Authorization") != "Bearer sk-test" {
+			t.Errorf("%s: upstream request = %s %s, Authorization %q", tc.name, sent.method, sent.url, sent.header.Get("Authorization"))
+		}
+		if body := sent.json(t); !reflect.DeepEqual(body, tc.want) {
+			t.Errorf("%s: upstream body = %#v\nwant %#v", tc.name, body, tc.want)
+		}
+	}
+}
+
+func TestHandleAnthropicRejectsMisplacedToolResult(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    misplaced_tool_results: "reject"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[
+		{"role":"user","content":"weather?"},
+		{"role":"assistant","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"sunny"}]}]}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", resp.Code, resp.Body.String())
+	}
+	if detail := decodeJSON(t, resp)["error"].(map[string]interface{}); detail["type"] != "invalid_request_error" || !strings.Contains(fmt.Sprint(detail["message"]), "tool_result") {
+		t.Errorf("error = %v", detail)
+	}
+	if upstream.count() != 0 {
+		t.Errorf("rejected request reached the upstream")
+	}
+}
+
+func TestHandleAnthropicDecompressesGzipUpstream(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(completion("m", "unzipped", "stop")))
+	zw.Close()
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type":     {"application/json"},
+				"Content-Encoding": {"gzip"},
+				"Content-Length":   {strconv.Itoa(compressed.Len())},
+			},
+			Body: io.NopCloser(bytes.NewReader(compressed.Bytes())),
+		}, nil
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	content := decodeJSON(t, resp)["content"].([]interface{})
+	if text := content[0].(map[string]interface{})["text"]; text != "unzipped" {
+		t.Errorf("text = %v, want unzipped", text)
+	}
+	if encoding := resp.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q, want it dropped", encoding)
+	}
+}
+
+const azureFilteredCompletion = `{"id":"chatcmpl-1","object":"chat.completion","model":"m",
+	"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{"hate":{"filtered":false,"severity":"safe"}}}],
+	"choices":[{"index":0,"message":{"role":"assistant","content":"I can"},"finish_reason":"content_filter",
+		"content_filter_results":{"violence":{"filtered":true,"severity":"high"}}}],
+	"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`
+
+func TestHandleAnthropicAzureContentFilter(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, azureFilteredCompletion))))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	body := decodeJSON(t, resp)
+	if body["stop_reason"] != "refusal" {
+		t.Errorf("stop_reason = %v, want refusal", body["stop_reason"])
+	}
+	prompt, _ := body["prompt_filter_results"].([]interface{})
+	if len(prompt) != 1 {
+		t.Errorf("prompt_filter_results = %v, want the upstream verdict", body["prompt_filter_results"])
+	}
+	violence, _ := body["content_filter_results"].(map[string]interface{})["violence"].(map[string]interface{})
+	if violence["filtered"] != true {
+		t.Errorf("content_filter_results = %v, want the upstream verdict", body["content_filter_results"])
+	}
+}
+
+func TestAnthropicStreamAzureContentFilter(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	chunks := []string{
+		`{"id":"","object":"","model":"","choices":[],"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{}}]}`,
+		textChunk("m", "I can"),
+		`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"m","choices":[{"index":0,"delta":{},"finish_reason":"content_filter","content_filter_results":{"violence":{"filtered":true,"severity":"high"}}}]}`,
+		"[DONE]",
+	}
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunks...))))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	events := parseSSE(t, resp.Body.String())
+	message := findEvent(t, events, "message_start").data["message"].(map[string]interface{})
+	if _, ok := message["prompt_filter_results"]; !ok {
+		t.Errorf("message_start = %v, want prompt_filter_results", message)
+	}
+	delta := findEvent(t, events, "message_delta").data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "refusal" {
+		t.Errorf("stop_reason = %v, want refusal", delta["stop_reason"])
+	}
+	if _, ok := delta["content_filter_results"]; !ok {
+		t.Errorf("message_delta = %v, want content_filter_results", delta)
+	}
+}
+
+func TestHandleAnthropicToolChoiceVariants(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, tc := range []struct {
+		choice       string
+		wantChoice   interface{}
+		wantParallel interface{}
+	}{
+		{choice: `"none"`, wantChoice: "none"},
+		{choice: `{"type":"none"}`, wantChoice: "none"},
+		{choice: `{"type":"auto"}`, wantChoice: "auto"},
+		{choice: `{"type":"any"}`, wantChoice: "required"},
+		{choice: `{"type":"auto","disable_parallel_tool_use":true}`, wantChoice: "auto", wantParallel: false},
+		{choice: `{"type":"any","disable_parallel_tool_use":true}`, wantChoice: "required", wantParallel: false},
+		{choice: `{"type":"auto","disable_parallel_tool_use":false}`, wantChoice: "auto"},
+		{
+			choice:       `{"type":"tool","name":"lookup","disable_parallel_tool_use":true}`,
+			wantChoice:   map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "lookup"}},
+			wantParallel: false,
+		},
+	} {
+		for _, stream := range []bool{false, true} {
+			var upstream *stubUpstream
+			if stream {
+				upstream = newStubUpstream(replySSE(textChunk("m", "ok"), finishChunk("m", "stop"), "[DONE]"))
+			} else {
+				upstream = newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+			}
+			engine := testEngine(newTestUseCase(t, upstream))
+
+			resp := serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(`{"model":"m","max_tokens":16,"stream":%t,
+				"tools":[{"name":"lookup","input_schema":{"type":"object"}}],"tool_choice":%s,
+				"messages":[{"role":"user","content":"hi"}]}`, stream, tc.choice))
+			if resp.Code != 200 {
+				t.Fatalf("%s stream=%t: status %d: %s", tc.choice, stream, resp.Code, resp.Body)
+			}
+			body := upstream.last(t).json(t)
+			if !reflect.DeepEqual(body["tool_choice"], tc.wantChoice) {
+				t.Errorf("%s stream=%t: tool_choice = %v, want %v", tc.choice, stream, body["tool_choice"], tc.wantChoice)
+			}
+			if parallel := body["parallel_tool_calls"]; parallel != tc.wantParallel {
+				t.Errorf("%s stream=%t: parallel_tool_calls = %v, want %v", tc.choice, stream, parallel, tc.wantParallel)
+			}
+		}
+	}
+}
+
+func TestHandleAnthropicSanitizesToolNames(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	const request = `{"model":"m","max_tokens":16,"stream":%t,
+		"tools":[{"name":"my.tool name","input_schema":{"type":"object"}},{"name":"plain","input_schema":{"type":"object"}}],
+		"tool_choice":{"type":"tool","name":"my.tool name"},
+		"messages":[
+			{"role":"user","content":"hi"},
+			{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"my.tool name","input":{}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"done"}]}]}`
+	const toolCall = `{"id":"chatcmpl-1","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant",
+		"tool_calls":[{"id":"call_1","type":"function","function":{"name":"my_tool_name","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`
+
+	for _, stream := range []bool{false, true} {
+		var upstream *stubUpstream
+		if stream {
+			upstream = newStubUpstream(replySSE(toolCallChunk(0, "call_1", "my_tool_name", "{}"), finishChunk("m", "tool_calls"), "[DONE]"))
+		} else {
+			upstream = newStubUpstream(replyJSON(200, toolCall))
+		}
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(request, stream))
+		if resp.Code != 200 {
+			t.Fatalf("stream=%t: status %d: %s", stream, resp.Code, resp.Body)
+		}
+
+		body := upstream.last(t).json(t)
+		var names []string
+		for _, tool := range body["tools"].([]interface{}) {
+			names = append(names, tool.(map[string]interface{})["function"].(map[string]interface{})["name"].(string))
+		}
+		if want := []string{"my_tool_name", "plain"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("stream=%t: outbound tool names = %v, want %v", stream, names, want)
+		}
+		if choice := body["tool_choice"].(map[string]interface{})["function"].(map[string]interface{})["name"]; choice != "my_tool_name" {
+			t.Errorf("stream=%t: tool_choice name = %v, want my_tool_name", stream, choice)
+		}
+		history := body["messages"].([]interface{})[1].(map[string]interface{})["tool_calls"].([]interface{})
+		if name := history[0].(map[string]interface{})["function"].(map[string]interface{})["name"]; name != "my_tool_name" {
+			t.Errorf("stream=%t: history tool call name = %v, want my_tool_name", stream, name)
+		}
+
+		var restored interface{}
+		if stream {
+			block := findEvent(t, parseSSE(t, resp.Body.String()), "content_block_start").data["content_block"].(map[string]interface{})
+			restored = block["name"]
+		} else {
+			restored = decodeJSON(t, resp)["content"].([]interface{})[0].(map[string]interface{})["name"]
+		}
+		if restored != "my.tool name" {
+			t.Errorf("stream=%t: returned tool_use name = %v, want my.tool name", stream, restored)
+		}
+	}
+}
+
+func TestHandleAnthropicDefaultToolSchema(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}],"tools":[
+		{"name":"bare"},
+		{"name":"null_schema","input_schema":null},
+		{"name":"typed","input_schema":{"type":"object","required":["q"],"properties":{"q":{"type":"string"}}}}]}`)
+	if resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	params := map[string]interface{}{}
+	for _, tool := range upstream.last(t).json(t)["tools"].([]interface{}) {
+		function := tool.(map[string]interface{})["function"].(map[string]interface{})
+		params[function["name"].(string)] = function["parameters"]
+	}
+	empty := map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	want := map[string]interface{}{
+		"bare":        empty,
+		"null_schema": empty,
+		"typed": map[string]interface{}{
+			"type":       "object",
+			"required":   []interface{}{"q"},
+			"properties": map[string]interface{}{"q": map[string]interface{}{"type": "string"}},
+		},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("parameters = %v\nwant %v", params, want)
+	}
+}
+
+func TestHandleAnthropicTopPRange(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  reject:
+    base_url: "http://upstream.test/v1"
+  clamp:
+    base_url: "http://upstream.test/v1"
+    top_p_mode: clamp
+`)
+	for _, tc := range []struct {
+		alias    string
+		topP     string
+		wantCode int
+		want     interface{}
+	}{
+		{alias: "reject", topP: "0.9", wantCode: 200, want: 0.9},
+		{alias: "reject", topP: "0", wantCode: 200, want: 0.0},
+		{alias: "reject", topP: "1.5", wantCode: 400},
+		{alias: "reject", topP: "-0.1", wantCode: 400},
+		{alias: "clamp", topP: "1.5", wantCode: 200, want: 1.0},
+		{alias: "clamp", topP: "-0.1", wantCode: 200, want: 0.0},
+		{alias: "clamp", topP: "0.5", wantCode: 200, want: 0.5},
+	} {
+		upstream := newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/"+tc.alias+"/v1/messages", `{"model":"m","max_tokens":16,"top_p":`+tc.topP+`,"messages":[{"role":"user","content":"hi"}]}`)
+		if resp.Code != tc.wantCode {
+			t.Errorf("%s top_p=%s: status %d, want %d: %s", tc.alias, tc.topP, resp.Code, tc.wantCode, resp.Body)
+			continue
+		}
+		if tc.wantCode != 200 {
+			if upstream.count() != 0 {
+				t.Errorf("%s top_p=%s: rejected request reached the upstream", tc.alias, tc.topP)
+			}
+			if errType := decodeJSON(t, resp)["error"].(map[string]interface{})["type"]; errType != "invalid_request_error" {
+				t.Errorf("%s top_p=%s: error type = %v", tc.alias, tc.topP, errType)
+			}
+			continue
+		}
+		if got := upstream.last(t).json(t)["top_p"]; got != tc.want {
+			t.Errorf("%s top_p=%s: upstream top_p = %v, want %v", tc.alias, tc.topP, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package usecase
+
+import (
+	"log"
+	"regexp"
+	"sync"
+
+	"api-conver/internal/config"
+)
+
+// RedactedText replaces PII removed from outbound requests
+const RedactedText = "[REDACTED]"
+
+// Built-in patterns enabled by redact_pii. A phone number needs a leading
+// + or separators between its digit groups, so bare digit runs such as
+// timestamps and order numbers are left alone.
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+\d{1,3}[ .-]?(?:\(\d{2,4}\)|\d{2,4})[ .-]?\d{3,4}[ .-]?\d{3,4}\b` +
+		`|(?:\b\d{1,3}[ .-])?(?:\(\d{2,4}\)[ .-]?|\b\d{2,4}[ .-])\d{3,4}[ .-]\d{3,4}\b`)
+)
+
+// redactPatterns caches compiled redact_patterns by source
+var redactPatterns sync.Map
+
+// piiPatterns returns the patterns to redact for alias, or nil when
+// redaction is off. Invalid custom patterns are logged and skipped.
+func piiPatterns(alias string) []*regexp.Regexp {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || (!cfg.RedactPII && len(cfg.RedactPatterns) == 0) {
+		return nil
+	}
+	var patterns []*regexp.Regexp
+	if cfg.RedactPII {
+		patterns = append(patterns, emailPattern, phonePattern)
+	}
+	for _, source := range cfg.RedactPatterns {
+		if cached, ok := redactPatterns.Load(source); ok {
+			patterns = append(patterns, cached.(*regexp.Regexp))
+			continue
+		}
+		pattern, err := regexp.Compile(source)
+		if err != nil {
+			log.Printf("ignoring invalid redact pattern %q for alias %s: %v", source, resolveAlias(alias), err)
+			continue
+		}
+		redactPatterns.Store(source, pattern)
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// redactPII replaces PII in the message content of an outbound chat
+// request when the alias enables redaction. Only text is rewritten; tool
+// call arguments and media parts are left alone.
+func redactPII(chatReq map[string]interface{}, alias string) {
+	patterns := piiPatterns(alias)
+	if len(patterns) == 0 {
+		return
+	}
+	r := &redactor{patterns: patterns}
+	switch messages := chatReq["messages"].(type) {
+	case []interface{}:
+		for _, item := range messages {
+			msg, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := msg["content"]; ok {
+				msg["content"] = r.content(msg["content"])
+			}
+		}
+	case []map[string]interface{}:
+		for _, msg := range messages {
+			if _, ok := msg["content"]; ok {
+				msg["content"] = r.content(msg["content"])
+			}
+		}
+	}
+	if r.count > 0 {
+		log.Printf("redacted %d PII match(es) from request for alias %s", r.count, resolveAlias(alias))
+	}
+}
+
+type redactor struct {
+	patterns []*regexp.Regexp
+	count    int
+}
+
+func (r *redactor) text(text string) string {
+	for _, pattern := range r.patterns {
+		text = pattern.ReplaceAllStringFunc(text, func(string) string {
+			r.count++
+			return RedactedText
+		})
+	}
+	return text
+}
+
+// content redacts string content and the text of content parts
+func (r *redactor) content(content interface{}) interface{} {
+	switch v := content.(type) {
+	case string:
+		return r.text(v)
+	case []interface{}:
+		for _, item := range v {
+			if part, ok := item.(map[string]interface{}); ok {
+				r.part(part)
+			}
+		}
+	case []map[string]interface{}:
+		for _, part := range v {
+			r.part(part)
+		}
+	}
+	return content
+}
+
+func (r *redactor) part(part map[string]interface{}) {
+	if text, ok := part["text"].(string); ok {
+		part["text"] = r.text(text)
+	}
+}
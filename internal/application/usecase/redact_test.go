@@ -0,0 +1,99 @@
+package usecase
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPhonePattern(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"call 555-123-4567 today", "call [REDACTED] today"},
+		{"call (555) 123-4567", "call [REDACTED]"},
+		{"call 1-555-123-4567", "call [REDACTED]"},
+		{"call +1 555 123 4567", "call [REDACTED]"},
+		{"call +447911123456", "call [REDACTED]"},
+		{"at 030.1234.5678.", "at [REDACTED]."},
+		// Bare digit runs are not phone numbers
+		{"created 1700000000", "created 1700000000"},
+		{"order 123456789012", "order 123456789012"},
+		{"id abc5551234567", "id abc5551234567"},
+		{"on 2024-10-16 at 12:30", "on 2024-10-16 at 12:30"},
+		{"host 192.168.1.100", "host 192.168.1.100"},
+	} {
+		if got := phonePattern.ReplaceAllString(tc.text, RedactedText); got != tc.want {
+			t.Errorf("redact(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestRedactPIIFromMessages(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    redact_pii: true
+  plain:
+    base_url: "http://upstream.test/v1"
+`)
+	const request = `{"model":"m","max_tokens":16,"system":"Reply to jane.doe@example.com","messages":[
+		{"role":"user","content":"Mail bob+news@mail.example.org or call 555-123-4567 about order 123456789012 from 1700000000"},
+		{"role":"assistant","content":[{"type":"text","text":"Noted, ops@example.co.uk"}]},
+		{"role":"user","content":[{"type":"text","text":"thanks"}]}]}`
+	upstream := newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	if resp := serve(engine, "POST", "/a/v1/messages", request); resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	body := string(upstream.last(t).body)
+	for _, leaked := range []string{"jane.doe@example.com", "bob+news@mail.example.org", "ops@example.co.uk", "555-123-4567"} {
+		if strings.Contains(body, leaked) {
+			t.Errorf("upstream request still contains %q: %s", leaked, body)
+		}
+	}
+	for _, kept := range []string{"order 123456789012", "from 1700000000", "thanks"} {
+		if !strings.Contains(body, kept) {
+			t.Errorf("upstream request lost %q: %s", kept, body)
+		}
+	}
+	if n := strings.Count(body, RedactedText); n != 4 {
+		t.Errorf("%d redactions, want 4: %s", n, body)
+	}
+
+	// Aliases without redaction forward content untouched
+	if resp := serve(engine, "POST", "/plain/v1/messages", request); resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	if body := string(upstream.last(t).body); !strings.Contains(body, "jane.doe@example.com") || strings.Contains(body, RedactedText) {
+		t.Errorf("plain alias rewrote content: %s", body)
+	}
+}
+
+func TestRedactPIILeavesMissingContentAbsent(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    redact_pii: true
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	request := `{"model":"m","messages":[
+		{"role":"user","content":"mail jane.doe@example.com"},
+		{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":"found"}]}`
+	if resp := serve(engine, "POST", "/a/v1/chat/completions", request); resp.Code != 200 {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	messages := upstream.last(t).json(t)["messages"].([]interface{})
+	if _, ok := messages[1].(map[string]interface{})["content"]; ok {
+		t.Errorf("tool call message gained a content key: %v", messages[1])
+	}
+	if body := string(upstream.last(t).body); strings.Contains(body, "jane.doe@example.com") {
+		t.Errorf("upstream request still contains the address: %s", body)
+	}
+}
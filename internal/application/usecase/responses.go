@@ -6,14 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"sort"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"api-conver/internal/config"
 	"api-conver/internal/domain/model"
+	"api-conver/internal/domain/service"
 )
 
 type responsesStreamState struct {
@@ -24,349 +26,124 @@ type responsesStreamState struct {
 	text        strings.Builder
 	toolCalls   map[int]*toolCallState
 	usage       *model.OpenAIUsage
+	clock       Clock
+	idPrefix    string
+	// outputTokens estimates the emitted text and tool arguments; it
+	// enforces the output cap and stands in for upstream usage when the
+	// stream was cut short or carried none.
+	outputTokens      service.OutputTokenCounter
+	incompleteReason  string
+	systemFingerprint string
+	// sequence numbers every emitted event as the Responses API does.
+	sequence int
+	// nextOutput is the output_index of the next output item; textItem is
+	// the message item currently receiving text, and output collects the
+	// finished items by output_index for response.completed.
+	nextOutput int
+	textItem   *textItemState
+	output     map[int]map[string]interface{}
+	// completed is the response sent with response.completed or
+	// response.incomplete.
+	completed map[string]interface{}
 }
 
-type toolCallState struct {
-	id        string
-	name      string
-	arguments strings.Builder
-}
-
-func (u *ProxyUseCase) buildChatRequestFromResponses(payload map[string]interface{}, alias string) (map[string]interface{}, bool, error) {
-	chatReq := map[string]interface{}{}
-
-	modelVal, _ := payload["model"].(string)
-	if strings.TrimSpace(modelVal) == "" {
-		modelVal = getDefaultModel(alias)
-	}
-	chatReq["model"] = modelVal
-
-	stream := false
-	if rawStream, ok := payload["stream"]; ok {
-		if v, ok := rawStream.(bool); ok {
-			stream = v
-		}
-	}
-	chatReq["stream"] = stream
-	if stream {
-		chatReq["stream_options"] = map[string]interface{}{"include_usage": true}
-	}
-
-	instructions, _ := payload["instructions"].(string)
-	if strings.TrimSpace(instructions) != "" {
-		chatReq["messages"] = []map[string]interface{}{
-			{"role": "system", "content": instructions},
-		}
-	}
-
-	messages, err := parseResponsesInput(payload["input"])
-	if err != nil {
-		return nil, false, err
-	}
-	if len(messages) > 0 {
-		if existing, ok := chatReq["messages"].([]map[string]interface{}); ok {
-			chatReq["messages"] = append(existing, messages...)
-		} else {
-			chatReq["messages"] = messages
-		}
-	}
-	if _, ok := chatReq["messages"]; !ok {
-		return nil, false, errors.New("missing input messages")
-	}
-
-	copyIfPresent(payload, chatReq, "temperature")
-	copyIfPresent(payload, chatReq, "top_p")
-	copyIfPresent(payload, chatReq, "presence_penalty")
-	copyIfPresent(payload, chatReq, "frequency_penalty")
-	copyIfPresent(payload, chatReq, "seed")
-	copyIfPresent(payload, chatReq, "response_format")
-	copyIfPresent(payload, chatReq, "tools")
-	copyIfPresent(payload, chatReq, "tool_choice")
-	copyIfPresent(payload, chatReq, "parallel_tool_calls")
-
-	if maxOutputTokens, ok := payload["max_output_tokens"]; ok {
-		chatReq["max_tokens"] = maxOutputTokens
-	} else if maxTokens, ok := payload["max_tokens"]; ok {
-		chatReq["max_tokens"] = maxTokens
-	}
-
-	return chatReq, stream, nil
+type textItemState struct {
+	id          string
+	outputIndex int
+	text        strings.Builder
 }
 
-func parseResponsesInput(input interface{}) ([]map[string]interface{}, error) {
-	if input == nil {
-		return nil, nil
-	}
-
-	items := []interface{}{input}
-	if list, ok := input.([]interface{}); ok {
-		items = list
-	}
-
-	messages := make([]map[string]interface{}, 0, len(items))
-	for _, item := range items {
-		msg, ok := item.(map[string]interface{})
-		if !ok {
-			if text, ok := item.(string); ok && strings.TrimSpace(text) != "" {
-				messages = append(messages, map[string]interface{}{
-					"role":    "user",
-					"content": text,
-				})
-			}
-			continue
-		}
-
-		itemType, _ := msg["type"].(string)
-		if itemType == "tool_output" || itemType == "tool_result" {
-			toolMsg := buildToolMessage(msg)
-			if toolMsg != nil {
-				messages = append(messages, toolMsg)
-			}
-			continue
-		}
-
-		role, _ := msg["role"].(string)
-		if strings.TrimSpace(role) == "" {
-			role = "user"
-		}
-		content := extractTextFromContent(msg["content"])
-		message := map[string]interface{}{
-			"role":    role,
-			"content": content,
-		}
-		if role == "tool" {
-			if toolID, ok := msg["tool_call_id"].(string); ok && strings.TrimSpace(toolID) != "" {
-				message["tool_call_id"] = toolID
-			}
-		}
-		if toolCalls, ok := msg["tool_calls"]; ok {
-			message["tool_calls"] = toolCalls
-		}
-		if functionCall, ok := msg["function_call"]; ok {
-			message["function_call"] = functionCall
-		}
-		messages = append(messages, message)
-	}
-
-	return messages, nil
+type toolCallState struct {
+	id          string
+	name        string
+	arguments   strings.Builder
+	itemID      string
+	outputIndex int
+	done        bool
 }
 
-func buildToolMessage(msg map[string]interface{}) map[string]interface{} {
-	toolID := ""
-	if v, ok := msg["tool_call_id"].(string); ok {
-		toolID = v
-	}
-	if toolID == "" {
-		if v, ok := msg["call_id"].(string); ok {
-			toolID = v
-		}
-	}
-	if toolID == "" {
-		if v, ok := msg["id"].(string); ok {
-			toolID = v
-		}
-	}
-	content := ""
-	if v, ok := msg["output"].(string); ok {
-		content = v
-	} else if v, ok := msg["content"].(string); ok {
-		content = v
-	} else {
-		content = extractTextFromContent(msg["content"])
-	}
-	if toolID == "" && strings.TrimSpace(content) == "" {
-		return nil
-	}
-	message := map[string]interface{}{
-		"role":    "tool",
-		"content": content,
-	}
-	if toolID != "" {
-		message["tool_call_id"] = toolID
-	}
-	return message
+func (u *ProxyUseCase) buildChatRequestFromResponses(payload map[string]interface{}, alias string) (map[string]interface{}, bool, error) {
+	return u.converterFor(alias).ConvertResponsesRequest(payload, service.ResponsesRequestOptions{
+		DefaultModel:            getDefaultModel(alias),
+		RejectMissingToolCallID: rejectMissingToolCallID(alias),
+	})
 }
 
-func extractTextFromContent(content interface{}) string {
-	switch v := content.(type) {
-	case nil:
-		return ""
-	case string:
-		return v
-	case []interface{}:
-		parts := make([]string, 0, len(v))
-		for _, item := range v {
-			block, ok := item.(map[string]interface{})
-			if !ok {
-				if text, ok := item.(string); ok && strings.TrimSpace(text) != "" {
-					parts = append(parts, text)
-				}
-				continue
-			}
-			blockType, _ := block["type"].(string)
-			if blockType != "" && blockType != "input_text" && blockType != "text" && blockType != "output_text" {
-				continue
-			}
-			if text, ok := block["text"].(string); ok && strings.TrimSpace(text) != "" {
-				parts = append(parts, text)
-			}
-		}
-		return strings.Join(parts, "\n")
-	case map[string]interface{}:
-		if text, ok := v["text"].(string); ok {
-			return text
-		}
-	}
-	return ""
+// rejectMissingToolCallID reports whether the alias rejects tool messages
+// without tool_call_id instead of attaching the most recent call id.
+func rejectMissingToolCallID(alias string) bool {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	return cfg != nil && strings.EqualFold(strings.TrimSpace(cfg.MissingToolCallID), "reject")
 }
 
 func (u *ProxyUseCase) convertOpenAIResponseToResponses(openAIResp model.OpenAIResponse, reqModel string) map[string]interface{} {
-	modelName := openAIResp.Model
-	if strings.TrimSpace(modelName) == "" {
-		modelName = reqModel
-	}
-
-	var message *model.OpenAIMessage
-	var finishReason string
-	if len(openAIResp.Choices) > 0 {
-		message = openAIResp.Choices[0].Message
-		finishReason = openAIResp.Choices[0].FinishReason
-	}
-
-	outputItems := []interface{}{}
-	messageItem := map[string]interface{}{
-		"id":      responseMessageID(openAIResp.ID),
-		"type":    "message",
-		"role":    "assistant",
-		"content": []interface{}{},
-	}
-
-	if message != nil {
-		text := strings.TrimSpace(u.converter.OpenAIContentToString(message.Content))
-		if text != "" {
-			messageItem["content"] = []interface{}{
-				map[string]interface{}{
-					"type": "output_text",
-					"text": text,
-				},
-			}
-		}
-
-		toolCallItems := buildResponsesToolCallItems(message.ToolCalls)
-		if len(toolCallItems) > 0 {
-			messageItem["tool_calls"] = toolCallItems
-			for _, item := range toolCallItems {
-				outputItems = append(outputItems, item)
-			}
-		}
-	}
-
-	outputItems = append([]interface{}{messageItem}, outputItems...)
-
-	response := map[string]interface{}{
-		"id":      openAIResp.ID,
-		"object":  "response",
-		"created": openAIResp.Created,
-		"model":   modelName,
-		"output":  outputItems,
-		"usage": map[string]interface{}{
-			"input_tokens":  openAIResp.Usage.PromptTokens,
-			"output_tokens": openAIResp.Usage.CompletionTokens,
-			"total_tokens":  openAIResp.Usage.TotalTokens,
-		},
+	if strings.TrimSpace(openAIResp.ID) == "" {
+		openAIResp.ID = synthesizeID(u.clock, u.idPrefix)
 	}
-
-	if finishReason != "" {
-		response["finish_reason"] = finishReason
-	}
-
-	return response
-}
-
-func buildResponsesToolCallItems(toolCalls []model.OpenAIToolCall) []map[string]interface{} {
-	if len(toolCalls) == 0 {
-		return nil
-	}
-	items := make([]map[string]interface{}, 0, len(toolCalls))
-	for _, call := range toolCalls {
-		name := strings.TrimSpace(call.Function.Name)
-		if name == "" && strings.TrimSpace(call.Function.Arguments) == "" {
-			continue
-		}
-		item := map[string]interface{}{
-			"id":        call.ID,
-			"call_id":   call.ID,
-			"type":      "tool_call",
-			"name":      name,
-			"arguments": parseToolCallArguments(call.Function.Arguments),
-		}
-		items = append(items, item)
-	}
-	if len(items) == 0 {
-		return nil
-	}
-	return items
+	messageID := responseMessageID(u.clock, u.idPrefix, openAIResp.ID)
+	return u.converter.ConvertOpenAIToResponses(openAIResp, reqModel, messageID, ensureCreated(u.clock, openAIResp.Created))
 }
 
-func parseToolCallArguments(raw string) interface{} {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
-		return map[string]interface{}{}
-	}
-	var payload interface{}
-	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
-		return raw
-	}
-	return payload
-}
-
-func responseMessageID(responseID string) string {
+func responseMessageID(clock Clock, prefix string, responseID string) string {
 	if strings.TrimSpace(responseID) == "" {
-		return fmt.Sprintf("msg_%d", time.Now().UnixNano())
+		return synthesizeID(clock, prefix)
 	}
 	return responseID + "_msg"
 }
 
-func copyIfPresent(src map[string]interface{}, dst map[string]interface{}, key string) {
-	if val, ok := src[key]; ok {
-		dst[key] = val
-	}
-}
-
-func (u *ProxyUseCase) streamOpenAIToResponses(c *gin.Context, resp *http.Response, reqModel string) error {
+// streamOpenAIToResponses converts an OpenAI chat completions SSE stream
+// into Responses API events and returns the final response object, or nil
+// when the stream did not complete.
+func (u *ProxyUseCase) streamOpenAIToResponses(c *gin.Context, resp *http.Response, reqModel string, opts streamOptions) (map[string]interface{}, error) {
 	defer resp.Body.Close()
 
 	reader := bufio.NewReader(resp.Body)
 	state := &responsesStreamState{
 		model:     reqModel,
 		toolCalls: map[int]*toolCallState{},
+		clock:     u.clock,
+		idPrefix:  u.idPrefix,
+		output:    map[int]map[string]interface{}{},
 	}
+	parseErrors := 0
 
+stream:
 	for {
-		line, err := reader.ReadString('\n')
+		// Upstreams that close without [DONE] end on a clean EOF, which
+		// finalizes the response like [DONE] does; readSSEData still
+		// returns a last data line that lacks its trailing newline.
+		data, err := readSSEData(reader)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return err
-		}
-		line = strings.TrimSpace(line)
-		if line == "" || !strings.HasPrefix(line, "data:") {
-			continue
-		}
-
-		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-		if data == "" {
-			continue
+			if writeErr := writeResponseFailed(c, state, "stream_error", err.Error()); writeErr != nil {
+				return nil, writeErr
+			}
+			return nil, err
 		}
 		if data == "[DONE]" {
 			break
 		}
 
+		if upstreamErr, ok := parseStreamError(data); ok {
+			code := upstreamErr.Type
+			if code == "" {
+				code = "stream_error"
+			}
+			return nil, writeResponseFailed(c, state, code, upstreamErr.Message)
+		}
+
 		var chunk model.OpenAIStreamResponse
 		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			parseErrors++
+			log.Printf("skipping unparseable stream chunk (%d consecutive): %v", parseErrors, err)
+			if opts.maxParseErrors > 0 && parseErrors >= opts.maxParseErrors {
+				return nil, writeResponseFailed(c, state, "stream_error", fmt.Sprintf("upstream stream aborted after %d unparseable chunks", parseErrors))
+			}
 			continue
 		}
+		parseErrors = 0
 
 		if state.responseID == "" && chunk.ID != "" {
 			state.responseID = chunk.ID
@@ -380,147 +157,331 @@ func (u *ProxyUseCase) streamOpenAIToResponses(c *gin.Context, resp *http.Respon
 		if chunk.Usage != nil {
 			state.usage = chunk.Usage
 		}
+		if chunk.SystemFingerprint != "" {
+			state.systemFingerprint = chunk.SystemFingerprint
+		}
 
-		if !state.createdSent {
-			if err := writeResponseCreated(c, state); err != nil {
-				return err
-			}
-			state.created = ensureCreated(state.created)
-			state.createdSent = true
+		if err := state.ensureCreatedSent(c); err != nil {
+			return nil, err
 		}
 
 		for _, choice := range chunk.Choices {
 			delta := choice.Delta
-			if delta.Content != "" {
-				state.text.WriteString(delta.Content)
-				if err := writeOutputTextDelta(c, state.responseID, delta.Content); err != nil {
-					return err
+			text := deltaText(delta.Content)
+			if text != "" {
+				state.text.WriteString(text)
+				var logprobs interface{}
+				if opts.logprobs {
+					logprobs = choice.Logprobs
+				}
+				if err := state.writeOutputTextDelta(c, text, logprobs); err != nil {
+					return nil, err
 				}
 			}
 			for _, call := range delta.ToolCalls {
-				toolState := state.toolCalls[call.Index]
-				if toolState == nil {
-					toolState = &toolCallState{}
-					state.toolCalls[call.Index] = toolState
-				}
-				if call.ID != "" {
-					toolState.id = call.ID
-				}
-				if call.Function.Name != "" {
-					toolState.name = call.Function.Name
-				}
-				if call.Function.Arguments != "" {
-					toolState.arguments.WriteString(call.Function.Arguments)
-				}
-				if err := writeToolCallDelta(c, state.responseID, toolState, call.Function.Arguments); err != nil {
-					return err
+				if err := state.writeFunctionCallDelta(c, call.Index, call.ID, call.Function.Name, call.Function.Arguments); err != nil {
+					return nil, err
 				}
 			}
+			state.outputTokens.Add(text)
+			for _, call := range delta.ToolCalls {
+				state.outputTokens.Add(call.Function.Arguments)
+			}
+		}
+
+		if opts.maxOutputTokens > 0 && state.outputTokens.Tokens() >= opts.maxOutputTokens {
+			state.incompleteReason = "max_output_tokens"
+			break stream
 		}
 	}
 
-	return writeResponseCompleted(c, state)
+	if err := state.writeResponseCompleted(c); err != nil {
+		return nil, err
+	}
+	return state.completed, nil
 }
 
-func ensureCreated(created int64) int64 {
-	if created != 0 {
-		return created
+// emit writes a Responses stream event, stamping its type and sequence
+// number.
+func (s *responsesStreamState) emit(c *gin.Context, event string, payload map[string]interface{}) error {
+	payload["type"] = event
+	payload["sequence_number"] = s.sequence
+	s.sequence++
+	return writeSSE(c, event, payload)
+}
+
+func (s *responsesStreamState) responseObject(status string, output []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         s.responseID,
+		"object":     "response",
+		"created_at": ensureCreated(s.clock, s.created),
+		"created":    ensureCreated(s.clock, s.created),
+		"status":     status,
+		"model":      s.model,
+		"output":     output,
 	}
-	return time.Now().Unix()
 }
 
-func writeResponseCreated(c *gin.Context, state *responsesStreamState) error {
-	response := map[string]interface{}{
-		"id":      state.responseID,
-		"object":  "response",
-		"created": ensureCreated(state.created),
-		"model":   state.model,
-		"output":  []interface{}{},
+// ensureCreatedSent emits response.created once, before any other event
+func (s *responsesStreamState) ensureCreatedSent(c *gin.Context) error {
+	if s.createdSent {
+		return nil
 	}
-	payload := map[string]interface{}{
-		"type":     "response.created",
-		"response": response,
+	s.ensureResponseID()
+	if err := s.writeResponseCreated(c); err != nil {
+		return err
+	}
+	s.created = ensureCreated(s.clock, s.created)
+	s.createdSent = true
+	return nil
+}
+
+// ensureResponseID synthesizes the response id when the upstream sent
+// none, like message ids of converted Anthropic streams.
+func (s *responsesStreamState) ensureResponseID() {
+	if s.responseID == "" {
+		s.responseID = synthesizeID(s.clock, s.idPrefix)
 	}
-	return writeSSE(c, "response.created", payload)
 }
 
-func writeOutputTextDelta(c *gin.Context, responseID string, delta string) error {
+func (s *responsesStreamState) writeResponseCreated(c *gin.Context) error {
+	return s.emit(c, "response.created", map[string]interface{}{
+		"response": s.responseObject("in_progress", []interface{}{}),
+	})
+}
+
+// writeOutputTextDelta streams text into the open message item, opening
+// the item and its output_text part first when needed.
+func (s *responsesStreamState) writeOutputTextDelta(c *gin.Context, delta string, logprobs interface{}) error {
+	if s.textItem == nil {
+		item := &textItemState{
+			id:          responseMessageID(s.clock, s.idPrefix, s.responseID),
+			outputIndex: s.nextOutput,
+		}
+		if item.outputIndex > 0 {
+			item.id = fmt.Sprintf("%s_%d", item.id, item.outputIndex)
+		}
+		s.nextOutput++
+		s.textItem = item
+		if err := s.emit(c, "response.output_item.added", map[string]interface{}{
+			"output_index": item.outputIndex,
+			"item": map[string]interface{}{
+				"id":      item.id,
+				"type":    "message",
+				"status":  "in_progress",
+				"role":    "assistant",
+				"content": []interface{}{},
+			},
+		}); err != nil {
+			return err
+		}
+		if err := s.emit(c, "response.content_part.added", map[string]interface{}{
+			"item_id":       item.id,
+			"output_index":  item.outputIndex,
+			"content_index": 0,
+			"part":          outputTextPart(""),
+		}); err != nil {
+			return err
+		}
+	}
+	s.textItem.text.WriteString(delta)
 	payload := map[string]interface{}{
-		"type":          "response.output_text.delta",
-		"response_id":   responseID,
-		"output_index":  0,
+		"item_id":       s.textItem.id,
+		"output_index":  s.textItem.outputIndex,
 		"content_index": 0,
 		"delta":         delta,
 	}
-	return writeSSE(c, "response.output_text.delta", payload)
+	if logprobs != nil {
+		payload["logprobs"] = logprobs
+	}
+	return s.emit(c, "response.output_text.delta", payload)
 }
 
-func writeToolCallDelta(c *gin.Context, responseID string, call *toolCallState, delta string) error {
-	if call == nil {
+// closeTextItem finishes the open message item with the done events
+func (s *responsesStreamState) closeTextItem(c *gin.Context) error {
+	item := s.textItem
+	if item == nil {
 		return nil
 	}
-	payload := map[string]interface{}{
-		"type":        "response.tool_call.delta",
-		"response_id": responseID,
-		"tool_call": map[string]interface{}{
-			"id":        call.id,
-			"name":      call.name,
-			"arguments": delta,
-		},
-	}
-	return writeSSE(c, "response.tool_call.delta", payload)
-}
-
-func writeResponseCompleted(c *gin.Context, state *responsesStreamState) error {
-	message := map[string]interface{}{
-		"id":      responseMessageID(state.responseID),
+	s.textItem = nil
+	text := item.text.String()
+	if err := s.emit(c, "response.output_text.done", map[string]interface{}{
+		"item_id":       item.id,
+		"output_index":  item.outputIndex,
+		"content_index": 0,
+		"text":          text,
+	}); err != nil {
+		return err
+	}
+	if err := s.emit(c, "response.content_part.done", map[string]interface{}{
+		"item_id":       item.id,
+		"output_index":  item.outputIndex,
+		"content_index": 0,
+		"part":          outputTextPart(text),
+	}); err != nil {
+		return err
+	}
+	done := map[string]interface{}{
+		"id":      item.id,
 		"type":    "message",
+		"status":  "completed",
 		"role":    "assistant",
-		"content": []interface{}{},
+		"content": []interface{}{outputTextPart(text)},
 	}
+	s.output[item.outputIndex] = done
+	return s.emit(c, "response.output_item.done", map[string]interface{}{
+		"output_index": item.outputIndex,
+		"item":         done,
+	})
+}
 
-	text := strings.TrimSpace(state.text.String())
-	if text != "" {
-		message["content"] = []interface{}{
-			map[string]interface{}{
-				"type": "output_text",
-				"text": text,
-			},
+// writeFunctionCallDelta streams a tool call fragment as a function_call
+// output item, announcing the item on the first fragment of each call.
+func (s *responsesStreamState) writeFunctionCallDelta(c *gin.Context, callIndex int, id, name, arguments string) error {
+	call := s.toolCalls[callIndex]
+	if call == nil {
+		if err := s.closeTextItem(c); err != nil {
+			return err
 		}
+		call = &toolCallState{id: id, name: name, outputIndex: s.nextOutput}
+		if call.id == "" {
+			call.id = service.GenerateToolCallID()
+		}
+		call.itemID = "fc_" + strings.TrimPrefix(call.id, "call_")
+		s.nextOutput++
+		s.toolCalls[callIndex] = call
+		if err := s.emit(c, "response.output_item.added", map[string]interface{}{
+			"output_index": call.outputIndex,
+			"item":         call.item("in_progress", ""),
+		}); err != nil {
+			return err
+		}
+	}
+	if call.name == "" && name != "" {
+		call.name = name
 	}
+	if arguments == "" {
+		return nil
+	}
+	call.arguments.WriteString(arguments)
+	return s.emit(c, "response.function_call_arguments.delta", map[string]interface{}{
+		"item_id":      call.itemID,
+		"output_index": call.outputIndex,
+		"delta":        arguments,
+	})
+}
+
+func (s *responsesStreamState) closeFunctionCall(c *gin.Context, call *toolCallState) error {
+	if call.done {
+		return nil
+	}
+	call.done = true
+	arguments := call.arguments.String()
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	if err := s.emit(c, "response.function_call_arguments.done", map[string]interface{}{
+		"item_id":      call.itemID,
+		"output_index": call.outputIndex,
+		"arguments":    arguments,
+	}); err != nil {
+		return err
+	}
+	done := call.item("completed", arguments)
+	s.output[call.outputIndex] = done
+	return s.emit(c, "response.output_item.done", map[string]interface{}{
+		"output_index": call.outputIndex,
+		"item":         done,
+	})
+}
 
-	output := []interface{}{message}
-	toolItems := buildResponsesToolCallItemsFromState(state.toolCalls)
-	if len(toolItems) > 0 {
-		message["tool_calls"] = toolItems
-		for _, item := range toolItems {
-			output = append(output, item)
+func (t *toolCallState) item(status, arguments string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        t.itemID,
+		"type":      "function_call",
+		"status":    status,
+		"call_id":   t.id,
+		"name":      t.name,
+		"arguments": arguments,
+	}
+}
+
+func outputTextPart(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "output_text",
+		"text":        text,
+		"annotations": []interface{}{},
+	}
+}
+
+// writeResponseCompleted closes every open output item in output_index
+// order and sends response.completed (or response.incomplete) with the
+// assembled output.
+func (s *responsesStreamState) writeResponseCompleted(c *gin.Context) error {
+	if err := s.ensureCreatedSent(c); err != nil {
+		return err
+	}
+	if err := s.closeTextItem(c); err != nil {
+		return err
+	}
+	calls := make([]*toolCallState, 0, len(s.toolCalls))
+	for _, call := range s.toolCalls {
+		calls = append(calls, call)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].outputIndex < calls[j].outputIndex })
+	for _, call := range calls {
+		if err := s.closeFunctionCall(c, call); err != nil {
+			return err
 		}
 	}
 
-	response := map[string]interface{}{
-		"id":      state.responseID,
-		"object":  "response",
-		"created": ensureCreated(state.created),
-		"model":   state.model,
-		"output":  output,
+	indexes := make([]int, 0, len(s.output))
+	for index := range s.output {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	output := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		output = append(output, s.output[index])
 	}
 
-	if state.usage != nil {
+	event := "response.completed"
+	response := s.responseObject("completed", output)
+	if s.usage != nil && s.incompleteReason == "" {
 		response["usage"] = map[string]interface{}{
-			"input_tokens":  state.usage.PromptTokens,
-			"output_tokens": state.usage.CompletionTokens,
-			"total_tokens":  state.usage.TotalTokens,
+			"input_tokens":  s.usage.PromptTokens,
+			"output_tokens": s.usage.CompletionTokens,
+			"total_tokens":  s.usage.TotalTokens,
+		}
+	} else {
+		// Without upstream usage, or when the output cap cut the stream,
+		// report the estimate of what the client received.
+		inputTokens := 0
+		if s.usage != nil {
+			inputTokens = s.usage.PromptTokens
+		}
+		outputTokens := s.outputTokens.Tokens()
+		response["usage"] = map[string]interface{}{
+			"input_tokens":  inputTokens,
+			"output_tokens": outputTokens,
+			"total_tokens":  inputTokens + outputTokens,
 		}
 	}
-
-	payload := map[string]interface{}{
-		"type":     "response.completed",
-		"response": response,
+	if s.systemFingerprint != "" {
+		response["system_fingerprint"] = s.systemFingerprint
+	}
+	if s.incompleteReason != "" {
+		event = "response.incomplete"
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]interface{}{
+			"reason": s.incompleteReason,
+		}
 	}
-	if err := writeSSE(c, "response.completed", payload); err != nil {
+
+	if err := s.emit(c, event, map[string]interface{}{"response": response}); err != nil {
 		return err
 	}
+	s.completed = response
 	_, err := c.Writer.Write([]byte("data: [DONE]\n\n"))
 	if flusher, ok := c.Writer.(http.Flusher); ok {
 		flusher.Flush()
@@ -528,35 +489,42 @@ func writeResponseCompleted(c *gin.Context, state *responsesStreamState) error {
 	return err
 }
 
-func buildResponsesToolCallItemsFromState(toolCalls map[int]*toolCallState) []map[string]interface{} {
-	if len(toolCalls) == 0 {
-		return nil
+// writeResponseFailed terminates a Responses stream with a response.failed
+// event carrying the partial output and the error, followed by [DONE].
+func writeResponseFailed(c *gin.Context, state *responsesStreamState, code string, message string) error {
+	// A stream failing before its first chunk still opens with
+	// response.created, so clients always see the response they fail
+	if err := state.ensureCreatedSent(c); err != nil {
+		return err
 	}
-	indexes := make([]int, 0, len(toolCalls))
-	for index := range toolCalls {
-		indexes = append(indexes, index)
+	response := state.responseObject("failed", []interface{}{})
+	response["error"] = map[string]interface{}{
+		"code":    code,
+		"message": message,
 	}
-	sort.Ints(indexes)
-
-	items := make([]map[string]interface{}, 0, len(indexes))
-	for _, index := range indexes {
-		call := toolCalls[index]
-		if call == nil {
-			continue
+	if text := strings.TrimSpace(state.text.String()); text != "" {
+		response["output"] = []interface{}{
+			map[string]interface{}{
+				"id":   responseMessageID(state.clock, state.idPrefix, state.responseID),
+				"type": "message",
+				"role": "assistant",
+				"content": []interface{}{
+					map[string]interface{}{
+						"type": "output_text",
+						"text": text,
+					},
+				},
+			},
 		}
-		args := strings.TrimSpace(call.arguments.String())
-		items = append(items, map[string]interface{}{
-			"id":        call.id,
-			"call_id":   call.id,
-			"type":      "tool_call",
-			"name":      call.name,
-			"arguments": parseToolCallArguments(args),
-		})
-	}
-	if len(items) == 0 {
-		return nil
 	}
-	return items
+	if err := state.emit(c, "response.failed", map[string]interface{}{"response": response}); err != nil {
+		return err
+	}
+	_, err := c.Writer.Write([]byte("data: [DONE]\n\n"))
+	if flusher, ok := c.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
 }
 
 func writeSSE(c *gin.Context, event string, payload map[string]interface{}) error {
@@ -0,0 +1,432 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestResponsesStreamAbortsAfterConsecutiveParseErrors(t *testing.T) {
+	loadConfig(t, parseErrorsConfig)
+	upstream := newStubUpstream(replySSE(textChunk("m", "hello"), "{bad", "{worse", "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	failed := findEvent(t, events, "response.failed")
+	response := failed.data["response"].(map[string]interface{})
+	detail := response["error"].(map[string]interface{})
+	if response["status"] != "failed" || !strings.Contains(detail["message"].(string), "2 unparseable chunks") {
+		t.Errorf("response.failed = %v", failed.data)
+	}
+	if names := eventNames(events); names[len(names)-1] != "[DONE]" {
+		t.Errorf("events = %v, want [DONE] last", names)
+	}
+}
+
+func TestResponsesSynthesizesIDAndCreatedFromClock(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	clock := &fakeClock{now: time.Unix(1700000000, 7)}
+	body := `{"object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, body)), WithClock(clock), WithIDPrefix("resp_")))
+
+	payload := decodeJSON(t, serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi"}`))
+	if payload["created"] != float64(1700000000) {
+		t.Errorf("created = %v, want 1700000000", payload["created"])
+	}
+	if payload["id"] != "resp_1700000000000000007" {
+		t.Errorf("id = %v, want resp_1700000000000000007", payload["id"])
+	}
+	output := payload["output"].([]interface{})
+	item := output[0].(map[string]interface{})
+	if item["id"] != "resp_1700000000000000007_msg" {
+		t.Errorf("output id = %v, want resp_1700000000000000007_msg", item["id"])
+	}
+
+	// A frozen clock keeps every synthesized value stable across calls
+	again := decodeJSON(t, serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi"}`))
+	if again["created"] != payload["created"] {
+		t.Errorf("created changed: %v then %v", payload["created"], again["created"])
+	}
+}
+
+func TestResponsesStreamForwardsLogprobs(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    stream_logprobs: true
+`)
+	upstream := newStubUpstream(replySSE(logprobsChunk("hi"), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	delta := findEvent(t, parseSSE(t, resp.Body.String()), "response.output_text.delta").data
+	logprobs, ok := delta["logprobs"].(map[string]interface{})
+	if !ok || len(logprobs["content"].([]interface{})) != 1 {
+		t.Errorf("delta = %v, want upstream logprobs", delta)
+	}
+}
+
+func TestResponsesStreamFailsOnUpstreamErrorChunk(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	errChunk := `{"error":{"message":"model overloaded","type":"server_error"}}`
+	upstream := newStubUpstream(replySSE(textChunk("m", "partial"), errChunk, textChunk("m", " ignored"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	names := eventNames(events)
+	if names[len(names)-2] != "response.failed" || names[len(names)-1] != "[DONE]" {
+		t.Fatalf("events = %v, want response.failed then [DONE] last", names)
+	}
+	for _, name := range names {
+		if name == "response.completed" {
+			t.Errorf("events = %v, want no response.completed", names)
+		}
+	}
+	response := findEvent(t, events, "response.failed").data["response"].(map[string]interface{})
+	detail := response["error"].(map[string]interface{})
+	if detail["code"] != "server_error" || detail["message"] != "model overloaded" {
+		t.Errorf("error = %v", detail)
+	}
+	output := response["output"].([]interface{})
+	content := output[0].(map[string]interface{})["content"].([]interface{})
+	if text := content[0].(map[string]interface{})["text"]; text != "partial" {
+		t.Errorf("partial output = %v, want the text before the error", text)
+	}
+}
+
+func TestResponsesStreamFailsOnFirstChunkError(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	errChunk := `{"error":{"message":"model overloaded","type":"server_error"}}`
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replySSE(errChunk, "[DONE]"))))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	if names := eventNames(events); len(names) < 2 || names[0] != "response.created" || names[len(names)-2] != "response.failed" {
+		t.Fatalf("events = %v, want response.created first and response.failed before [DONE]", names)
+	}
+	created := findEvent(t, events, "response.created").data["response"].(map[string]interface{})
+	failed := findEvent(t, events, "response.failed").data["response"].(map[string]interface{})
+	if created["id"] == nil || created["id"] != failed["id"] {
+		t.Errorf("created id = %v, failed id = %v, want the same id", created["id"], failed["id"])
+	}
+}
+
+func TestResponsesStreamFailsOnBrokenConnection(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+		resp := sseResponse(textChunk("m", "partial"))
+		resp.Body = io.NopCloser(io.MultiReader(resp.Body, iotest.ErrReader(errors.New("connection reset"))))
+		return resp, nil
+	})
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	detail := findEvent(t, events, "response.failed").data["response"].(map[string]interface{})["error"].(map[string]interface{})
+	if detail["code"] != "stream_error" || !strings.Contains(detail["message"].(string), "connection reset") {
+		t.Errorf("error = %v", detail)
+	}
+	if names := eventNames(events); names[len(names)-1] != "[DONE]" {
+		t.Errorf("events = %v, want [DONE] last", names)
+	}
+}
+
+func TestResponsesStreamStopsAtOutputTokenCap(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    max_stream_output_tokens: 5
+`)
+	chunks := []string{}
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, textChunk("m", "abcdefgh"))
+	}
+	upstream := newStubUpstream(replySSE(append(chunks, finishChunk("m", "stop"), "[DONE]")...))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	response := findEvent(t, events, "response.incomplete").data["response"].(map[string]interface{})
+	details := response["incomplete_details"].(map[string]interface{})
+	if details["reason"] != "max_output_tokens" {
+		t.Errorf("incomplete_details = %v", details)
+	}
+	if usage := response["usage"].(map[string]interface{}); usage["output_tokens"] != float64(6) {
+		t.Errorf("usage = %v, want 6 output tokens", usage)
+	}
+	deltas := 0
+	for _, event := range events {
+		if event.name == "response.output_text.delta" {
+			deltas++
+		}
+	}
+	if deltas != 3 {
+		t.Errorf("text deltas = %d, want 3", deltas)
+	}
+}
+
+// closeTracker records whether an upstream body was closed
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTracker) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestResponsesStreamClosesUpstreamBody(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, tc := range []struct {
+		name string
+		resp *http.Response
+	}{
+		{name: "stream", resp: sseResponse(textChunk("m", "hi"), finishChunk("m", "stop"), "[DONE]")},
+		{name: "upstream error", resp: jsonResponse(429, `{"error":{"message":"slow down"}}`)},
+	} {
+		body := &closeTracker{Reader: tc.resp.Body}
+		tc.resp.Body = body
+		resp := tc.resp
+		engine := testEngine(newTestUseCase(t, newStubUpstream(func(*http.Request) (*http.Response, error) { return resp, nil })))
+
+		serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+		if !body.closed {
+			t.Errorf("%s: upstream body left open", tc.name)
+		}
+	}
+}
+
+func TestResponsesStreamEventSequence(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	upstream := newStubUpstream(replySSE(
+		textChunk("m", "Checking"),
+		textChunk("m", " now."),
+		toolCallChunk(0, "call_1", "get_weather", `{"city":`),
+		toolCallChunk(0, "", "", `"Paris"}`),
+		finishChunk("m", "tool_calls"),
+		"[DONE]",
+	))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"weather?","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	want := []string{
+		"response.created",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+		"[DONE]",
+	}
+	if names := eventNames(events); !reflect.DeepEqual(names, want) {
+		t.Fatalf("events = %v\nwant %v", names, want)
+	}
+	for i, event := range events[1:13] {
+		wantIndex := float64(0)
+		if i >= 7 {
+			wantIndex = 1
+		}
+		if event.data["output_index"] != wantIndex {
+			t.Errorf("%s: output_index = %v, want %v", event.name, event.data["output_index"], wantIndex)
+		}
+		if index, ok := event.data["content_index"]; ok && index != float64(0) {
+			t.Errorf("%s: content_index = %v, want 0", event.name, index)
+		}
+	}
+	if text := events[5].data["text"]; text != "Checking now." {
+		t.Errorf("output_text.done text = %v", text)
+	}
+	if args := events[11].data["arguments"]; args != `{"city":"Paris"}` {
+		t.Errorf("function_call_arguments.done arguments = %v", args)
+	}
+
+	completed := events[13].data["response"].(map[string]interface{})
+	output := completed["output"].([]interface{})
+	if completed["status"] != "completed" || len(output) != 2 {
+		t.Fatalf("response.completed = %v", completed)
+	}
+	message, call := output[0].(map[string]interface{}), output[1].(map[string]interface{})
+	if message["type"] != "message" || !reflect.DeepEqual(message["content"], []interface{}{map[string]interface{}{"type": "output_text", "text": "Checking now.", "annotations": []interface{}{}}}) {
+		t.Errorf("output[0] = %v", message)
+	}
+	if call["type"] != "function_call" || call["call_id"] != "call_1" || call["name"] != "get_weather" || call["arguments"] != `{"city":"Paris"}` || call["status"] != "completed" {
+		t.Errorf("output[1] = %v", call)
+	}
+}
+
+func TestResponsesToolMessageMissingToolCallID(t *testing.T) {
+	input := `{"model":"m","input":[
+		{"role":"user","content":"weather?"},
+		{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]},
+		{"role":"tool","content":"sunny"}]}`
+	for _, tc := range []struct {
+		mode   string
+		status int
+	}{
+		{mode: "", status: 200},
+		{mode: "attach", status: 200},
+		{mode: "reject", status: 400},
+	} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    missing_tool_call_id: "%s"
+`, tc.mode))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "It's sunny.", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/responses", input)
+		if resp.Code != tc.status {
+			t.Errorf("mode %q: status = %d, want %d: %s", tc.mode, resp.Code, tc.status, resp.Body.String())
+			continue
+		}
+		if tc.status != 200 {
+			if upstream.count() != 0 || !strings.Contains(resp.Body.String(), "tool_call_id") {
+				t.Errorf("mode %q: body = %s, upstream requests = %d", tc.mode, resp.Body.String(), upstream.count())
+			}
+			continue
+		}
+		messages := upstream.last(t).json(t)["messages"].([]interface{})
+		if id := messages[2].(map[string]interface{})["tool_call_id"]; id != "call_1" {
+			t.Errorf("mode %q: tool_call_id = %v, want call_1", tc.mode, id)
+		}
+	}
+}
+
+func TestStreamsFinalizeOnEOFWithoutDone(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	chunks := []string{textChunk("m", "Hel"), textChunk("m", "lo"), finishChunk("m", "stop")}
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunks...))))
+
+	resp := serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`)
+	events := parseSSE(t, resp.Body.String())
+	names := eventNames(events)
+	if names[len(names)-2] != "response.completed" || names[len(names)-1] != "[DONE]" {
+		t.Fatalf("responses events = %v, want response.completed then [DONE] last", names)
+	}
+	output := findEvent(t, events, "response.completed").data["response"].(map[string]interface{})["output"].([]interface{})
+	content := output[0].(map[string]interface{})["content"].([]interface{})
+	if text := content[0].(map[string]interface{})["text"]; text != "Hello" {
+		t.Errorf("responses output text = %v", text)
+	}
+
+	// Without even a finish_reason the message still closes cleanly
+	for _, chunks := range [][]string{chunks, chunks[:2]} {
+		engine = testEngine(newTestUseCase(t, newStubUpstream(replySSE(chunks...))))
+		resp = serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		events = parseSSE(t, resp.Body.String())
+		names = eventNames(events)
+		if names[len(names)-2] != "message_delta" || names[len(names)-1] != "message_stop" {
+			t.Errorf("messages events = %v, want message_delta then message_stop last", names)
+		}
+		if text := streamText(events); text != "Hello" {
+			t.Errorf("messages text = %q", text)
+		}
+		for _, name := range names {
+			if name == "error" {
+				t.Errorf("messages events = %v, want no error on a clean EOF", names)
+			}
+		}
+	}
+}
+
+func TestResponsesStoresResponsesWithoutUpstreamID(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    store_responses: true
+`)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	noID := `{"object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"kept"},"finish_reason":"stop"}]}`
+	chunks := []string{
+		`{"object":"chat.completion.chunk","model":"m","choices":[{"index":0,"delta":{"content":"kept"}}]}`,
+		`{"object":"chat.completion.chunk","model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		"[DONE]",
+	}
+	for _, stream := range []bool{false, true} {
+		clock.Advance(time.Second)
+		var upstream *stubUpstream
+		if stream {
+			upstream = newStubUpstream(replySSE(chunks...))
+		} else {
+			upstream = newStubUpstream(replyJSON(200, noID))
+		}
+		engine := testEngine(newTestUseCase(t, upstream, WithClock(clock), WithIDPrefix("resp_")))
+
+		resp := serve(engine, "POST", "/a/v1/responses", fmt.Sprintf(`{"model":"m","input":"hi","stream":%t}`, stream))
+		var id interface{}
+		if stream {
+			events := parseSSE(t, resp.Body.String())
+			id = findEvent(t, events, "response.created").data["response"].(map[string]interface{})["id"]
+			if completed := findEvent(t, events, "response.completed").data["response"].(map[string]interface{})["id"]; completed != id {
+				t.Errorf("stream: completed id = %v, created id = %v", completed, id)
+			}
+		} else {
+			id = decodeJSON(t, resp)["id"]
+		}
+		want := fmt.Sprintf("resp_%d", clock.Now().UnixNano())
+		if id != want {
+			t.Fatalf("stream=%t: id = %v, want synthesized %s", stream, id, want)
+		}
+
+		stored := serve(engine, "GET", "/a/v1/responses/"+want, "")
+		if stored.Code != 200 {
+			t.Fatalf("stream=%t: GET stored response: status %d: %s", stream, stored.Code, stored.Body)
+		}
+		body := decodeJSON(t, stored)
+		content := body["output"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})
+		if body["id"] != want || content[0].(map[string]interface{})["text"] != "kept" {
+			t.Errorf("stream=%t: stored response = %v", stream, body)
+		}
+	}
+}
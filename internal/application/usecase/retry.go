@@ -0,0 +1,99 @@
+package usecase
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+)
+
+const (
+	// defaultBodyRetries bounds body-pattern retries when the alias sets
+	// retry_body_patterns without retry_max_attempts.
+	defaultBodyRetries = 2
+	// bodyRetryBackoff is the wait before the first retry; it grows
+	// linearly with each further attempt.
+	bodyRetryBackoff = 500 * time.Millisecond
+)
+
+// bodyRetryPolicy returns the retry_body_patterns of alias and how many
+// retries they allow. No patterns disable body-pattern retries.
+func bodyRetryPolicy(alias string) ([]string, int) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || len(cfg.RetryBodyPatterns) == 0 {
+		return nil, 0
+	}
+	retries := cfg.RetryMaxAttempts
+	if retries <= 0 {
+		retries = defaultBodyRetries
+	}
+	return cfg.RetryBodyPatterns, retries
+}
+
+// shouldRetryBody reports whether an upstream response matches one of
+// patterns (case-insensitive). A 2xx response is only considered when its
+// body is an error payload, so successful completions are never retried.
+func shouldRetryBody(body []byte, statusCode int, patterns []string) bool {
+	if len(body) == 0 {
+		return false
+	}
+	if statusCode >= 200 && statusCode <= 299 && !isErrorBody(body) {
+		return false
+	}
+	text := strings.ToLower(string(body))
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(text, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isErrorBody reports whether body is a JSON object carrying an error and
+// no completion choices.
+func isErrorBody(body []byte) bool {
+	var payload struct {
+		Error   json.RawMessage `json:"error"`
+		Choices json.RawMessage `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return false
+	}
+	hasError := len(payload.Error) > 0 && string(payload.Error) != "null"
+	hasChoices := len(payload.Choices) > 0 && string(payload.Choices) != "null"
+	return hasError && !hasChoices
+}
+
+// waitRetry sleeps before retry attempt (1-based) and reports false when
+// the client went away meanwhile.
+func waitRetry(c *gin.Context, attempt int) bool {
+	timer := time.NewTimer(time.Duration(attempt) * bodyRetryBackoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// sendCompleteWithRetry performs sendComplete, retrying while the upstream
+// answers with a body matching the alias's retry_body_patterns.
+func (u *ProxyUseCase) sendCompleteWithRetry(c *gin.Context, chatReq map[string]interface{}, upstreamPath string, alias string) ([]byte, int, http.Header, error) {
+	patterns, retries := bodyRetryPolicy(alias)
+	for attempt := 0; ; attempt++ {
+		respBody, statusCode, headers, err := u.sendComplete(c, chatReq, upstreamPath, alias)
+		if err != nil || attempt >= retries || !shouldRetryBody(respBody, statusCode, patterns) {
+			return respBody, statusCode, headers, err
+		}
+		log.Printf("upstream body matched a retry pattern (status=%d), retrying alias %s (%d/%d)", statusCode, resolveAlias(alias), attempt+1, retries)
+		if !waitRetry(c, attempt+1) {
+			return respBody, statusCode, headers, err
+		}
+	}
+}
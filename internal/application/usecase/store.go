@@ -0,0 +1,75 @@
+package usecase
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+)
+
+// DefaultResponseStoreTTL keeps stored responses for an hour when the
+// alias sets no response_store_ttl.
+const DefaultResponseStoreTTL = time.Hour
+
+// responseStoreTTL reports whether alias stores Responses API results and
+// for how long.
+func responseStoreTTL(alias string) (time.Duration, bool) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || !cfg.StoreResponses {
+		return 0, false
+	}
+	if cfg.ResponseStoreTTL > 0 {
+		return time.Duration(cfg.ResponseStoreTTL) * time.Second, true
+	}
+	return DefaultResponseStoreTTL, true
+}
+
+// storeResponse persists a completed Responses object when the alias
+// stores responses and the request did not opt out with store: false.
+func (u *ProxyUseCase) storeResponse(alias string, payload map[string]interface{}, response map[string]interface{}) {
+	ttl, ok := responseStoreTTL(alias)
+	if !ok || response == nil {
+		return
+	}
+	if store, set := payload["store"].(bool); set && !store {
+		return
+	}
+	id, _ := response["id"].(string)
+	if id == "" {
+		return
+	}
+	u.responses.Save(resolveAlias(alias), id, response, u.clock.Now(), ttl)
+}
+
+// HandleGetResponse handles GET /v1/responses/:id, returning a stored
+// response of the alias or 404.
+func (u *ProxyUseCase) HandleGetResponse(c *gin.Context, alias string) {
+	id := c.Param("id")
+	response, ok := u.responses.Find(resolveAlias(alias), id, u.clock.Now())
+	if !ok {
+		writeOpenAIError(c, http.StatusNotFound, "invalid_request_error", responseNotFoundMessage(id))
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// HandleDeleteResponse handles DELETE /v1/responses/:id, removing a stored
+// response of the alias or answering 404.
+func (u *ProxyUseCase) HandleDeleteResponse(c *gin.Context, alias string) {
+	id := c.Param("id")
+	if !u.responses.Delete(resolveAlias(alias), id, u.clock.Now()) {
+		writeOpenAIError(c, http.StatusNotFound, "invalid_request_error", responseNotFoundMessage(id))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"object":  "response.deleted",
+		"deleted": true,
+	})
+}
+
+func responseNotFoundMessage(id string) string {
+	return "Response with id '" + id + "' not found."
+}
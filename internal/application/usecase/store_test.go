@@ -0,0 +1,113 @@
+package usecase
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const storeConfig = `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    store_responses: true
+    response_store_ttl: 60
+  b:
+    base_url: "http://upstream.test/v1"
+    store_responses: true
+`
+
+func TestGetStoredResponse(t *testing.T) {
+	loadConfig(t, storeConfig)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	upstream := newStubUpstream(replyJSON(200, completion("m", "remember me", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream, WithClock(clock)))
+
+	created := decodeJSON(t, serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi"}`))
+	id, _ := created["id"].(string)
+	if id == "" {
+		t.Fatalf("response has no id: %v", created)
+	}
+
+	for _, target := range []string{"/a/v1/responses/" + id, "/v1/responses/" + id} {
+		resp := serve(engine, "GET", target, "")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", target, resp.Code, resp.Body)
+		}
+		if got := decodeJSON(t, resp); got["id"] != id || got["object"] != "response" {
+			t.Errorf("GET %s = %v", target, got)
+		}
+	}
+	if upstream.count() != 1 {
+		t.Errorf("upstream calls = %d, want retrieval served from the store", upstream.count())
+	}
+
+	for _, tc := range []struct{ name, target string }{
+		{name: "unknown id", target: "/a/v1/responses/resp_missing"},
+		{name: "other alias", target: "/b/v1/responses/" + id},
+	} {
+		resp := serve(engine, "GET", tc.target, "")
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", tc.name, resp.Code)
+			continue
+		}
+		errBody := decodeJSON(t, resp)["error"].(map[string]interface{})
+		if errBody["type"] != "invalid_request_error" {
+			t.Errorf("%s: error = %v", tc.name, errBody)
+		}
+	}
+
+	// Stored responses expire after the alias TTL
+	clock.Advance(61 * time.Second)
+	if resp := serve(engine, "GET", "/a/v1/responses/"+id, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("after TTL: status %d, want 404", resp.Code)
+	}
+}
+
+func TestResponseStoreOptOut(t *testing.T) {
+	loadConfig(t, storeConfig)
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, completion("m", "secret", "stop")))))
+
+	created := decodeJSON(t, serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi","store":false}`))
+	if resp := serve(engine, "GET", "/a/v1/responses/"+created["id"].(string), ""); resp.Code != http.StatusNotFound {
+		t.Errorf("store:false response retrievable: status %d", resp.Code)
+	}
+}
+
+func TestDeleteStoredResponse(t *testing.T) {
+	loadConfig(t, storeConfig)
+	engine := testEngine(newTestUseCase(t, newStubUpstream(replyJSON(200, completion("m", "bye", "stop")))))
+
+	id := decodeJSON(t, serve(engine, "POST", "/a/v1/responses", `{"model":"m","input":"hi"}`))["id"].(string)
+
+	// Another alias cannot delete it
+	if resp := serve(engine, "DELETE", "/b/v1/responses/"+id, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("DELETE from other alias: status %d, want 404", resp.Code)
+	}
+
+	resp := serve(engine, "DELETE", "/a/v1/responses/"+id, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("DELETE: status %d: %s", resp.Code, resp.Body)
+	}
+	want := map[string]interface{}{"id": id, "object": "response.deleted", "deleted": true}
+	if got := decodeJSON(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("DELETE = %v, want %v", got, want)
+	}
+	if resp := serve(engine, "GET", "/a/v1/responses/"+id, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: status %d, want 404", resp.Code)
+	}
+
+	for _, target := range []string{"/a/v1/responses/" + id, "/a/v1/responses/resp_missing"} {
+		resp := serve(engine, "DELETE", target, "")
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("DELETE %s: status %d, want 404", target, resp.Code)
+			continue
+		}
+		if errBody := decodeJSON(t, resp)["error"].(map[string]interface{}); errBody["type"] != "invalid_request_error" {
+			t.Errorf("DELETE %s: error = %v", target, errBody)
+		}
+	}
+}
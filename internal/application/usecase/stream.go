@@ -0,0 +1,135 @@
+package usecase
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"api-conver/internal/config"
+)
+
+// streamOptions carries per-alias knobs for SSE stream conversion
+type streamOptions struct {
+	// maxParseErrors aborts the stream after this many consecutive
+	// unparseable chunks. Zero means bad chunks are always skipped.
+	maxParseErrors int
+	// logprobs forwards upstream choice logprobs as an extension field on
+	// converted text deltas.
+	logprobs bool
+	// maxOutputTokens ends the converted stream once the emitted output
+	// reaches this many estimated tokens, even if the upstream keeps
+	// generating.
+	maxOutputTokens int
+	// coalesceWindow merges consecutive text deltas that arrive within the
+	// window into a single event.
+	coalesceWindow time.Duration
+	// idleTimeout aborts the stream when the upstream sends nothing for
+	// this long. Zero waits indefinitely.
+	idleTimeout time.Duration
+}
+
+func streamOptionsFor(alias string) streamOptions {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil {
+		return streamOptions{}
+	}
+	return streamOptions{
+		maxParseErrors:  cfg.MaxStreamParseErrors,
+		logprobs:        cfg.StreamLogprobs,
+		maxOutputTokens: cfg.MaxStreamOutputTokens,
+		coalesceWindow:  time.Duration(cfg.StreamCoalesceMS) * time.Millisecond,
+		idleTimeout:     time.Duration(cfg.StreamIdleTimeout) * time.Second,
+	}
+}
+
+// deltaText returns the text of a stream delta's content. Some upstreams
+// send content as an array of parts; their text is concatenated.
+func deltaText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var b strings.Builder
+		for _, item := range v {
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if partType, _ := part["type"].(string); partType == "text" || partType == "output_text" {
+				text, _ := part["text"].(string)
+				b.WriteString(text)
+			}
+		}
+		return b.String()
+	default:
+		return ""
+	}
+}
+
+// streamWatchdog closes an upstream body once no data arrived for the idle
+// timeout, unblocking the pending read. A nil watchdog never fires.
+type streamWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+func newStreamWatchdog(timeout time.Duration, body io.Closer) *streamWatchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &streamWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.fired.Store(true)
+		body.Close()
+	})
+	return w
+}
+
+// reset restarts the idle timeout after upstream data arrived
+func (w *streamWatchdog) reset() {
+	if w != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+func (w *streamWatchdog) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// timedOut reports whether the watchdog closed the body
+func (w *streamWatchdog) timedOut() bool {
+	return w != nil && w.fired.Load()
+}
+
+// sseResult is one data payload read by readSSEAsync, or the error that
+// ended the stream
+type sseResult struct {
+	data string
+	err  error
+}
+
+// readSSEAsync reads data payloads in the background, so a converting
+// loop can also wake up for timers while the upstream is quiet. Reading
+// stops after the first error or once done is closed.
+func readSSEAsync(reader *bufio.Reader, done <-chan struct{}) <-chan sseResult {
+	results := make(chan sseResult)
+	go func() {
+		for {
+			data, err := readSSEData(reader)
+			select {
+			case results <- sseResult{data: data, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
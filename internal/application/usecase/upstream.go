@@ -0,0 +1,477 @@
+package usecase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+	"api-conver/internal/domain/model"
+)
+
+const (
+	streamModeStream    = "stream"
+	streamModeNonStream = "non_stream"
+)
+
+// forcedStreamMode returns the upstream mode an alias is pinned to, if any
+func forcedStreamMode(alias string) string {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil {
+		return ""
+	}
+	if cfg.ForceStream {
+		return streamModeStream
+	}
+	if cfg.ForceNonStream {
+		return streamModeNonStream
+	}
+	return ""
+}
+
+const (
+	// ConvertedModelHeader reports the model sent upstream
+	ConvertedModelHeader = "X-Converted-Model"
+	// ConvertedToolsCountHeader reports the number of tools sent upstream
+	ConvertedToolsCountHeader = "X-Converted-Tools-Count"
+)
+
+// setConvertedHeaders exposes what the proxy sends upstream on the client
+// response when the alias enables debug_headers.
+func setConvertedHeaders(c *gin.Context, chatReq map[string]interface{}, alias string) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || !cfg.DebugHeaders {
+		return
+	}
+	modelName, _ := chatReq["model"].(string)
+	c.Header(ConvertedModelHeader, modelName)
+	tools := 0
+	switch list := chatReq["tools"].(type) {
+	case []interface{}:
+		tools = len(list)
+	case []map[string]interface{}:
+		tools = len(list)
+	}
+	c.Header(ConvertedToolsCountHeader, strconv.Itoa(tools))
+}
+
+// stripNullFields removes null-valued optional fields from an outbound chat
+// request when the alias enables strip_nulls. Only top-level fields and
+// message fields are touched: a null message content next to tool_calls is
+// kept, and tool schemas and arguments are never rewritten since their
+// nulls carry meaning.
+func stripNullFields(chatReq map[string]interface{}, alias string) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || !cfg.StripNulls {
+		return
+	}
+	for key, value := range chatReq {
+		if value == nil {
+			delete(chatReq, key)
+		}
+	}
+	switch messages := chatReq["messages"].(type) {
+	case []interface{}:
+		for _, item := range messages {
+			if msg, ok := item.(map[string]interface{}); ok {
+				stripNullMessageFields(msg)
+			}
+		}
+	case []map[string]interface{}:
+		for _, msg := range messages {
+			stripNullMessageFields(msg)
+		}
+	}
+}
+
+func stripNullMessageFields(msg map[string]interface{}) {
+	for key, value := range msg {
+		if value == nil && key != "content" {
+			delete(msg, key)
+		}
+	}
+}
+
+// upstreamComplete performs a non-streaming chat completion. When the alias
+// forces streaming, the upstream stream is buffered into a complete response.
+// Error bodies matching retry_body_patterns are retried first.
+func (u *ProxyUseCase) upstreamComplete(c *gin.Context, chatReq map[string]interface{}, upstreamPath string, alias string) ([]byte, int, http.Header, error) {
+	respBody, statusCode, headers, err := u.sendCompleteWithRetry(c, chatReq, upstreamPath, alias)
+	if fallback, ok := u.fallbackCompletion(alias, chatReq, statusCode, err); ok {
+		body, _ := json.Marshal(fallback)
+		return body, http.StatusOK, http.Header{"Content-Type": {"application/json"}}, nil
+	}
+	return respBody, statusCode, headers, err
+}
+
+func (u *ProxyUseCase) sendComplete(c *gin.Context, chatReq map[string]interface{}, upstreamPath string, alias string) ([]byte, int, http.Header, error) {
+	aliasCfg := getUpstreamConfig(alias)
+	if forcedStreamMode(alias) != streamModeStream {
+		chatReq["stream"] = false
+		delete(chatReq, "stream_options")
+		out, _ := json.Marshal(chatReq)
+		return u.client.ProxyRequest(c, out, "POST", upstreamPath, aliasCfg)
+	}
+
+	chatReq["stream"] = true
+	chatReq["stream_options"] = map[string]interface{}{"include_usage": true}
+	out, _ := json.Marshal(chatReq)
+	resp, err := u.client.ProxyStream(c, out, "POST", upstreamPath, aliasCfg)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return body, resp.StatusCode, resp.Header, nil
+	}
+
+	body, err := bufferOpenAIStream(resp.Body)
+	headers := resp.Header.Clone()
+	headers.Set("Content-Type", "application/json")
+	var streamErr *streamErrorChunk
+	if errors.As(err, &streamErr) {
+		// Surface the error chunk as an error response so callers convert
+		// it like any other upstream failure.
+		body, _ := json.Marshal(model.OpenAIErrorResponse{Error: streamErr.detail})
+		return body, http.StatusBadGateway, headers, nil
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return body, resp.StatusCode, headers, nil
+}
+
+// upstreamStream opens a streaming chat completion. When the alias forces
+// non-streaming, the stream is synthesized from the complete response.
+func (u *ProxyUseCase) upstreamStream(c *gin.Context, chatReq map[string]interface{}, upstreamPath string, alias string) (*http.Response, error) {
+	resp, err := u.sendStream(c, chatReq, upstreamPath, alias)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	if fallback, ok := u.fallbackCompletion(alias, chatReq, statusCode, err); ok {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return u.fallbackStream(fallback), nil
+	}
+	return resp, err
+}
+
+func (u *ProxyUseCase) sendStream(c *gin.Context, chatReq map[string]interface{}, upstreamPath string, alias string) (*http.Response, error) {
+	aliasCfg := getUpstreamConfig(alias)
+	if forcedStreamMode(alias) != streamModeNonStream {
+		chatReq["stream"] = true
+		chatReq["stream_options"] = map[string]interface{}{"include_usage": true}
+		out, _ := json.Marshal(chatReq)
+		return u.client.ProxyStream(c, out, "POST", upstreamPath, aliasCfg)
+	}
+
+	chatReq["stream"] = false
+	delete(chatReq, "stream_options")
+	out, _ := json.Marshal(chatReq)
+	respBody, statusCode, headers, err := u.client.ProxyRequest(c, out, "POST", upstreamPath, aliasCfg)
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		StatusCode: statusCode,
+		Header:     headers.Clone(),
+		Body:       io.NopCloser(bytes.NewReader(respBody)),
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return resp, nil
+	}
+
+	var openAIResp model.OpenAIResponse
+	if err := json.Unmarshal(respBody, &openAIResp); err != nil {
+		return nil, errors.New("invalid upstream response")
+	}
+	resp.Header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	resp.Body = io.NopCloser(bytes.NewReader(u.synthesizeOpenAIStream(openAIResp)))
+	return resp, nil
+}
+
+// fallbackCompletion returns the alias's canned completion when the upstream
+// failed outright (transport error or 5xx) and a fallback is configured.
+func (u *ProxyUseCase) fallbackCompletion(alias string, chatReq map[string]interface{}, statusCode int, err error) (model.OpenAIResponse, bool) {
+	cfg := config.GetAliasConfig(resolveAlias(alias))
+	if cfg == nil || cfg.FallbackResponse == "" {
+		return model.OpenAIResponse{}, false
+	}
+	if err == nil && statusCode < http.StatusInternalServerError {
+		return model.OpenAIResponse{}, false
+	}
+	log.Printf("upstream failed (status=%d err=%v), serving fallback response for alias %s", statusCode, err, resolveAlias(alias))
+
+	modelName, _ := chatReq["model"].(string)
+	fallback := model.OpenAIResponse{
+		ID:      synthesizeID(u.clock, "chatcmpl-fallback-"),
+		Object:  "chat.completion",
+		Created: u.clock.Now().Unix(),
+		Model:   modelName,
+	}
+	fallback.Choices = []model.OpenAIChoice{{
+		Message: &model.OpenAIMessage{
+			Role:    "assistant",
+			Content: cfg.FallbackResponse,
+		},
+		FinishReason: "stop",
+	}}
+	return fallback, true
+}
+
+func (u *ProxyUseCase) fallbackStream(fallback model.OpenAIResponse) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}},
+		Body:       io.NopCloser(bytes.NewReader(u.synthesizeOpenAIStream(fallback))),
+	}
+}
+
+// readSSEData returns the payload of the next SSE data line
+func readSSEData(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || strings.TrimSpace(line) == "") {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || !strings.HasPrefix(line, "data:") {
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+		return data, nil
+	}
+}
+
+// streamErrorChunk is returned by bufferOpenAIStream when the upstream
+// sends an error object in place of a chunk
+type streamErrorChunk struct {
+	detail *model.OpenAIError
+}
+
+func (e *streamErrorChunk) Error() string {
+	return "upstream stream error: " + e.detail.Message
+}
+
+// bufferOpenAIStream assembles an OpenAI SSE stream into a chat.completion
+// body. An error chunk aborts it with a *streamErrorChunk.
+func bufferOpenAIStream(body io.Reader) ([]byte, error) {
+	reader := bufio.NewReader(body)
+	var (
+		id, modelName, finishReason string
+		created                     int64
+		content                     strings.Builder
+		usage                       *model.OpenAIUsage
+	)
+	type bufferedCall struct {
+		id        string
+		name      string
+		arguments strings.Builder
+	}
+	calls := map[int]*bufferedCall{}
+
+	for {
+		data, err := readSSEData(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if data == "[DONE]" {
+			break
+		}
+		if upstreamErr, ok := parseStreamError(data); ok {
+			return nil, &streamErrorChunk{detail: upstreamErr}
+		}
+
+		var chunk model.OpenAIStreamResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if id == "" {
+			id = chunk.ID
+		}
+		if modelName == "" {
+			modelName = chunk.Model
+		}
+		if created == 0 {
+			created = chunk.Created
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			content.WriteString(deltaText(choice.Delta.Content))
+			for _, call := range choice.Delta.ToolCalls {
+				buffered := calls[call.Index]
+				if buffered == nil {
+					buffered = &bufferedCall{}
+					calls[call.Index] = buffered
+				}
+				if call.ID != "" {
+					buffered.id = call.ID
+				}
+				if call.Function.Name != "" {
+					buffered.name = call.Function.Name
+				}
+				buffered.arguments.WriteString(call.Function.Arguments)
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				finishReason = *choice.FinishReason
+			}
+		}
+	}
+
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": content.String(),
+	}
+	if len(calls) > 0 {
+		indexes := make([]int, 0, len(calls))
+		for index := range calls {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		toolCalls := make([]model.OpenAIToolCall, 0, len(indexes))
+		for _, index := range indexes {
+			call := calls[index]
+			toolCalls = append(toolCalls, model.OpenAIToolCall{
+				ID:   call.id,
+				Type: "function",
+				Function: model.OpenAIFunctionCall{
+					Name:      call.name,
+					Arguments: call.arguments.String(),
+				},
+			})
+		}
+		message["tool_calls"] = toolCalls
+	}
+
+	completion := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   modelName,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       message,
+				"finish_reason": finishReason,
+			},
+		},
+	}
+	if usage != nil {
+		completion["usage"] = usage
+	}
+	return json.Marshal(completion)
+}
+
+// synthesizeOpenAIStream renders a complete chat.completion as SSE chunks
+func (u *ProxyUseCase) synthesizeOpenAIStream(resp model.OpenAIResponse) []byte {
+	var buf bytes.Buffer
+	writeChunk := func(choices []interface{}, usage *model.OpenAIUsage) {
+		chunk := map[string]interface{}{
+			"id":      resp.ID,
+			"object":  "chat.completion.chunk",
+			"created": resp.Created,
+			"model":   resp.Model,
+			"choices": choices,
+		}
+		if usage != nil {
+			chunk["usage"] = usage
+		}
+		body, _ := json.Marshal(chunk)
+		buf.WriteString("data: ")
+		buf.Write(body)
+		buf.WriteString("\n\n")
+	}
+
+	for _, choice := range resp.Choices {
+		delta := map[string]interface{}{"role": "assistant"}
+		if choice.Message != nil {
+			if text := u.converter.OpenAIContentToString(choice.Message.Content); text != "" {
+				delta["content"] = text
+			}
+			if len(choice.Message.ToolCalls) > 0 {
+				toolCalls := make([]interface{}, 0, len(choice.Message.ToolCalls))
+				for i, call := range choice.Message.ToolCalls {
+					toolCalls = append(toolCalls, map[string]interface{}{
+						"index":    i,
+						"id":       call.ID,
+						"type":     "function",
+						"function": call.Function,
+					})
+				}
+				delta["tool_calls"] = toolCalls
+			}
+		}
+		writeChunk([]interface{}{map[string]interface{}{
+			"index": choice.Index,
+			"delta": delta,
+		}}, nil)
+
+		finishReason := choice.FinishReason
+		if finishReason == "" {
+			finishReason = "stop"
+		}
+		writeChunk([]interface{}{map[string]interface{}{
+			"index":         choice.Index,
+			"delta":         map[string]interface{}{},
+			"finish_reason": finishReason,
+		}}, nil)
+	}
+	usage := resp.Usage
+	writeChunk([]interface{}{}, &usage)
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes()
+}
+
+// parseStreamError reports whether an SSE data payload is an error object
+// rather than a chunk. Both {"error":{...}} and {"error":"message"} are
+// recognized.
+func parseStreamError(data string) (*model.OpenAIError, bool) {
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil || len(payload.Error) == 0 || string(payload.Error) == "null" {
+		return nil, false
+	}
+	var detail model.OpenAIError
+	if err := json.Unmarshal(payload.Error, &detail); err == nil {
+		if detail.Message == "" {
+			detail.Message = "upstream stream error"
+		}
+		return &detail, true
+	}
+	var message string
+	if err := json.Unmarshal(payload.Error, &message); err == nil && message != "" {
+		return &model.OpenAIError{Message: message}, true
+	}
+	return &model.OpenAIError{Message: string(payload.Error)}, true
+}
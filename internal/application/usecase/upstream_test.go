@@ -0,0 +1,364 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForceStreamBuffersUpstreamStream(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    force_stream: true
+`)
+	upstream := newStubUpstream(replySSE(textChunk("m", "Hel"), textChunk("m", "lo"), finishChunk("m", "stop"), "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.Code, resp.Body.String())
+	}
+	if body := upstream.last(t).json(t); body["stream"] != true {
+		t.Errorf("upstream stream = %v, want true", body["stream"])
+	}
+	message := decodeJSON(t, resp)
+	block := message["content"].([]interface{})[0].(map[string]interface{})
+	if block["text"] != "Hello" || message["stop_reason"] != "end_turn" {
+		t.Errorf("message = %v", message)
+	}
+}
+
+func TestForceStreamSurfacesErrorChunk(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    force_stream: true
+`)
+	errChunk := `{"error":{"message":"quota exhausted","type":"insufficient_quota"}}`
+	upstream := newStubUpstream(replySSE(textChunk("m", "Hel"), errChunk, "[DONE]"))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502: %s", resp.Code, resp.Body.String())
+	}
+	detail := decodeJSON(t, resp)["error"].(map[string]interface{})
+	if detail["type"] != "rate_limit_error" || detail["message"] != "quota exhausted" {
+		t.Errorf("error = %v", detail)
+	}
+
+	resp = serve(engine, "POST", "/a/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.Code != http.StatusBadGateway {
+		t.Fatalf("chat completions status = %d, want 502: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestForceNonStreamSynthesizesStream(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    force_non_stream: true
+`)
+	upstream := newStubUpstream(replyJSON(200, completion("m", "Hello", "stop")))
+	engine := testEngine(newTestUseCase(t, upstream))
+
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if body := upstream.last(t).json(t); body["stream"] != false {
+		t.Errorf("upstream stream = %v, want false", body["stream"])
+	}
+	events := parseSSE(t, resp.Body.String())
+	if text := streamText(events); text != "Hello" {
+		t.Errorf("text = %q, want Hello", text)
+	}
+	if names := eventNames(events); names[len(names)-1] != "message_stop" {
+		t.Errorf("events = %v, want message_stop last", names)
+	}
+}
+
+func TestFallbackResponseOnTotalUpstreamFailure(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://primary.test/v1"
+    fallback_base_url: "http://secondary.test/v1"
+    fallback_response: "Service is busy, try again later."
+  plain:
+    base_url: "http://primary.test/v1"
+`)
+	for _, failure := range []struct {
+		name    string
+		respond func(*http.Request) (*http.Response, error)
+	}{
+		{name: "transport error", respond: func(*http.Request) (*http.Response, error) { return nil, errors.New("connection refused") }},
+		{name: "5xx", respond: replyJSON(http.StatusServiceUnavailable, `{"error":{"message":"down","type":"server_error"}}`)},
+	} {
+		upstream := newStubUpstream(failure.respond)
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", failure.name, resp.Code, resp.Body.String())
+		}
+		message := decodeJSON(t, resp)
+		block := message["content"].([]interface{})[0].(map[string]interface{})
+		if block["text"] != "Service is busy, try again later." || message["stop_reason"] != "end_turn" {
+			t.Errorf("%s: message = %v", failure.name, message)
+		}
+		// Both the primary and the fallback base URL were tried first
+		if upstream.count() != 2 {
+			t.Errorf("%s: upstream calls = %d, want primary and fallback", failure.name, upstream.count())
+		}
+
+		resp = serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		if text := streamText(parseSSE(t, resp.Body.String())); text != "Service is busy, try again later." {
+			t.Errorf("%s: streamed text = %q", failure.name, text)
+		}
+
+		resp = serve(engine, "POST", "/plain/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+		if resp.Code == http.StatusOK {
+			t.Errorf("%s: alias without fallback_response answered 200", failure.name)
+		}
+	}
+}
+
+func TestConvertedDebugHeaders(t *testing.T) {
+	const tool = `{"name":"lookup","description":"Look up","input_schema":{"type":"object"}}`
+	const function = `{"type":"function","name":"lookup","parameters":{"type":"object"}}`
+	requests := []struct {
+		name, path, body string
+		tools            string
+	}{
+		{"messages", "/a/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":16,"tools":[` + tool + `,` + tool + `],"messages":[{"role":"user","content":"hi"}]}`, "2"},
+		{"messages stream", "/a/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":16,"stream":true,"tools":[` + tool + `],"messages":[{"role":"user","content":"hi"}]}`, "1"},
+		{"responses", "/a/v1/responses", `{"model":"claude-3-5-sonnet","tools":[` + function + `],"input":"hi"}`, "1"},
+		{"chat", "/a/v1/chat/completions", `{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"hi"}]}`, "0"},
+	}
+	for _, enabled := range []bool{true, false} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    debug_headers: %t
+    model_map:
+      claude-3-5-sonnet: "qwen2.5-72b"
+`, enabled))
+		var upstream *stubUpstream
+		upstream = newStubUpstream(func(*http.Request) (*http.Response, error) {
+			if stream, _ := upstream.last(t).json(t)["stream"].(bool); stream {
+				return sseResponse(textChunk("m", "hi"), finishChunk("m", "stop"), "[DONE]"), nil
+			}
+			return jsonResponse(200, completion("m", "hi", "stop")), nil
+		})
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		for _, tc := range requests {
+			resp := serve(engine, "POST", tc.path, tc.body)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d: %s", tc.name, resp.Code, resp.Body.String())
+			}
+			model, tools := resp.Header().Get(ConvertedModelHeader), resp.Header().Get(ConvertedToolsCountHeader)
+			if !enabled {
+				if model != "" || tools != "" {
+					t.Errorf("%s: debug headers sent while disabled: %q, %q", tc.name, model, tools)
+				}
+				continue
+			}
+			if model != "qwen2.5-72b" || tools != tc.tools {
+				t.Errorf("%s: %s = %q, %s = %q, want qwen2.5-72b and %s", tc.name, ConvertedModelHeader, model, ConvertedToolsCountHeader, tools, tc.tools)
+			}
+			if sent := upstream.last(t).json(t)["model"]; sent != model {
+				t.Errorf("%s: header model %q differs from the upstream model %v", tc.name, model, sent)
+			}
+		}
+	}
+}
+
+func TestStripNullFields(t *testing.T) {
+	body := `{"model":"m","user":null,"seed":null,"temperature":0.5,
+		"tools":[{"type":"function","function":{"name":"f","parameters":{"type":"object","default":null}}}],
+		"messages":[
+			{"role":"user","content":"hi","name":null},
+			{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{\"x\":null}"}}]},
+			{"role":"tool","tool_call_id":"call_1","content":"ok"}]}`
+	for _, enabled := range []bool{true, false} {
+		loadConfig(t, fmt.Sprintf(`
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    strip_nulls: %t
+`, enabled))
+		upstream := newStubUpstream(replyJSON(200, completion("m", "hi", "stop")))
+		engine := testEngine(newTestUseCase(t, upstream))
+		serve(engine, "POST", "/a/v1/chat/completions", body)
+
+		sent := upstream.last(t).json(t)
+		for _, key := range []string{"user", "seed"} {
+			if _, ok := sent[key]; ok == enabled {
+				t.Errorf("strip_nulls=%t: top-level %s present = %t", enabled, key, ok)
+			}
+		}
+		if sent["temperature"] != 0.5 {
+			t.Errorf("strip_nulls=%t: temperature = %v", enabled, sent["temperature"])
+		}
+		messages := sent["messages"].([]interface{})
+		if _, ok := messages[0].(map[string]interface{})["name"]; ok == enabled {
+			t.Errorf("strip_nulls=%t: message name present = %t", enabled, ok)
+		}
+		assistant := messages[1].(map[string]interface{})
+		if content, ok := assistant["content"]; !ok || content != nil {
+			t.Errorf("strip_nulls=%t: assistant content = %v (present %t), want a kept null", enabled, content, ok)
+		}
+		call := assistant["tool_calls"].([]interface{})[0].(map[string]interface{})
+		if args := call["function"].(map[string]interface{})["arguments"]; args != `{"x":null}` {
+			t.Errorf("strip_nulls=%t: arguments = %v", enabled, args)
+		}
+		params := sent["tools"].([]interface{})[0].(map[string]interface{})["function"].(map[string]interface{})["parameters"].(map[string]interface{})
+		if value, ok := params["default"]; !ok || value != nil {
+			t.Errorf("strip_nulls=%t: schema default = %v (present %t), want a kept null", enabled, value, ok)
+		}
+	}
+}
+
+func TestBodyPatternRetry(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    retry_body_patterns: ["model is overloaded"]
+    retry_max_attempts: 1
+`)
+	const overloaded = `{"error":{"message":"The Model Is Overloaded, try later","type":"server_error"}}`
+	for _, tc := range []struct {
+		name      string
+		first     string
+		wantCalls int
+		wantText  string
+	}{
+		{name: "200 error body", first: overloaded, wantCalls: 2, wantText: "recovered"},
+		{name: "completion mentioning the pattern", first: completion("m", "the model is overloaded", "stop"), wantCalls: 1, wantText: "the model is overloaded"},
+		{name: "unrelated error body", first: `{"error":{"message":"bad key","type":"auth"}}`, wantCalls: 1},
+	} {
+		var calls int
+		upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return jsonResponse(200, tc.first), nil
+			}
+			return jsonResponse(200, completion("m", "recovered", "stop")), nil
+		})
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+		if upstream.count() != tc.wantCalls {
+			t.Errorf("%s: upstream calls = %d, want %d", tc.name, upstream.count(), tc.wantCalls)
+		}
+		if tc.wantText == "" {
+			continue
+		}
+		if resp.Code != 200 {
+			t.Fatalf("%s: status %d: %s", tc.name, resp.Code, resp.Body)
+		}
+		content := decodeJSON(t, resp)["content"].([]interface{})
+		if text := content[0].(map[string]interface{})["text"]; text != tc.wantText {
+			t.Errorf("%s: text = %v, want %s", tc.name, text, tc.wantText)
+		}
+	}
+
+	// Retries stop at retry_max_attempts
+	upstream := newStubUpstream(replyJSON(503, overloaded))
+	engine := testEngine(newTestUseCase(t, upstream))
+	resp := serve(engine, "POST", "/a/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if upstream.count() != 2 || resp.Code != 503 {
+		t.Errorf("persistent overload: calls = %d, status = %d, want 2 calls and 503", upstream.count(), resp.Code)
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	for _, stream := range []bool{false, true} {
+		upstream := newStubUpstream(func(*http.Request) (*http.Response, error) {
+			var resp *http.Response
+			if stream {
+				resp = sseResponse(textChunk("m", "ok"), finishChunk("m", "stop"), "[DONE]")
+			} else {
+				resp = jsonResponse(200, completion("m", "ok", "stop"))
+			}
+			// The upstream's own id must not replace the proxy's
+			resp.Header.Set("X-Request-ID", "upstream-generated")
+			return resp, nil
+		})
+		engine := testEngine(newTestUseCase(t, upstream))
+		request := fmt.Sprintf(`{"model":"m","max_tokens":16,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream)
+
+		resp := serve(engine, "POST", "/a/v1/messages", request)
+		generated := resp.Header().Get("X-Request-ID")
+		if !strings.HasPrefix(generated, "req_") {
+			t.Fatalf("stream=%t: response X-Request-ID = %q, want a generated id", stream, generated)
+		}
+		if sent := upstream.last(t).header.Get("X-Request-ID"); sent != generated {
+			t.Errorf("stream=%t: upstream X-Request-ID = %q, want %q", stream, sent, generated)
+		}
+
+		// A client-supplied id is kept end to end
+		resp = serve(engine, "POST", "/a/v1/messages", request, "X-Request-ID", "client-trace-1")
+		if got := resp.Header().Get("X-Request-ID"); got != "client-trace-1" {
+			t.Errorf("stream=%t: response X-Request-ID = %q, want client-trace-1", stream, got)
+		}
+		if sent := upstream.last(t).header.Get("X-Request-ID"); sent != "client-trace-1" {
+			t.Errorf("stream=%t: upstream X-Request-ID = %q, want client-trace-1", stream, sent)
+		}
+	}
+}
+
+func TestAliasHeaders(t *testing.T) {
+	loadConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    api_key: "sk-configured"
+    headers:
+      OpenAI-Organization: "org-123"
+      X-Route: "alias-wins"
+      User-Agent: "custom-agent/1.0"
+    remove_headers: ["X-Internal-Trace", "cookie"]
+`)
+	for _, stream := range []bool{false, true} {
+		var upstream *stubUpstream
+		if stream {
+			upstream = newStubUpstream(replySSE(textChunk("m", "ok"), finishChunk("m", "stop"), "[DONE]"))
+		} else {
+			upstream = newStubUpstream(replyJSON(200, completion("m", "ok", "stop")))
+		}
+		engine := testEngine(newTestUseCase(t, upstream))
+
+		resp := serve(engine, "POST", "/a/v1/messages", fmt.Sprintf(`{"model":"m","max_tokens":16,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream),
+			"X-Route", "client-value", "X-Internal-Trace", "secret-span", "Cookie", "session=1", "X-Kept", "yes")
+		if resp.Code != 200 {
+			t.Fatalf("stream=%t: status %d: %s", stream, resp.Code, resp.Body)
+		}
+		header := upstream.last(t).header
+		for name, want := range map[string]string{
+			"OpenAI-Organization": "org-123",
+			"X-Route":             "alias-wins",
+			"User-Agent":          "custom-agent/1.0",
+			"X-Kept":              "yes",
+			"Authorization":       "Bearer sk-configured",
+			"X-Internal-Trace":    "",
+			"Cookie":              "",
+		} {
+			if got := header.Get(name); got != want {
+				t.Errorf("stream=%t: upstream %s = %q, want %q", stream, name, got, want)
+			}
+		}
+	}
+}
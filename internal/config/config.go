@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,19 +18,196 @@ type AliasConfig struct {
 	AuthHeader   string `yaml:"auth_header"`
 	AuthPrefix   string `yaml:"auth_prefix"`
 	DefaultModel string `yaml:"default_model"`
+	// APIKeys rotates several keys round-robin across requests and takes
+	// precedence over APIKey.
+	APIKeys []string `yaml:"api_keys"`
+	// FallbackBaseURL receives requests again when BaseURL fails with a
+	// connection error or 5xx. Streams only fail over before any output.
+	FallbackBaseURL string `yaml:"fallback_base_url"`
+	// EchoRequestModel reports the client-requested model in converted
+	// responses instead of the model name returned by the upstream.
+	EchoRequestModel bool `yaml:"echo_request_model"`
+	// MaxMessages caps the number of non-system messages per request.
+	// MaxMessagesMode is "reject" (default) or "window".
+	MaxMessages     int    `yaml:"max_messages"`
+	MaxMessagesMode string `yaml:"max_messages_mode"`
+	// DisableFileInputs rejects Anthropic document blocks for upstreams
+	// that do not accept OpenAI file content parts.
+	DisableFileInputs bool `yaml:"disable_file_inputs"`
+	// MaxStreamParseErrors terminates a converted stream after this many
+	// consecutive unparseable upstream chunks (0 = never).
+	MaxStreamParseErrors int `yaml:"max_stream_parse_errors"`
+	// StreamLogprobs passes upstream logprobs through on converted stream deltas.
+	StreamLogprobs bool `yaml:"stream_logprobs"`
+	// Timeout is the number of seconds a non-streaming upstream request may
+	// take, defaulting to 60. Streaming requests are not bounded by it.
+	Timeout int `yaml:"timeout"`
+	// AuxTimeout is the number of seconds auxiliary upstream requests such
+	// as /v1/models lookups may take, defaulting to 10.
+	AuxTimeout int `yaml:"aux_timeout"`
+	// StreamHeaderTimeout is the number of seconds a streaming request
+	// waits for upstream response headers before failing with 504.
+	StreamHeaderTimeout int `yaml:"stream_header_timeout"`
+	// StreamIdleTimeout is the number of seconds a converted Anthropic
+	// stream may go without upstream data before it ends with an error event.
+	StreamIdleTimeout int `yaml:"stream_idle_timeout"`
+	// ForwardEmptyTools sends an explicit empty tools list with
+	// tool_choice "none" when the client sends tools: [].
+	ForwardEmptyTools bool `yaml:"forward_empty_tools"`
+	// RescaleTemperature doubles Anthropic temperatures (0-1) into the
+	// OpenAI range (0-2).
+	RescaleTemperature bool `yaml:"rescale_temperature"`
+	// UserAgent replaces the client's User-Agent on upstream requests.
+	UserAgent string `yaml:"user_agent"`
+	// ForceStream and ForceNonStream pin the upstream to one mode; the
+	// proxy buffers or synthesizes streams to match the client's request.
+	ForceStream    bool `yaml:"force_stream"`
+	ForceNonStream bool `yaml:"force_non_stream"`
+	// MaxStreamOutputTokens terminates converted streams once the emitted
+	// output reaches this many estimated tokens (0 = unlimited).
+	MaxStreamOutputTokens int `yaml:"max_stream_output_tokens"`
+	// TextJoinSeparator joins the text blocks of a single Anthropic message
+	// (defaults to "\n").
+	TextJoinSeparator string `yaml:"text_join_separator"`
+	// DropConvertedQuery stops forwarding the client's query string on
+	// converted endpoints (/v1/messages, /v1/responses).
+	DropConvertedQuery bool `yaml:"drop_converted_query"`
+	// StreamCoalesceMS merges text deltas arriving within this many
+	// milliseconds into one converted event (0 = disabled).
+	StreamCoalesceMS int `yaml:"stream_coalesce_ms"`
+	// FallbackResponse is returned as a normal assistant completion when
+	// the upstream fails with a transport error or 5xx. Empty disables it.
+	FallbackResponse string `yaml:"fallback_response"`
+	// LogLevel controls upstream response logging for this alias:
+	// "off", "error", "info" (no bodies) or "debug" (with bodies when
+	// defaults.log_bodies is on).
+	LogLevel string `yaml:"log_level"`
+	// EmptyToolNamePlaceholder names upstream tool calls that have arguments
+	// but no function name; when empty such calls are dropped.
+	EmptyToolNamePlaceholder string `yaml:"empty_tool_name_placeholder"`
+	// ModelMap translates requested model names to upstream model ids.
+	// Unmapped models are forwarded unchanged.
+	ModelMap map[string]string `yaml:"model_map"`
+	// MaxToolRounds logs a warning when a conversation history contains
+	// more tool call rounds than this. Requests are still forwarded.
+	MaxToolRounds int `yaml:"max_tool_rounds"`
+	// ReasoningField names the upstream field that receives Anthropic
+	// thinking directives: "reasoning_effort" (default) sends an effort
+	// string, "reasoning" an {"effort": ...} object, and any other name the
+	// original thinking object unchanged.
+	ReasoningField string `yaml:"reasoning_field"`
+	// MaxConcurrent caps in-flight requests to the alias; extra requests
+	// queue until a slot frees up. Zero means unlimited.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// BasePathMode controls how /v1 request paths join a base_url with its
+	// own path: "auto" (default) replaces /v1 when base_url ends in a
+	// version segment like /v1 or /api/v3, "replace" always replaces it and
+	// "append" never does.
+	BasePathMode string `yaml:"base_path_mode"`
+	// MissingToolCallID decides what happens to Responses input tool
+	// messages without tool_call_id: "attach" (default) fills in the most
+	// recent assistant tool call id, "reject" fails the request with 400.
+	MissingToolCallID string `yaml:"missing_tool_call_id"`
+	// DebugHeaders adds X-Converted-Model and X-Converted-Tools-Count to
+	// converted responses so clients can see what was sent upstream.
+	DebugHeaders bool `yaml:"debug_headers"`
+	// AllowedModels restricts the models clients may request (case-sensitive,
+	// "*" allows any). An empty list allows every model.
+	AllowedModels []string `yaml:"allowed_models"`
+	// ToolErrorMode marks Anthropic tool_result blocks with is_error:
+	// "prefix" (default) prepends "Error: ", "json" wraps the content.
+	ToolErrorMode string `yaml:"tool_error_mode"`
+	// StructuredSystem forwards an array-form Anthropic system prompt as an
+	// OpenAI content array instead of a newline-joined string.
+	StructuredSystem bool `yaml:"structured_system"`
+	// StripNulls drops null-valued optional fields from outbound requests
+	// for upstreams that reject them.
+	StripNulls bool `yaml:"strip_nulls"`
+	// MisplacedToolResults handles tool_result blocks sent in Anthropic
+	// assistant messages: "relocate" (default) moves them next to the
+	// matching tool calls, "reject" fails the request with 400.
+	MisplacedToolResults string `yaml:"misplaced_tool_results"`
+	// RetryBodyPatterns retries non-streaming requests whose upstream error
+	// body contains one of these substrings (case-insensitive). A 2xx body
+	// is only matched when it is an error payload without choices.
+	RetryBodyPatterns []string `yaml:"retry_body_patterns"`
+	// RetryMaxAttempts bounds body-pattern retries (default 2)
+	RetryMaxAttempts int `yaml:"retry_max_attempts"`
+	// TopPMode handles Anthropic top_p values outside 0-1: "reject"
+	// (default) fails the request with 400, "clamp" clamps them.
+	TopPMode string `yaml:"top_p_mode"`
+	// RedactPII replaces email addresses and phone numbers in outbound
+	// message text with [REDACTED]; RedactPatterns adds custom regular
+	// expressions and enables redaction on its own.
+	RedactPII      bool     `yaml:"redact_pii"`
+	RedactPatterns []string `yaml:"redact_patterns"`
+	// StoreResponses keeps completed /v1/responses results in memory for
+	// ResponseStoreTTL seconds (default 3600) unless the request sets
+	// store: false.
+	StoreResponses   bool `yaml:"store_responses"`
+	ResponseStoreTTL int  `yaml:"response_store_ttl"`
+	// Headers are added to every upstream request and win over client
+	// and auth headers of the same name, except Accept-Encoding, which the
+	// proxy negotiates itself. RemoveHeaders strips the named client
+	// headers before forwarding.
+	Headers       map[string]string `yaml:"headers"`
+	RemoveHeaders []string          `yaml:"remove_headers"`
+	// Provider "azure" targets Azure OpenAI: base_url is the resource
+	// endpoint, requests go to /openai/deployments/{deployment} with
+	// APIVersion and the key is sent in the api-key header. Deployment
+	// defaults to the mapped request model.
+	Provider   string `yaml:"provider"`
+	APIVersion string `yaml:"api_version"`
+	Deployment string `yaml:"deployment"`
 }
 
 type Config struct {
 	Aliases  map[string]AliasConfig `yaml:"aliases"`
 	Defaults struct {
-		Port  string `yaml:"port"`
-		Alias string `yaml:"alias"`
+		Port         string `yaml:"port"`
+		Alias        string `yaml:"alias"`
+		DefaultModel string `yaml:"default_model"`
+		// Warmup preconnects to every alias's upstream at startup.
+		Warmup bool `yaml:"warmup"`
+		// StreamIdleConnTimeout is the number of seconds a pooled streaming
+		// connection may stay idle before it is closed (default 90).
+		StreamIdleConnTimeout int `yaml:"stream_idle_conn_timeout"`
+		// AdminToken enables the /admin endpoints for callers presenting it.
+		// The ADMIN_TOKEN environment variable overrides it.
+		AdminToken string `yaml:"admin_token"`
+		// MaxHeaderCount and MaxHeaderBytes bound the number of incoming
+		// header values and their total size (names plus values); larger
+		// requests are rejected with 431. Zero uses the defaults of 100
+		// headers and 32 KiB.
+		MaxHeaderCount int `yaml:"max_header_count"`
+		MaxHeaderBytes int `yaml:"max_header_bytes"`
+		// LogBodies includes upstream bodies, with credentials masked, in
+		// logs at the "error" and "debug" levels. Off by default; the
+		// LOG_BODIES environment variable overrides it.
+		LogBodies bool `yaml:"log_bodies"`
+		// LogPrettyJSON indents logged outbound request bodies for
+		// debugging; compact by default.
+		LogPrettyJSON bool `yaml:"log_pretty_json"`
+		// Cassette records upstream interactions to Dir ("record") or
+		// serves them from Dir without an upstream ("replay"). The
+		// CASSETTE_MODE and CASSETTE_DIR environment variables override it.
+		Cassette struct {
+			Mode string `yaml:"mode"`
+			Dir  string `yaml:"dir"`
+		} `yaml:"cassette"`
 	} `yaml:"defaults"`
+	// Generation increases every time a config is loaded, so logs can tell
+	// which config served a request.
+	Generation uint64 `yaml:"-"`
 }
 
+// cfg is replaced, never mutated, on reload; mu guards the pointer so
+// readers always see a complete config.
 var (
-	cfg  *Config
-	once sync.Once
+	cfg        *Config
+	mu         sync.RWMutex
+	once       sync.Once
+	generation atomic.Uint64
 )
 
 func Load(path string) (*Config, error) {
@@ -36,10 +216,18 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("read config: %w", err)
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	expandEnvNodes(&doc)
+
+	var config Config
+	if len(doc.Content) > 0 {
+		if err := doc.Decode(&config); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
 
 	// Apply defaults
 	if config.Aliases == nil {
@@ -49,7 +237,16 @@ func Load(path string) (*Config, error) {
 		config.Defaults.Port = "8080"
 	}
 
+	applyEnvOverrides(&config)
+
 	for name, alias := range config.Aliases {
+		if strings.EqualFold(alias.Provider, "azure") {
+			if alias.AuthHeader == "" {
+				alias.AuthHeader = "api-key"
+				config.Aliases[name] = alias
+			}
+			continue
+		}
 		if alias.AuthHeader == "" {
 			alias.AuthHeader = "Authorization"
 			config.Aliases[name] = alias
@@ -60,27 +257,61 @@ func Load(path string) (*Config, error) {
 		}
 	}
 
+	mu.Lock()
+	config.Generation = generation.Add(1)
 	cfg = &config
+	mu.Unlock()
 	return &config, nil
 }
 
 func Get() *Config {
-	if cfg != nil {
-		return cfg
+	if current := current(); current != nil {
+		return current
 	}
 	once.Do(func() {
-		var err error
-		cfgPath := Path()
-		cfg, err = Load(cfgPath)
-		if err != nil {
-			cfg = &Config{
+		if _, err := Load(Path()); err != nil {
+			fallback := &Config{
 				Aliases: make(map[string]AliasConfig),
 			}
+			applyEnvOverrides(fallback)
+			mu.Lock()
+			if cfg == nil {
+				fallback.Generation = generation.Add(1)
+				cfg = fallback
+			}
+			mu.Unlock()
 		}
 	})
+	return current()
+}
+
+func current() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
 	return cfg
 }
 
+// applyEnvOverrides lets environment variables override config settings
+func applyEnvOverrides(config *Config) {
+	if mode := os.Getenv("CASSETTE_MODE"); mode != "" {
+		config.Defaults.Cassette.Mode = mode
+	}
+	if dir := os.Getenv("CASSETTE_DIR"); dir != "" {
+		config.Defaults.Cassette.Dir = dir
+	}
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		config.Defaults.AdminToken = token
+	}
+	if logBodies, err := strconv.ParseBool(os.Getenv("LOG_BODIES")); err == nil {
+		config.Defaults.LogBodies = logBodies
+	}
+}
+
+// CurrentGeneration returns the generation of the active config
+func CurrentGeneration() uint64 {
+	return Get().Generation
+}
+
 func Reload(path string) (*Config, error) {
 	return Load(path)
 }
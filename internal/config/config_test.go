@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes yaml to a temporary config file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestGenerationIncrementsOnReload(t *testing.T) {
+	path := writeConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	first, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if CurrentGeneration() != first.Generation {
+		t.Errorf("CurrentGeneration = %d, want %d", CurrentGeneration(), first.Generation)
+	}
+	second, err := Reload(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if second.Generation != first.Generation+1 || CurrentGeneration() != second.Generation {
+		t.Errorf("generations = %d then %d (current %d), want consecutive", first.Generation, second.Generation, CurrentGeneration())
+	}
+
+	// A failed reload keeps the active config and its generation
+	if err := os.WriteFile(path, []byte("aliases: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reload(path); err == nil {
+		t.Fatal("reload of invalid YAML succeeded")
+	}
+	if CurrentGeneration() != second.Generation {
+		t.Errorf("generation after failed reload = %d, want %d", CurrentGeneration(), second.Generation)
+	}
+}
+
+func TestConcurrentReloadAndGet(t *testing.T) {
+	path := writeConfig(t, `
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	if _, err := Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if _, err := Reload(path); err != nil {
+				t.Errorf("reload: %v", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if Get() == nil || !IsValidAlias("a") || GetAliasConfig("a") == nil || CurrentGeneration() == 0 {
+			t.Fatal("alias a missing while reloading")
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("API_CONVER_TEST_KEY", "sk-from-env")
+	t.Setenv("API_CONVER_TEST_EMPTY", "")
+	for _, tc := range []struct{ value, want string }{
+		{"${API_CONVER_TEST_KEY}", "sk-from-env"},
+		{"Bearer ${API_CONVER_TEST_KEY}!", "Bearer sk-from-env!"},
+		{"${API_CONVER_TEST_UNSET}", ""},
+		{"${API_CONVER_TEST_UNSET:-http://localhost:8080/v1}", "http://localhost:8080/v1"},
+		{"${API_CONVER_TEST_EMPTY:-fallback}", "fallback"},
+		{"${API_CONVER_TEST_KEY:-unused}", "sk-from-env"},
+		{"sk-literal", "sk-literal"},
+		{"pa$$word", "pa$$word"},
+		{"$API_CONVER_TEST_KEY", "$API_CONVER_TEST_KEY"},
+	} {
+		if got := ExpandEnv(tc.value); got != tc.want {
+			t.Errorf("ExpandEnv(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestLoadExpandsEnv(t *testing.T) {
+	t.Setenv("API_CONVER_TEST_KEY", "sk-from-env")
+	t.Setenv("API_CONVER_TEST_TIMEOUT", "42")
+	path := writeConfig(t, `
+aliases:
+  a:
+    base_url: "${API_CONVER_TEST_BASE:-http://upstream.test/v1}"
+    api_key: ${API_CONVER_TEST_KEY}
+    api_keys: ["${API_CONVER_TEST_KEY}", "sk-literal"]
+    auth_header: "${API_CONVER_TEST_UNSET}"
+    timeout: ${API_CONVER_TEST_TIMEOUT}
+`)
+	if _, err := Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	alias := GetAliasConfig("a")
+	if alias == nil {
+		t.Fatal("alias a missing")
+	}
+	if alias.BaseURL != "http://upstream.test/v1" {
+		t.Errorf("base_url = %q, want the default", alias.BaseURL)
+	}
+	if alias.APIKey != "sk-from-env" {
+		t.Errorf("api_key = %q, want the variable", alias.APIKey)
+	}
+	if len(alias.APIKeys) != 2 || alias.APIKeys[0] != "sk-from-env" || alias.APIKeys[1] != "sk-literal" {
+		t.Errorf("api_keys = %q", alias.APIKeys)
+	}
+	// An unset variable expands to empty, which then takes the default
+	if alias.AuthHeader != "Authorization" {
+		t.Errorf("auth_header = %q, want the default", alias.AuthHeader)
+	}
+	if alias.Timeout != 42 {
+		t.Errorf("timeout = %d, want 42", alias.Timeout)
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envRef matches ${VAR} and ${VAR:-default}
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// ExpandEnv replaces ${VAR} and ${VAR:-default} references in value with
+// the process environment. An unset or empty variable expands to its
+// default, or to nothing. Other text, including a bare $, is kept as is.
+func ExpandEnv(value string) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+	return envRef.ReplaceAllStringFunc(value, func(ref string) string {
+		match := envRef.FindStringSubmatch(ref)
+		if v := os.Getenv(match[1]); v != "" {
+			return v
+		}
+		return match[2]
+	})
+}
+
+// expandEnvNodes expands environment references in every scalar of a
+// parsed YAML document, so any string setting can come from the
+// environment. Plain scalars are re-resolved afterwards, letting numeric
+// and boolean settings use references too.
+func expandEnvNodes(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		expanded := ExpandEnv(node.Value)
+		if expanded != node.Value {
+			node.Value = expanded
+			if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				node.Tag = ""
+			}
+		}
+		return
+	}
+	for _, child := range node.Content {
+		expandEnvNodes(child)
+	}
+}
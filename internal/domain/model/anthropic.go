@@ -1,5 +1,7 @@
 package model
 
+import "encoding/json"
+
 // Anthropic Models
 
 type AnthropicMessage struct {
@@ -8,10 +10,12 @@ type AnthropicMessage struct {
 }
 
 type AnthropicToolDefinition struct {
-	Name        string      `json:"name"`
-	Description string      `json:"description,omitempty"`
-	InputSchema interface{} `json:"input_schema,omitempty"`
-	Type        string      `json:"type,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// InputSchema is kept raw so $ref, $defs and key order reach the
+	// upstream exactly as the client sent them.
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+	Type        string          `json:"type,omitempty"`
 }
 
 type AnthropicRequest struct {
@@ -26,26 +30,49 @@ type AnthropicRequest struct {
 	Tools         []AnthropicToolDefinition `json:"tools"`
 	ToolChoice    interface{}               `json:"tool_choice"`
 	StopSequences []string                  `json:"stop_sequences"`
+	Thinking      interface{}               `json:"thinking,omitempty"`
 }
 
 type AnthropicContentBlock struct {
-	Type  string      `json:"type"`
-	Text  string      `json:"text,omitempty"`
-	ID    string      `json:"id,omitempty"`
-	Name  string      `json:"name,omitempty"`
-	Input interface{} `json:"input,omitempty"`
+	Type     string      `json:"type"`
+	Text     string      `json:"text,omitempty"`
+	Thinking string      `json:"thinking,omitempty"`
+	Source   interface{} `json:"source,omitempty"`
+	ID       string      `json:"id,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Input    interface{} `json:"input,omitempty"`
 }
 
 type AnthropicResponse struct {
-	ID           string                  `json:"id"`
-	Type         string                  `json:"type"`
-	Role         string                  `json:"role"`
-	Model        string                  `json:"model"`
-	Content      []AnthropicContentBlock `json:"content"`
-	StopReason   string                  `json:"stop_reason,omitempty"`
-	StopSequence string                  `json:"stop_sequence,omitempty"`
-	Usage        struct {
+	ID                string                  `json:"id"`
+	Type              string                  `json:"type"`
+	Role              string                  `json:"role"`
+	Model             string                  `json:"model"`
+	Content           []AnthropicContentBlock `json:"content"`
+	StopReason        string                  `json:"stop_reason,omitempty"`
+	StopSequence      string                  `json:"stop_sequence,omitempty"`
+	SystemFingerprint string                  `json:"system_fingerprint,omitempty"`
+	Usage             struct {
 		InputTokens  int `json:"input_tokens"`
 		OutputTokens int `json:"output_tokens"`
+		// TotalTokens is an extension field copied from the OpenAI usage;
+		// Anthropic itself does not report a total.
+		TotalTokens int `json:"total_tokens,omitempty"`
 	} `json:"usage"`
+	// PromptFilterResults and ContentFilterResults are extension fields
+	// carrying Azure OpenAI content filtering verdicts.
+	PromptFilterResults  interface{} `json:"prompt_filter_results,omitempty"`
+	ContentFilterResults interface{} `json:"content_filter_results,omitempty"`
+}
+
+type AnthropicErrorDetail struct {
+	Type    string      `json:"type"`
+	Message string      `json:"message"`
+	Code    interface{} `json:"code,omitempty"`
+	Param   interface{} `json:"param,omitempty"`
+}
+
+type AnthropicErrorResponse struct {
+	Type  string               `json:"type"`
+	Error AnthropicErrorDetail `json:"error"`
 }
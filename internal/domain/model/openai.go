@@ -14,10 +14,11 @@ type OpenAIToolCall struct {
 }
 
 type OpenAIMessage struct {
-	Role         string              `json:"role"`
-	Content      interface{}         `json:"content"`
-	ToolCalls    []OpenAIToolCall    `json:"tool_calls,omitempty"`
-	FunctionCall *OpenAIFunctionCall `json:"function_call,omitempty"`
+	Role             string              `json:"role"`
+	Content          interface{}         `json:"content"`
+	ReasoningContent string              `json:"reasoning_content,omitempty"`
+	ToolCalls        []OpenAIToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall     *OpenAIFunctionCall `json:"function_call,omitempty"`
 }
 
 type OpenAIUsage struct {
@@ -27,30 +28,47 @@ type OpenAIUsage struct {
 }
 
 type OpenAIResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index        int            `json:"index"`
-		Message      *OpenAIMessage `json:"message"`
-		FinishReason string         `json:"finish_reason"`
-	} `json:"choices"`
-	Usage OpenAIUsage `json:"usage"`
+	ID                string         `json:"id"`
+	Object            string         `json:"object"`
+	Created           int64          `json:"created"`
+	Model             string         `json:"model"`
+	SystemFingerprint string         `json:"system_fingerprint,omitempty"`
+	Choices           []OpenAIChoice `json:"choices"`
+	Usage             OpenAIUsage    `json:"usage"`
+	// PromptFilterResults is Azure OpenAI's content filtering verdict on
+	// the prompt.
+	PromptFilterResults interface{} `json:"prompt_filter_results,omitempty"`
+}
+
+type OpenAIChoice struct {
+	Index        int            `json:"index"`
+	Message      *OpenAIMessage `json:"message"`
+	FinishReason string         `json:"finish_reason"`
+	// StopReason is the matched stop string (or stop token id) reported
+	// by vLLM-style upstreams alongside finish_reason "stop".
+	StopReason interface{} `json:"stop_reason,omitempty"`
+	// ContentFilterResults is Azure OpenAI's filtering verdict on the
+	// completion.
+	ContentFilterResults interface{} `json:"content_filter_results,omitempty"`
 }
 
 type OpenAIStreamResponse struct {
-	ID      string       `json:"id"`
-	Object  string       `json:"object"`
-	Created int64        `json:"created"`
-	Model   string       `json:"model"`
-	Usage   *OpenAIUsage `json:"usage,omitempty"`
-	Choices []struct {
+	ID                string       `json:"id"`
+	Object            string       `json:"object"`
+	Created           int64        `json:"created"`
+	Model             string       `json:"model"`
+	SystemFingerprint string       `json:"system_fingerprint,omitempty"`
+	Usage             *OpenAIUsage `json:"usage,omitempty"`
+	// PromptFilterResults arrives on an early Azure OpenAI chunk
+	PromptFilterResults interface{} `json:"prompt_filter_results,omitempty"`
+	Choices             []struct {
 		Index int `json:"index"`
 		Delta struct {
-			Role      string `json:"role"`
-			Content   string `json:"content"`
-			ToolCalls []struct {
+			Role string `json:"role"`
+			// Content is usually a string but may be an array of parts.
+			Content          interface{} `json:"content"`
+			ReasoningContent string      `json:"reasoning_content"`
+			ToolCalls        []struct {
 				Index    int    `json:"index"`
 				ID       string `json:"id"`
 				Type     string `json:"type"`
@@ -60,6 +78,20 @@ type OpenAIStreamResponse struct {
 				} `json:"function"`
 			} `json:"tool_calls"`
 		} `json:"delta"`
-		FinishReason *string `json:"finish_reason"`
+		Logprobs             interface{} `json:"logprobs,omitempty"`
+		FinishReason         *string     `json:"finish_reason"`
+		StopReason           interface{} `json:"stop_reason,omitempty"`
+		ContentFilterResults interface{} `json:"content_filter_results,omitempty"`
 	} `json:"choices"`
 }
+
+type OpenAIError struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    interface{} `json:"code"`
+}
+
+type OpenAIErrorResponse struct {
+	Error *OpenAIError `json:"error"`
+}
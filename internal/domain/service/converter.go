@@ -2,26 +2,129 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"api-conver/internal/domain/model"
 )
 
 // Converter handles protocol conversion between Anthropic and OpenAI
-type Converter struct{}
+type Converter struct {
+	opts ConverterOptions
+	// toolNames holds the tool name sanitization of the request being
+	// converted, so a Converter serves a single request.
+	toolNames toolNameMap
+}
+
+// ConverterOptions tunes conversion for a particular upstream
+type ConverterOptions struct {
+	// DisableFileInputs rejects Anthropic document blocks instead of
+	// converting them to OpenAI file content parts.
+	DisableFileInputs bool
+	// RescaleTemperature maps Anthropic's 0-1 temperature range onto
+	// OpenAI's 0-2 range.
+	RescaleTemperature bool
+	// TextJoinSeparator joins multiple text blocks of one message.
+	// Defaults to a single newline.
+	TextJoinSeparator string
+	// EmptyToolNamePlaceholder names OpenAI tool calls that arrive with
+	// arguments but no function name. Empty drops such calls instead.
+	EmptyToolNamePlaceholder string
+	// ToolErrorMode marks tool_result blocks flagged is_error: "prefix"
+	// (default) prepends ToolErrorPrefix to the content, "json" wraps it
+	// as {"is_error":true,"content":...}.
+	ToolErrorMode string
+	// StructuredSystem sends an array-form system prompt as an OpenAI
+	// content array of text parts instead of one newline-joined string.
+	StructuredSystem bool
+	// RejectMisplacedToolResults fails assistant messages carrying
+	// tool_result blocks instead of relocating the results.
+	RejectMisplacedToolResults bool
+	// ClampTopP clamps out-of-range top_p values into 0-1 instead of
+	// rejecting the request.
+	ClampTopP bool
+}
+
+// Tool error modes for ConverterOptions.ToolErrorMode
+const (
+	ToolErrorModePrefix = "prefix"
+	ToolErrorModeJSON   = "json"
+)
+
+// ToolErrorPrefix marks failed tool results in "prefix" mode
+const ToolErrorPrefix = "Error: "
+
+// defaultToolSchema is sent as the parameters of tools without input_schema
+const defaultToolSchema = `{"type":"object","properties":{}}`
+
+// ErrUnsupportedContent is returned when a content block cannot be converted
+// for the configured upstream.
+var ErrUnsupportedContent = errors.New("unsupported content")
 
 func NewConverter() *Converter {
 	return &Converter{}
 }
 
+// NewConverterWithOptions creates a converter with upstream-specific options
+func NewConverterWithOptions(opts ConverterOptions) *Converter {
+	return &Converter{opts: opts}
+}
+
+// anthropicContent is the parsed form of a single Anthropic message content
+type anthropicContent struct {
+	textParts []string
+	parts     []map[string]interface{}
+	hasMedia  bool
+	// splitByTools is set when text follows a tool_use block, so the
+	// segments before and after the call are kept as distinct parts.
+	splitByTools bool
+	toolCalls    []map[string]interface{}
+	toolResults  []map[string]interface{}
+	err          error
+}
+
+func (p *anthropicContent) addText(text string) {
+	if len(p.toolCalls) > 0 {
+		p.splitByTools = true
+	}
+	p.textParts = append(p.textParts, text)
+	p.parts = append(p.parts, map[string]interface{}{
+		"type": "text",
+		"text": text,
+	})
+}
+
+func (p *anthropicContent) addMedia(part map[string]interface{}) {
+	p.parts = append(p.parts, part)
+	p.hasMedia = true
+}
+
+// content returns the OpenAI message content: a joined string for text-only
+// messages, or an ordered array of content parts when media is present or
+// text is interleaved with tool calls.
+func (p *anthropicContent) content(separator string) interface{} {
+	if p.hasMedia || p.splitByTools {
+		return p.parts
+	}
+	return strings.Join(p.textParts, separator)
+}
+
+func (c *Converter) textSeparator() string {
+	if c.opts.TextJoinSeparator != "" {
+		return c.opts.TextJoinSeparator
+	}
+	return "\n"
+}
+
 // ConvertAnthropicToOpenAIMessages converts Anthropic messages to OpenAI format
 func (c *Converter) ConvertAnthropicToOpenAIMessages(system interface{}, messages []model.AnthropicMessage) ([]map[string]interface{}, error) {
 	openAIMessages := make([]map[string]interface{}, 0, len(messages)+1)
-	sysText := c.FlattenAnthropicText(system)
-	if strings.TrimSpace(sysText) != "" {
+	if sysContent := c.convertSystem(system); sysContent != nil {
 		openAIMessages = append(openAIMessages, map[string]interface{}{
 			"role":    "system",
-			"content": sysText,
+			"content": sysContent,
 		})
 	}
 
@@ -36,29 +139,78 @@ func (c *Converter) ConvertAnthropicToOpenAIMessages(system interface{}, message
 	return openAIMessages, nil
 }
 
+// convertSystem converts an Anthropic system prompt, keeping the order of
+// array-form blocks. Block metadata such as cache_control is dropped since
+// OpenAI has no equivalent. It returns nil when the prompt is empty.
+func (c *Converter) convertSystem(system interface{}) interface{} {
+	system = normalizeSystemBlocks(system)
+	if blocks, ok := system.([]interface{}); ok && c.opts.StructuredSystem {
+		parts := []map[string]interface{}{}
+		for _, text := range c.ExtractTextParts(blocks) {
+			parts = append(parts, map[string]interface{}{
+				"type": "text",
+				"text": text,
+			})
+		}
+		if len(parts) == 0 {
+			return nil
+		}
+		return parts
+	}
+	sysText := c.FlattenAnthropicText(system)
+	if strings.TrimSpace(sysText) == "" {
+		return nil
+	}
+	return sysText
+}
+
+// normalizeSystemBlocks wraps a system prompt given as a single block object
+// into a one-element block array so it is handled exactly like the array form.
+func normalizeSystemBlocks(system interface{}) interface{} {
+	if block, ok := system.(map[string]interface{}); ok {
+		return []interface{}{block}
+	}
+	return system
+}
+
 // ConvertAnthropicMessage converts a single Anthropic message to OpenAI format
 func (c *Converter) ConvertAnthropicMessage(msg model.AnthropicMessage) ([]map[string]interface{}, error) {
-	textParts, toolCalls, toolResults := c.ParseAnthropicContent(msg.Content)
+	parsed := c.parseAnthropicContent(msg.Content)
+	if parsed.err != nil {
+		return nil, parsed.err
+	}
+
+	if msg.Role == "assistant" && len(parsed.toolResults) > 0 && c.opts.RejectMisplacedToolResults {
+		return nil, fmt.Errorf("%w: tool_result blocks must be sent in user messages", ErrUnsupportedContent)
+	}
 
 	messages := []map[string]interface{}{}
-	if len(textParts) > 0 || len(toolCalls) > 0 {
+	// Tool results answer the preceding assistant tool_calls, so OpenAI
+	// requires them immediately after it, ahead of any accompanying text.
+	// Results misplaced in an assistant message follow its own tool_calls,
+	// or move ahead of it when it has none.
+	resultsFirst := len(parsed.toolResults) > 0 && (msg.Role != "assistant" || len(parsed.toolCalls) == 0)
+	if resultsFirst {
+		messages = append(messages, parsed.toolResults...)
+	}
+	if len(parsed.parts) > 0 || len(parsed.toolCalls) > 0 {
 		mainMsg := map[string]interface{}{
 			"role":    msg.Role,
-			"content": strings.Join(textParts, "\n"),
+			"content": parsed.content(c.textSeparator()),
 		}
-		if len(toolCalls) > 0 {
-			mainMsg["tool_calls"] = toolCalls
+		if len(parsed.toolCalls) > 0 {
+			mainMsg["tool_calls"] = parsed.toolCalls
 		}
 		messages = append(messages, mainMsg)
-	} else if len(toolResults) == 0 {
+	} else if len(parsed.toolResults) == 0 {
 		messages = append(messages, map[string]interface{}{
 			"role":    msg.Role,
 			"content": "",
 		})
 	}
 
-	if len(toolResults) > 0 {
-		messages = append(messages, toolResults...)
+	if len(parsed.toolResults) > 0 && !resultsFirst {
+		messages = append(messages, parsed.toolResults...)
 	}
 
 	return messages, nil
@@ -66,44 +218,54 @@ func (c *Converter) ConvertAnthropicMessage(msg model.AnthropicMessage) ([]map[s
 
 // ParseAnthropicContent parses Anthropic content into text, tool calls, and tool results
 func (c *Converter) ParseAnthropicContent(content interface{}) ([]string, []map[string]interface{}, []map[string]interface{}) {
-	textParts := []string{}
-	toolCalls := []map[string]interface{}{}
-	toolResults := []map[string]interface{}{}
+	parsed := c.parseAnthropicContent(content)
+	return parsed.textParts, parsed.toolCalls, parsed.toolResults
+}
+
+func (c *Converter) parseAnthropicContent(content interface{}) *anthropicContent {
+	parsed := &anthropicContent{
+		textParts:   []string{},
+		toolCalls:   []map[string]interface{}{},
+		toolResults: []map[string]interface{}{},
+	}
 
 	switch v := content.(type) {
 	case string:
 		if strings.TrimSpace(v) != "" {
-			textParts = append(textParts, v)
+			parsed.addText(v)
 		}
 	case []interface{}:
 		for _, item := range v {
-			block, ok := item.(map[string]interface{})
-			if !ok {
-				continue
+			switch block := item.(type) {
+			case string:
+				if strings.TrimSpace(block) != "" {
+					parsed.addText(block)
+				}
+			case map[string]interface{}:
+				c.parseAnthropicBlock(block, parsed)
 			}
-			c.parseAnthropicBlock(block, &textParts, &toolCalls, &toolResults)
 		}
 	case map[string]interface{}:
-		c.parseAnthropicBlock(v, &textParts, &toolCalls, &toolResults)
+		c.parseAnthropicBlock(v, parsed)
 	case nil:
-		return textParts, toolCalls, toolResults
+		return parsed
 	default:
 		fallback := c.FlattenAnthropicText(v)
 		if strings.TrimSpace(fallback) != "" {
-			textParts = append(textParts, fallback)
+			parsed.addText(fallback)
 		}
 	}
 
-	return textParts, toolCalls, toolResults
+	return parsed
 }
 
-func (c *Converter) parseAnthropicBlock(block map[string]interface{}, textParts *[]string, toolCalls *[]map[string]interface{}, toolResults *[]map[string]interface{}) {
+func (c *Converter) parseAnthropicBlock(block map[string]interface{}, parsed *anthropicContent) {
 	typeVal, _ := block["type"].(string)
 	switch typeVal {
 	case "text":
 		text, _ := block["text"].(string)
 		if strings.TrimSpace(text) != "" {
-			*textParts = append(*textParts, text)
+			parsed.addText(text)
 		}
 	case "tool_use":
 		name, _ := block["name"].(string)
@@ -118,26 +280,117 @@ func (c *Converter) parseAnthropicBlock(block map[string]interface{}, textParts
 				argsBytes = b
 			}
 		}
-		*toolCalls = append(*toolCalls, map[string]interface{}{
+		parsed.toolCalls = append(parsed.toolCalls, map[string]interface{}{
 			"id":   id,
 			"type": "function",
 			"function": map[string]interface{}{
-				"name":      name,
+				"name":      c.outboundToolName(name),
 				"arguments": string(argsBytes),
 			},
 		})
 	case "tool_result":
 		toolUseID, _ := block["tool_use_id"].(string)
-		*toolResults = append(*toolResults, map[string]interface{}{
+		content := c.StringifyToolResult(block["content"])
+		if isError, _ := block["is_error"].(bool); isError {
+			content = c.markToolError(content)
+		}
+		parsed.toolResults = append(parsed.toolResults, map[string]interface{}{
 			"role":         "tool",
 			"tool_call_id": toolUseID,
-			"content":      c.StringifyToolResult(block["content"]),
+			"content":      content,
 		})
+		// OpenAI tool messages carry text only, so images returned by the
+		// tool ride along in the user message that follows the results.
+		if list, ok := block["content"].([]interface{}); ok {
+			for _, item := range list {
+				if image, _ := item.(map[string]interface{}); image != nil && image["type"] == "image" {
+					c.parseImageBlock(image, parsed)
+				}
+			}
+		}
+	case "image":
+		c.parseImageBlock(block, parsed)
+	case "document":
+		c.parseDocumentBlock(block, parsed)
 	default:
 		text, _ := block["text"].(string)
 		if strings.TrimSpace(text) != "" {
-			*textParts = append(*textParts, text)
+			parsed.addText(text)
+		}
+	}
+}
+
+// parseImageBlock converts an Anthropic image block into an OpenAI
+// image_url content part.
+func (c *Converter) parseImageBlock(block map[string]interface{}, parsed *anthropicContent) {
+	source, _ := block["source"].(map[string]interface{})
+	if source == nil {
+		return
+	}
+	url := ""
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "base64":
+		data, _ := source["data"].(string)
+		mediaType, _ := source["media_type"].(string)
+		if strings.TrimSpace(data) == "" || strings.TrimSpace(mediaType) == "" {
+			return
+		}
+		url = "data:" + mediaType + ";base64," + data
+	case "url":
+		url, _ = source["url"].(string)
+		url = strings.TrimSpace(url)
+	}
+	if url == "" {
+		return
+	}
+	parsed.addMedia(map[string]interface{}{
+		"type": "image_url",
+		"image_url": map[string]interface{}{
+			"url": url,
+		},
+	})
+}
+
+// parseDocumentBlock converts an Anthropic document block into an OpenAI
+// file content part. Plain-text documents are inlined as text.
+func (c *Converter) parseDocumentBlock(block map[string]interface{}, parsed *anthropicContent) {
+	source, _ := block["source"].(map[string]interface{})
+	if source == nil {
+		return
+	}
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "text":
+		if text, _ := source["data"].(string); strings.TrimSpace(text) != "" {
+			parsed.addText(text)
+		}
+	case "base64":
+		if c.opts.DisableFileInputs {
+			parsed.err = fmt.Errorf("%w: document blocks are not supported by this upstream", ErrUnsupportedContent)
+			return
+		}
+		data, _ := source["data"].(string)
+		if strings.TrimSpace(data) == "" {
+			return
+		}
+		mediaType, _ := source["media_type"].(string)
+		if strings.TrimSpace(mediaType) == "" {
+			mediaType = "application/pdf"
+		}
+		filename, _ := block["title"].(string)
+		if strings.TrimSpace(filename) == "" {
+			filename = "document.pdf"
 		}
+		parsed.addMedia(map[string]interface{}{
+			"type": "file",
+			"file": map[string]interface{}{
+				"filename":  filename,
+				"file_data": "data:" + mediaType + ";base64," + data,
+			},
+		})
+	default:
+		parsed.err = fmt.Errorf("%w: document source type %q is not supported", ErrUnsupportedContent, sourceType)
 	}
 }
 
@@ -196,6 +449,21 @@ func (c *Converter) ExtractTextParts(v interface{}) []string {
 	}
 }
 
+// markToolError flags the content of a failed tool result so the model can
+// tell it apart from a successful one.
+func (c *Converter) markToolError(content string) string {
+	if strings.EqualFold(strings.TrimSpace(c.opts.ToolErrorMode), ToolErrorModeJSON) {
+		b, err := json.Marshal(map[string]interface{}{
+			"is_error": true,
+			"content":  content,
+		})
+		if err == nil {
+			return string(b)
+		}
+	}
+	return ToolErrorPrefix + content
+}
+
 // StringifyToolResult converts tool result content to string
 func (c *Converter) StringifyToolResult(content interface{}) string {
 	if content == nil {
@@ -204,6 +472,9 @@ func (c *Converter) StringifyToolResult(content interface{}) string {
 	if text, ok := content.(string); ok {
 		return text
 	}
+	if list, ok := content.([]interface{}); ok && isContentBlockList(list) {
+		return strings.Join(c.ExtractTextParts(list), c.textSeparator())
+	}
 	payload, err := json.Marshal(content)
 	if err != nil {
 		return ""
@@ -211,25 +482,51 @@ func (c *Converter) StringifyToolResult(content interface{}) string {
 	return string(payload)
 }
 
-// ConvertAnthropicTools converts Anthropic tools to OpenAI format
+// isContentBlockList reports whether every item is a string or a typed
+// content block, as opposed to arbitrary JSON returned by a tool.
+func isContentBlockList(list []interface{}) bool {
+	for _, item := range list {
+		switch v := item.(type) {
+		case string:
+		case map[string]interface{}:
+			if _, ok := v["type"].(string); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ConvertAnthropicTools converts Anthropic tools to OpenAI format. Names
+// OpenAI would reject are sanitized; OriginalToolName restores them.
 func (c *Converter) ConvertAnthropicTools(tools []model.AnthropicToolDefinition) []map[string]interface{} {
 	if len(tools) == 0 {
 		return nil
 	}
+	names := make([]string, len(tools))
+	for i, tool := range tools {
+		names[i] = strings.TrimSpace(tool.Name)
+	}
+	c.reserveToolNames(names)
 	openAITools := make([]map[string]interface{}, 0, len(tools))
-	for _, tool := range tools {
-		name := strings.TrimSpace(tool.Name)
+	for i, tool := range tools {
+		name := names[i]
 		if name == "" {
 			continue
 		}
 		function := map[string]interface{}{
-			"name": name,
+			"name": c.outboundToolName(name),
 		}
 		if strings.TrimSpace(tool.Description) != "" {
 			function["description"] = tool.Description
 		}
-		if tool.InputSchema != nil {
+		if len(tool.InputSchema) > 0 && string(tool.InputSchema) != "null" {
 			function["parameters"] = tool.InputSchema
+		} else {
+			// Strict upstreams require parameters on every function
+			function["parameters"] = json.RawMessage(defaultToolSchema)
 		}
 		openAITools = append(openAITools, map[string]interface{}{
 			"type":     "function",
@@ -246,24 +543,21 @@ func (c *Converter) ConvertAnthropicTools(tools []model.AnthropicToolDefinition)
 func (c *Converter) ConvertAnthropicToolChoice(choice interface{}) interface{} {
 	switch v := choice.(type) {
 	case string:
-		switch v {
-		case "any":
-			return "required"
-		case "auto":
-			return "auto"
-		default:
-			return v
-		}
+		return convertToolChoiceType(v)
 	case map[string]interface{}:
-		if v["type"] == "tool" {
+		choiceType, _ := v["type"].(string)
+		switch choiceType {
+		case "tool":
 			if name, ok := v["name"].(string); ok && strings.TrimSpace(name) != "" {
 				return map[string]interface{}{
 					"type": "function",
 					"function": map[string]interface{}{
-						"name": name,
+						"name": c.outboundToolName(strings.TrimSpace(name)),
 					},
 				}
 			}
+		case "auto", "any", "none":
+			return convertToolChoiceType(choiceType)
 		}
 		return v
 	default:
@@ -271,6 +565,31 @@ func (c *Converter) ConvertAnthropicToolChoice(choice interface{}) interface{} {
 	}
 }
 
+func convertToolChoiceType(choiceType string) string {
+	switch choiceType {
+	case "any":
+		return "required"
+	case "auto":
+		return "auto"
+	case "none":
+		return "none"
+	default:
+		return choiceType
+	}
+}
+
+// DisableParallelToolUse reports whether an Anthropic tool_choice object
+// sets disable_parallel_tool_use, which OpenAI expresses as the top-level
+// parallel_tool_calls: false.
+func (c *Converter) DisableParallelToolUse(choice interface{}) bool {
+	v, ok := choice.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	disabled, _ := v["disable_parallel_tool_use"].(bool)
+	return disabled
+}
+
 // BuildAnthropicContentBlocks converts OpenAI message to Anthropic content blocks
 func (c *Converter) BuildAnthropicContentBlocks(message *model.OpenAIMessage) []model.AnthropicContentBlock {
 	if message == nil {
@@ -278,14 +597,14 @@ func (c *Converter) BuildAnthropicContentBlocks(message *model.OpenAIMessage) []
 	}
 
 	blocks := []model.AnthropicContentBlock{}
-	text := c.OpenAIContentToString(message.Content)
-	if strings.TrimSpace(text) != "" {
-		blocks = append(blocks, model.AnthropicContentBlock{Type: "text", Text: text})
+	if strings.TrimSpace(message.ReasoningContent) != "" {
+		blocks = append(blocks, model.AnthropicContentBlock{Type: "thinking", Thinking: message.ReasoningContent})
 	}
+	blocks = append(blocks, c.buildAnthropicContentParts(message.Content)...)
 
 	for _, call := range message.ToolCalls {
-		name := strings.TrimSpace(call.Function.Name)
-		if name == "" && strings.TrimSpace(call.Function.Arguments) == "" {
+		name, ok := c.ResolveToolName(call.Function.Name, call.Function.Arguments)
+		if !ok {
 			continue
 		}
 		id := strings.TrimSpace(call.ID)
@@ -301,8 +620,7 @@ func (c *Converter) BuildAnthropicContentBlocks(message *model.OpenAIMessage) []
 	}
 
 	if message.FunctionCall != nil {
-		name := strings.TrimSpace(message.FunctionCall.Name)
-		if name != "" || strings.TrimSpace(message.FunctionCall.Arguments) != "" {
+		if name, ok := c.ResolveToolName(message.FunctionCall.Name, message.FunctionCall.Arguments); ok {
 			blocks = append(blocks, model.AnthropicContentBlock{
 				Type:  "tool_use",
 				ID:    GenerateToolCallID(),
@@ -319,6 +637,101 @@ func (c *Converter) BuildAnthropicContentBlocks(message *model.OpenAIMessage) []
 	return blocks
 }
 
+// buildAnthropicContentParts converts OpenAI assistant content into Anthropic
+// blocks. Array content keeps its order: text parts become text blocks,
+// image_url parts image blocks, and reasoning parts thinking blocks.
+func (c *Converter) buildAnthropicContentParts(content interface{}) []model.AnthropicContentBlock {
+	parts, ok := content.([]interface{})
+	if !ok {
+		text := c.OpenAIContentToString(content)
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return []model.AnthropicContentBlock{{Type: "text", Text: text}}
+	}
+
+	blocks := []model.AnthropicContentBlock{}
+	for _, item := range parts {
+		part, ok := item.(map[string]interface{})
+		if !ok {
+			if text, ok := item.(string); ok && strings.TrimSpace(text) != "" {
+				blocks = append(blocks, model.AnthropicContentBlock{Type: "text", Text: text})
+			}
+			continue
+		}
+		partType, _ := part["type"].(string)
+		switch partType {
+		case "text", "output_text":
+			if text, _ := part["text"].(string); strings.TrimSpace(text) != "" {
+				blocks = append(blocks, model.AnthropicContentBlock{Type: "text", Text: text})
+			}
+		case "refusal":
+			if text, _ := part["refusal"].(string); strings.TrimSpace(text) != "" {
+				blocks = append(blocks, model.AnthropicContentBlock{Type: "text", Text: text})
+			}
+		case "reasoning", "thinking":
+			thinking, _ := part["thinking"].(string)
+			if thinking == "" {
+				thinking, _ = part["text"].(string)
+			}
+			if strings.TrimSpace(thinking) != "" {
+				blocks = append(blocks, model.AnthropicContentBlock{Type: "thinking", Thinking: thinking})
+			}
+		case "image_url":
+			if source := imageURLSource(part["image_url"]); source != nil {
+				blocks = append(blocks, model.AnthropicContentBlock{Type: "image", Source: source})
+			}
+		}
+	}
+	return blocks
+}
+
+// imageURLSource converts an OpenAI image_url value into an Anthropic image
+// source, decoding data URLs into base64 sources.
+func imageURLSource(imageURL interface{}) map[string]interface{} {
+	url, _ := imageURL.(string)
+	if obj, ok := imageURL.(map[string]interface{}); ok {
+		url, _ = obj["url"].(string)
+	}
+	url = strings.TrimSpace(url)
+	if url == "" {
+		return nil
+	}
+	if strings.HasPrefix(url, "data:") {
+		header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+		if !ok || !isBase64 || mediaType == "" || data == "" {
+			return nil
+		}
+		return map[string]interface{}{
+			"type":       "base64",
+			"media_type": mediaType,
+			"data":       data,
+		}
+	}
+	return map[string]interface{}{
+		"type": "url",
+		"url":  url,
+	}
+}
+
+// ResolveToolName returns the Anthropic tool_use name for an OpenAI call and
+// whether the call should be emitted at all. Calls without a name are
+// dropped unless a placeholder name is configured.
+func (c *Converter) ResolveToolName(name, arguments string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name != "" {
+		return c.OriginalToolName(name), true
+	}
+	if strings.TrimSpace(arguments) == "" {
+		return "", false
+	}
+	if c.opts.EmptyToolNamePlaceholder == "" {
+		return "", false
+	}
+	return c.opts.EmptyToolNamePlaceholder, true
+}
+
 // OpenAIContentToString converts OpenAI content to string
 func (c *Converter) OpenAIContentToString(content interface{}) string {
 	if content == nil {
@@ -358,14 +771,136 @@ func (c *Converter) ParseToolCallArgs(args string) interface{} {
 	return payload
 }
 
-// MapStopReason maps OpenAI stop reason to Anthropic format
+// ConvertAnthropicTemperature converts an Anthropic temperature to OpenAI
+func (c *Converter) ConvertAnthropicTemperature(temperature float64) float64 {
+	if !c.opts.RescaleTemperature {
+		return temperature
+	}
+	scaled := temperature * 2
+	if scaled < 0 {
+		return 0
+	}
+	if scaled > 2 {
+		return 2
+	}
+	return scaled
+}
+
+// ConvertAnthropicTopP validates an Anthropic top_p. Both protocols use the
+// 0-1 range, so valid values pass through unchanged; others are clamped or
+// rejected depending on ClampTopP.
+func (c *Converter) ConvertAnthropicTopP(topP float64) (float64, error) {
+	if topP >= 0 && topP <= 1 {
+		return topP, nil
+	}
+	if !c.opts.ClampTopP {
+		return 0, fmt.Errorf("top_p must be between 0 and 1, got %g", topP)
+	}
+	if topP < 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// ConvertAnthropicThinking converts an Anthropic thinking directive into an
+// OpenAI reasoning effort. budget_tokens below 4096 maps to "low", below
+// 16384 to "medium" and anything larger to "high". It reports false when
+// thinking is absent or disabled.
+func (c *Converter) ConvertAnthropicThinking(thinking interface{}) (string, bool) {
+	directive, ok := thinking.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	if kind, _ := directive["type"].(string); kind != "enabled" {
+		return "", false
+	}
+	budget, _ := directive["budget_tokens"].(float64)
+	switch {
+	case budget <= 0:
+		return "medium", true
+	case budget < 4096:
+		return "low", true
+	case budget < 16384:
+		return "medium", true
+	default:
+		return "high", true
+	}
+}
+
+// ConvertOpenAIError converts an upstream error response into Anthropic's
+// error shape, keeping code and param as extra detail. Bodies that are not
+// OpenAI errors become a generic api_error.
+func (c *Converter) ConvertOpenAIError(status int, body []byte) model.AnthropicErrorResponse {
+	var openAIErr model.OpenAIErrorResponse
+	if err := json.Unmarshal(body, &openAIErr); err != nil || openAIErr.Error == nil {
+		message := strings.TrimSpace(string(body))
+		if message == "" || !utf8.ValidString(message) {
+			message = fmt.Sprintf("upstream returned status %d", status)
+		}
+		return model.AnthropicErrorResponse{
+			Type: "error",
+			Error: model.AnthropicErrorDetail{
+				Type:    "api_error",
+				Message: message,
+			},
+		}
+	}
+	return model.AnthropicErrorResponse{
+		Type: "error",
+		Error: model.AnthropicErrorDetail{
+			Type:    c.MapErrorType(openAIErr.Error.Type, status),
+			Message: openAIErr.Error.Message,
+			Code:    openAIErr.Error.Code,
+			Param:   openAIErr.Error.Param,
+		},
+	}
+}
+
+// MapErrorType maps an OpenAI error type to the Anthropic equivalent,
+// falling back to the HTTP status when the type is not recognized.
+func (c *Converter) MapErrorType(errType string, status int) string {
+	switch errType {
+	case "invalid_request_error", "authentication_error", "permission_error", "not_found_error", "rate_limit_error", "overloaded_error":
+		return errType
+	case "insufficient_quota", "requests", "tokens":
+		return "rate_limit_error"
+	}
+	switch {
+	case status == 400 || status == 422:
+		return "invalid_request_error"
+	case status == 401:
+		return "authentication_error"
+	case status == 403:
+		return "permission_error"
+	case status == 404:
+		return "not_found_error"
+	case status == 413:
+		return "request_too_large"
+	case status == 429:
+		return "rate_limit_error"
+	case status == 503 || status == 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// MapStopReason maps OpenAI stop reason to Anthropic format. A tool_calls
+// finish without any emitted tool_use block is reported as end_turn so
+// agent loops do not wait for tool calls that were dropped.
 func (c *Converter) MapStopReason(finish string, hasToolCalls bool) string {
 	switch finish {
 	case "length":
 		return "max_tokens"
 	case "stop":
 		return "end_turn"
+	case "content_filter":
+		// Azure OpenAI stops generation when its content filter triggers
+		return "refusal"
 	case "tool_calls", "function_call":
+		if !hasToolCalls {
+			return "end_turn"
+		}
 		return "tool_use"
 	default:
 		if hasToolCalls {
@@ -374,3 +909,36 @@ func (c *Converter) MapStopReason(finish string, hasToolCalls bool) string {
 		return "end_turn"
 	}
 }
+
+// ResolveStopSequence returns the request stop sequence that ended a
+// completion with finish_reason "stop", or "" when it cannot be told.
+// OpenAI-compatible upstreams cut the stop string out of the output, so the
+// upstream's stop_reason (reported by vLLM and compatible servers) is
+// trusted first; text is only suffix matched for upstreams configured to
+// keep the stop string in the output.
+func (c *Converter) ResolveStopSequence(stopReason interface{}, text string, sequences []string) string {
+	if reported, ok := stopReason.(string); ok && reported != "" {
+		for _, seq := range sequences {
+			if seq == reported {
+				return seq
+			}
+		}
+	}
+	return c.MatchStopSequence(text, sequences)
+}
+
+// MatchStopSequence returns the longest stop sequence that text ends with,
+// or "" when none match. Sequences are compared as literal bytes, so regex
+// metacharacters and multi-byte UTF-8 sequences need no escaping.
+func (c *Converter) MatchStopSequence(text string, sequences []string) string {
+	matched := ""
+	for _, seq := range sequences {
+		if seq == "" || len(seq) <= len(matched) {
+			continue
+		}
+		if strings.HasSuffix(text, seq) {
+			matched = seq
+		}
+	}
+	return matched
+}
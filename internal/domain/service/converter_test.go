@@ -0,0 +1,532 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"api-conver/internal/domain/model"
+)
+
+func TestConvertDocumentBlock(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "Summarize this"},
+		map[string]interface{}{
+			"type":  "document",
+			"title": "report.pdf",
+			"source": map[string]interface{}{
+				"type":       "base64",
+				"media_type": "application/pdf",
+				"data":       "JVBERi0x",
+			},
+		},
+	}}
+
+	converted, err := NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"role": "user",
+		"content": []map[string]interface{}{
+			{"type": "text", "text": "Summarize this"},
+			{"type": "file", "file": map[string]interface{}{
+				"filename":  "report.pdf",
+				"file_data": "data:application/pdf;base64,JVBERi0x",
+			}},
+		},
+	}}
+	if !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted = %#v\nwant %#v", converted, want)
+	}
+}
+
+func TestConvertDocumentBlockUnsupported(t *testing.T) {
+	document := map[string]interface{}{
+		"type":   "document",
+		"source": map[string]interface{}{"type": "base64", "media_type": "application/pdf", "data": "JVBERi0x"},
+	}
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{document}}
+
+	converter := NewConverterWithOptions(ConverterOptions{DisableFileInputs: true})
+	if _, err := converter.ConvertAnthropicMessage(msg); !errors.Is(err, ErrUnsupportedContent) {
+		t.Errorf("disabled file inputs: err = %v, want ErrUnsupportedContent", err)
+	}
+
+	document["source"] = map[string]interface{}{"type": "file", "file_id": "file_123"}
+	if _, err := NewConverter().ConvertAnthropicMessage(msg); !errors.Is(err, ErrUnsupportedContent) {
+		t.Errorf("file source: err = %v, want ErrUnsupportedContent", err)
+	}
+}
+
+func TestConvertAnthropicTemperature(t *testing.T) {
+	for _, tc := range []struct {
+		rescale bool
+		in      float64
+		want    float64
+	}{
+		{rescale: false, in: 0.7, want: 0.7},
+		{rescale: false, in: 1, want: 1},
+		{rescale: true, in: 0, want: 0},
+		{rescale: true, in: 0.25, want: 0.5},
+		{rescale: true, in: 1, want: 2},
+		{rescale: true, in: 1.5, want: 2},
+		{rescale: true, in: -0.5, want: 0},
+	} {
+		converter := NewConverterWithOptions(ConverterOptions{RescaleTemperature: tc.rescale})
+		if got := converter.ConvertAnthropicTemperature(tc.in); got != tc.want {
+			t.Errorf("rescale=%t: ConvertAnthropicTemperature(%g) = %g, want %g", tc.rescale, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestConvertOpenAIError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   model.AnthropicErrorDetail
+	}{
+		{
+			name:   "code and param preserved",
+			status: 400,
+			body:   `{"error":{"message":"bad value","type":"invalid_request_error","param":"messages[0].content","code":"invalid_value"}}`,
+			want:   model.AnthropicErrorDetail{Type: "invalid_request_error", Message: "bad value", Code: "invalid_value", Param: "messages[0].content"},
+		},
+		{
+			name:   "quota type mapped",
+			status: 429,
+			body:   `{"error":{"message":"quota","type":"insufficient_quota","param":null,"code":"insufficient_quota"}}`,
+			want:   model.AnthropicErrorDetail{Type: "rate_limit_error", Message: "quota", Code: "insufficient_quota"},
+		},
+		{
+			name:   "unknown type falls back to status",
+			status: 401,
+			body:   `{"error":{"message":"no key","type":"","code":null}}`,
+			want:   model.AnthropicErrorDetail{Type: "authentication_error", Message: "no key"},
+		},
+		{
+			name:   "non-JSON body",
+			status: 502,
+			body:   `bad gateway`,
+			want:   model.AnthropicErrorDetail{Type: "api_error", Message: "bad gateway"},
+		},
+		{
+			name:   "empty body",
+			status: 503,
+			body:   ``,
+			want:   model.AnthropicErrorDetail{Type: "api_error", Message: "upstream returned status 503"},
+		},
+	} {
+		got := NewConverter().ConvertOpenAIError(tc.status, []byte(tc.body))
+		if got.Type != "error" || !reflect.DeepEqual(got.Error, tc.want) {
+			t.Errorf("%s: ConvertOpenAIError = %#v, want %#v", tc.name, got.Error, tc.want)
+		}
+	}
+}
+
+func TestConvertTextBlocksJoinSeparator(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "first"},
+		map[string]interface{}{"type": "text", "text": "second"},
+		map[string]interface{}{"type": "text", "text": "third"},
+	}}
+	for _, tc := range []struct {
+		separator string
+		want      string
+	}{
+		{separator: "", want: "first\nsecond\nthird"},
+		{separator: "\n\n", want: "first\n\nsecond\n\nthird"},
+		{separator: " | ", want: "first | second | third"},
+	} {
+		converted, err := NewConverterWithOptions(ConverterOptions{TextJoinSeparator: tc.separator}).ConvertAnthropicMessage(msg)
+		if err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		if len(converted) != 1 || converted[0]["content"] != tc.want {
+			t.Errorf("separator %q: converted = %#v, want content %q", tc.separator, converted, tc.want)
+		}
+	}
+}
+
+func TestConvertSingleObjectSystem(t *testing.T) {
+	block := map[string]interface{}{
+		"type":          "text",
+		"text":          "You are terse.",
+		"cache_control": map[string]interface{}{"type": "ephemeral"},
+	}
+	user := []model.AnthropicMessage{{Role: "user", Content: "hi"}}
+	for _, structured := range []bool{false, true} {
+		converter := NewConverterWithOptions(ConverterOptions{StructuredSystem: structured})
+		fromObject, err := converter.ConvertAnthropicToOpenAIMessages(block, user)
+		if err != nil {
+			t.Fatalf("convert object: %v", err)
+		}
+		fromArray, err := converter.ConvertAnthropicToOpenAIMessages([]interface{}{block}, user)
+		if err != nil {
+			t.Fatalf("convert array: %v", err)
+		}
+		if !reflect.DeepEqual(fromObject, fromArray) {
+			t.Errorf("structured=%t: object form %#v differs from array form %#v", structured, fromObject, fromArray)
+		}
+		var want interface{} = "You are terse."
+		if structured {
+			want = []map[string]interface{}{{"type": "text", "text": "You are terse."}}
+		}
+		if system := fromObject[0]; system["role"] != "system" || !reflect.DeepEqual(system["content"], want) {
+			t.Errorf("structured=%t: system = %#v, want content %#v", structured, system, want)
+		}
+	}
+}
+
+func TestConvertBase64ImageBlock(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "What is in this picture?"},
+		map[string]interface{}{
+			"type": "image",
+			"source": map[string]interface{}{
+				"type":       "base64",
+				"media_type": "image/png",
+				"data":       "iVBORw0KGgo=",
+			},
+		},
+		map[string]interface{}{"type": "text", "text": "Answer briefly."},
+	}}
+
+	converted, err := NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"role": "user",
+		"content": []map[string]interface{}{
+			{"type": "text", "text": "What is in this picture?"},
+			{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64,iVBORw0KGgo="}},
+			{"type": "text", "text": "Answer briefly."},
+		},
+	}}
+	if !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted = %#v\nwant %#v", converted, want)
+	}
+}
+
+func TestConvertImageSources(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "url", "url": "https://example.com/cat.jpg"}},
+		map[string]interface{}{"type": "text", "text": "Compare these."},
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/jpeg", "data": "/9j/4AAQ"}},
+		// Missing or malformed sources are skipped
+		map[string]interface{}{"type": "image"},
+		map[string]interface{}{"type": "image", "source": "https://example.com/not-an-object.jpg"},
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "data": "/9j/4AAQ"}},
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "url", "url": "  "}},
+	}}
+
+	converted, err := NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"role": "user",
+		"content": []map[string]interface{}{
+			{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/cat.jpg"}},
+			{"type": "text", "text": "Compare these."},
+			{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/jpeg;base64,/9j/4AAQ"}},
+		},
+	}}
+	if !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted = %#v\nwant %#v", converted, want)
+	}
+}
+
+func TestConvertImageWithoutSourceKeepsTextContent(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "hello"},
+		map[string]interface{}{"type": "image"},
+	}}
+	converted, err := NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(converted) != 1 || converted[0]["content"] != "hello" {
+		t.Errorf("converted = %#v, want plain text content", converted)
+	}
+}
+
+func TestResolveToolName(t *testing.T) {
+	for _, tc := range []struct {
+		placeholder, name, arguments string
+		want                         string
+		ok                           bool
+	}{
+		{name: "lookup", arguments: "{}", want: "lookup", ok: true},
+		{name: "", arguments: "", ok: false},
+		{name: "", arguments: `{"q":1}`, ok: false},
+		{placeholder: "unknown_tool", name: " ", arguments: `{"q":1}`, want: "unknown_tool", ok: true},
+		{placeholder: "unknown_tool", name: "", arguments: "", ok: false},
+	} {
+		converter := NewConverterWithOptions(ConverterOptions{EmptyToolNamePlaceholder: tc.placeholder})
+		got, ok := converter.ResolveToolName(tc.name, tc.arguments)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("placeholder %q: ResolveToolName(%q, %q) = %q, %t, want %q, %t", tc.placeholder, tc.name, tc.arguments, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestResolveStopSequence(t *testing.T) {
+	sequences := []string{"。完", "$.*", "[END]", "\n\nHuman:"}
+	for _, tc := range []struct {
+		name       string
+		stopReason interface{}
+		text       string
+		want       string
+	}{
+		{name: "reported unicode", stopReason: "。完", text: "答案是四", want: "。完"},
+		{name: "reported regex metacharacters", stopReason: "$.*", text: "cost", want: "$.*"},
+		{name: "reported brackets", stopReason: "[END]", text: "done", want: "[END]"},
+		{name: "reported but not requested", stopReason: "STOP", text: "done"},
+		{name: "stop token id", stopReason: float64(151643), text: "done"},
+		{name: "stripped by upstream", text: "plain answer"},
+		{name: "suffix unicode", text: "答案是四。完", want: "。完"},
+		{name: "suffix metacharacters literal", text: "price is $.*", want: "$.*"},
+		{name: "metacharacters not a pattern", text: "price is $12"},
+		{name: "suffix multi-line", text: "Sure.\n\nHuman:", want: "\n\nHuman:"},
+	} {
+		if got := NewConverter().ResolveStopSequence(tc.stopReason, tc.text, sequences); got != tc.want {
+			t.Errorf("%s: ResolveStopSequence = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMatchStopSequencePrefersLongest(t *testing.T) {
+	if got := NewConverter().MatchStopSequence("the end.", []string{".", "end.", ""}); got != "end." {
+		t.Errorf("MatchStopSequence = %q, want end.", got)
+	}
+}
+
+func TestConvertMixedStringAndBlockContent(t *testing.T) {
+	converter := NewConverter()
+	msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+		"hello",
+		map[string]interface{}{"type": "text", "text": "world"},
+		"  ",
+		"again",
+	}}
+	converted, err := converter.ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(converted) != 1 || converted[0]["content"] != "hello\nworld\nagain" {
+		t.Errorf("converted = %#v", converted)
+	}
+
+	text, _, _ := converter.ParseAnthropicContent(msg.Content)
+	if want := converter.ExtractTextParts(msg.Content); !reflect.DeepEqual(text, want) {
+		t.Errorf("ParseAnthropicContent text = %q, ExtractTextParts = %q", text, want)
+	}
+
+	msg.Content = []interface{}{
+		"look at this",
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "url", "url": "https://example.com/cat.png"}},
+	}
+	converted, err = converter.ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	parts, _ := converted[0]["content"].([]map[string]interface{})
+	if len(parts) != 2 || parts[0]["text"] != "look at this" || parts[1]["type"] != "image_url" {
+		t.Errorf("converted = %#v, want the string ahead of the image", converted)
+	}
+}
+
+func TestConvertAssistantKeepsTextAndToolOrder(t *testing.T) {
+	msg := model.AnthropicMessage{Role: "assistant", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "Let me check the weather."},
+		map[string]interface{}{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]interface{}{"city": "Paris"}},
+		map[string]interface{}{"type": "text", "text": "While that runs, note it's spring."},
+	}}
+	converted, err := NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(converted) != 1 {
+		t.Fatalf("converted = %#v, want one assistant message", converted)
+	}
+	wantContent := []map[string]interface{}{
+		{"type": "text", "text": "Let me check the weather."},
+		{"type": "text", "text": "While that runs, note it's spring."},
+	}
+	if !reflect.DeepEqual(converted[0]["content"], wantContent) {
+		t.Errorf("content = %#v, want the text before and after the call as distinct ordered parts", converted[0]["content"])
+	}
+	calls, _ := converted[0]["tool_calls"].([]map[string]interface{})
+	if len(calls) != 1 || calls[0]["id"] != "toolu_1" {
+		t.Errorf("tool_calls = %#v", converted[0]["tool_calls"])
+	}
+
+	msg.Content = []interface{}{
+		map[string]interface{}{"type": "text", "text": "Checking."},
+		map[string]interface{}{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]interface{}{}},
+	}
+	converted, err = NewConverter().ConvertAnthropicMessage(msg)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if converted[0]["content"] != "Checking." {
+		t.Errorf("content = %#v, want plain text when nothing follows the call", converted[0]["content"])
+	}
+}
+
+func TestConvertToolResultIsError(t *testing.T) {
+	result := func(isError interface{}) model.AnthropicMessage {
+		block := map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_1", "content": "city not found"}
+		if isError != nil {
+			block["is_error"] = isError
+		}
+		return model.AnthropicMessage{Role: "user", Content: []interface{}{block}}
+	}
+	for _, tc := range []struct {
+		mode    string
+		isError interface{}
+		want    string
+	}{
+		{mode: "", isError: true, want: "Error: city not found"},
+		{mode: ToolErrorModePrefix, isError: true, want: "Error: city not found"},
+		{mode: ToolErrorModeJSON, isError: true, want: `{"content":"city not found","is_error":true}`},
+		{mode: ToolErrorModeJSON, isError: false, want: "city not found"},
+		{mode: "", want: "city not found"},
+	} {
+		converted, err := NewConverterWithOptions(ConverterOptions{ToolErrorMode: tc.mode}).ConvertAnthropicMessage(result(tc.isError))
+		if err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		want := []map[string]interface{}{{"role": "tool", "tool_call_id": "toolu_1", "content": tc.want}}
+		if !reflect.DeepEqual(converted, want) {
+			t.Errorf("mode %q, is_error %v: converted = %#v\nwant %#v", tc.mode, tc.isError, converted, want)
+		}
+	}
+}
+
+func TestConvertToolResultBlockContent(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		content     interface{}
+		wantContent string
+		wantImage   bool
+	}{
+		{name: "text block", content: []interface{}{map[string]interface{}{"type": "text", "text": "result"}}, wantContent: "result"},
+		{name: "text blocks", content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "line one"},
+			map[string]interface{}{"type": "text", "text": "line two"},
+		}, wantContent: "line one\nline two"},
+		{name: "text and image", content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "screenshot taken"},
+			map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": "iVBORw0K"}},
+		}, wantContent: "screenshot taken", wantImage: true},
+		{name: "arbitrary JSON", content: []interface{}{map[string]interface{}{"rows": float64(3)}}, wantContent: `[{"rows":3}]`},
+	} {
+		msg := model.AnthropicMessage{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_1", "content": tc.content},
+		}}
+		converted, err := NewConverter().ConvertAnthropicMessage(msg)
+		if err != nil {
+			t.Fatalf("%s: convert: %v", tc.name, err)
+		}
+		if converted[0]["role"] != "tool" || converted[0]["content"] != tc.wantContent {
+			t.Errorf("%s: tool message = %#v, want content %q", tc.name, converted[0], tc.wantContent)
+		}
+		if !tc.wantImage {
+			if len(converted) != 1 {
+				t.Errorf("%s: converted = %#v, want only the tool message", tc.name, converted)
+			}
+			continue
+		}
+		if len(converted) != 2 {
+			t.Fatalf("%s: converted = %#v, want the image in a following user message", tc.name, converted)
+		}
+		parts, _ := converted[1]["content"].([]map[string]interface{})
+		if converted[1]["role"] != "user" || len(parts) != 1 || parts[0]["type"] != "image_url" {
+			t.Errorf("%s: image message = %#v", tc.name, converted[1])
+		}
+	}
+}
+
+func TestConvertSystemPromptForms(t *testing.T) {
+	user := []model.AnthropicMessage{{Role: "user", Content: "hi"}}
+	blocks := []interface{}{
+		map[string]interface{}{"type": "text", "text": "You are a librarian.", "cache_control": map[string]interface{}{"type": "ephemeral"}},
+		map[string]interface{}{"type": "text", "text": "Answer in French."},
+		map[string]interface{}{"type": "text", "text": "Be brief."},
+	}
+	for _, tc := range []struct {
+		name       string
+		system     interface{}
+		structured bool
+		want       interface{}
+	}{
+		{name: "string", system: "You are a librarian.", want: "You are a librarian."},
+		{name: "string structured", system: "You are a librarian.", structured: true, want: "You are a librarian."},
+		{name: "array", system: blocks, want: "You are a librarian.\nAnswer in French.\nBe brief."},
+		{name: "array structured", system: blocks, structured: true, want: []map[string]interface{}{
+			{"type": "text", "text": "You are a librarian."},
+			{"type": "text", "text": "Answer in French."},
+			{"type": "text", "text": "Be brief."},
+		}},
+		{name: "blank", system: "  "},
+		{name: "empty array structured", system: []interface{}{}, structured: true},
+	} {
+		converted, err := NewConverterWithOptions(ConverterOptions{StructuredSystem: tc.structured}).ConvertAnthropicToOpenAIMessages(tc.system, user)
+		if err != nil {
+			t.Fatalf("%s: convert: %v", tc.name, err)
+		}
+		if tc.want == nil {
+			if len(converted) != 1 || converted[0]["role"] != "user" {
+				t.Errorf("%s: converted = %#v, want no system message", tc.name, converted)
+			}
+			continue
+		}
+		if system := converted[0]; system["role"] != "system" || !reflect.DeepEqual(system["content"], tc.want) {
+			t.Errorf("%s: system = %#v, want content %#v", tc.name, system, tc.want)
+		}
+	}
+}
+
+func TestConvertMisplacedToolResult(t *testing.T) {
+	result := map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_1", "content": "sunny"}
+	toolResult := map[string]interface{}{"role": "tool", "tool_call_id": "toolu_1", "content": "sunny"}
+
+	// Without own tool calls the result moves ahead of the assistant text
+	converted, err := NewConverter().ConvertAnthropicMessage(model.AnthropicMessage{Role: "assistant", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "It's sunny."},
+		result,
+	}})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	want := []map[string]interface{}{toolResult, {"role": "assistant", "content": "It's sunny."}}
+	if !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted = %#v\nwant %#v", converted, want)
+	}
+
+	// With own tool calls it follows them, answering the call
+	converted, err = NewConverter().ConvertAnthropicMessage(model.AnthropicMessage{Role: "assistant", Content: []interface{}{
+		map[string]interface{}{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]interface{}{}},
+		result,
+	}})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(converted) != 2 || converted[0]["role"] != "assistant" || converted[0]["tool_calls"] == nil || !reflect.DeepEqual(converted[1], toolResult) {
+		t.Errorf("converted = %#v, want the assistant tool call then its result", converted)
+	}
+
+	_, err = NewConverterWithOptions(ConverterOptions{RejectMisplacedToolResults: true}).ConvertAnthropicMessage(model.AnthropicMessage{Role: "assistant", Content: []interface{}{result}})
+	if !errors.Is(err, ErrUnsupportedContent) {
+		t.Errorf("reject mode: err = %v, want ErrUnsupportedContent", err)
+	}
+	// User messages are unaffected by reject mode
+	converted, err = NewConverterWithOptions(ConverterOptions{RejectMisplacedToolResults: true}).ConvertAnthropicMessage(model.AnthropicMessage{Role: "user", Content: []interface{}{result}})
+	if err != nil || !reflect.DeepEqual(converted, []map[string]interface{}{toolResult}) {
+		t.Errorf("user tool_result in reject mode: converted = %#v, err = %v", converted, err)
+	}
+}
@@ -1,11 +1,24 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-// GenerateToolCallID generates a unique tool call ID
+// toolCallSeq disambiguates ids should the random source ever fail
+var toolCallSeq atomic.Uint64
+
+// GenerateToolCallID generates a unique tool call ID. The timestamp keeps
+// ids roughly ordered; the random suffix keeps ids created within the same
+// clock tick apart. Safe for concurrent use.
 func GenerateToolCallID() string {
-	return "call_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	id := "call_" + strconv.FormatInt(time.Now().UnixNano(), 10) + "_"
+	var suffix [6]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return id + strconv.FormatUint(toolCallSeq.Add(1), 10)
+	}
+	return id + hex.EncodeToString(suffix[:])
 }
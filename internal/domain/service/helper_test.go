@@ -0,0 +1,38 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGenerateToolCallIDUnique(t *testing.T) {
+	const workers, perWorker = 10, 1000
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				ids <- GenerateToolCallID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*perWorker)
+	for id := range ids {
+		if !strings.HasPrefix(id, "call_") {
+			t.Fatalf("id %q lacks the call_ prefix", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("generated %d ids, want %d", len(seen), workers*perWorker)
+	}
+}
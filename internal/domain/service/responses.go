@@ -0,0 +1,445 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"api-conver/internal/domain/model"
+)
+
+// ResponsesRequestOptions carries the per-upstream settings used when
+// converting a Responses API request.
+type ResponsesRequestOptions struct {
+	// DefaultModel is used when the request names no model.
+	DefaultModel string
+	// RejectMissingToolCallID fails tool messages without tool_call_id
+	// instead of attaching the most recent tool call id.
+	RejectMissingToolCallID bool
+}
+
+// ConvertResponsesRequest converts a Responses API request into an OpenAI
+// chat completion request and reports whether the client asked to stream.
+func (c *Converter) ConvertResponsesRequest(payload map[string]interface{}, opts ResponsesRequestOptions) (map[string]interface{}, bool, error) {
+	chatReq := map[string]interface{}{}
+
+	modelVal, _ := payload["model"].(string)
+	if strings.TrimSpace(modelVal) == "" {
+		modelVal = opts.DefaultModel
+	}
+	chatReq["model"] = modelVal
+
+	stream := false
+	if rawStream, ok := payload["stream"]; ok {
+		if v, ok := rawStream.(bool); ok {
+			stream = v
+		}
+	}
+	chatReq["stream"] = stream
+	if stream {
+		chatReq["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	messages, err := ParseResponsesInput(payload["input"])
+	if err != nil {
+		return nil, false, err
+	}
+	if err := ResolveToolCallIDs(messages, opts.RejectMissingToolCallID); err != nil {
+		return nil, false, err
+	}
+	instructions, _ := payload["instructions"].(string)
+	if merged := MergeSystemMessages(instructions, messages); len(merged) > 0 {
+		chatReq["messages"] = merged
+	}
+	if _, ok := chatReq["messages"]; !ok {
+		return nil, false, errors.New("missing input messages")
+	}
+
+	copyIfPresent(payload, chatReq, "temperature")
+	copyIfPresent(payload, chatReq, "top_p")
+	copyIfPresent(payload, chatReq, "presence_penalty")
+	copyIfPresent(payload, chatReq, "frequency_penalty")
+	copyIfPresent(payload, chatReq, "seed")
+	copyIfPresent(payload, chatReq, "response_format")
+	copyIfPresent(payload, chatReq, "tools")
+	copyIfPresent(payload, chatReq, "tool_choice")
+	copyIfPresent(payload, chatReq, "parallel_tool_calls")
+
+	if maxOutputTokens, ok := payload["max_output_tokens"]; ok {
+		chatReq["max_tokens"] = maxOutputTokens
+	} else if maxTokens, ok := payload["max_tokens"]; ok {
+		chatReq["max_tokens"] = maxTokens
+	}
+
+	return chatReq, stream, nil
+}
+
+// MergeSystemMessages folds instructions and any system messages from the
+// input into a single leading system message, instructions first, so the
+// upstream never sees competing system prompts.
+func MergeSystemMessages(instructions string, messages []map[string]interface{}) []map[string]interface{} {
+	systemParts := []string{}
+	if strings.TrimSpace(instructions) != "" {
+		systemParts = append(systemParts, instructions)
+	}
+	rest := make([]map[string]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		if role, _ := msg["role"].(string); role == "system" {
+			if text, _ := msg["content"].(string); strings.TrimSpace(text) != "" {
+				systemParts = append(systemParts, text)
+			}
+			continue
+		}
+		rest = append(rest, msg)
+	}
+	if len(systemParts) == 0 {
+		return rest
+	}
+	system := map[string]interface{}{
+		"role":    "system",
+		"content": strings.Join(systemParts, "\n\n"),
+	}
+	return append([]map[string]interface{}{system}, rest...)
+}
+
+// ParseResponsesInput converts a Responses API input, either a string or a
+// list of items, into OpenAI chat messages.
+func ParseResponsesInput(input interface{}) ([]map[string]interface{}, error) {
+	if input == nil {
+		return nil, nil
+	}
+
+	items := []interface{}{input}
+	if list, ok := input.([]interface{}); ok {
+		items = list
+	}
+
+	messages := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		msg, ok := item.(map[string]interface{})
+		if !ok {
+			if text, ok := item.(string); ok && strings.TrimSpace(text) != "" {
+				messages = append(messages, map[string]interface{}{
+					"role":    "user",
+					"content": text,
+				})
+			}
+			continue
+		}
+
+		itemType, _ := msg["type"].(string)
+		switch itemType {
+		case "tool_output", "tool_result", "function_call_output":
+			toolMsg := buildToolMessage(msg)
+			if toolMsg != nil {
+				messages = append(messages, toolMsg)
+			}
+		case "message":
+			messages = append(messages, buildResponsesMessage(msg))
+		default:
+			messages = append(messages, buildChatMessage(msg))
+		}
+	}
+
+	return messages, nil
+}
+
+// buildResponsesMessage converts an input item of type "message", such as
+// a replayed assistant output whose content is a list of output_text and
+// refusal parts.
+func buildResponsesMessage(msg map[string]interface{}) map[string]interface{} {
+	role, _ := msg["role"].(string)
+	if strings.TrimSpace(role) == "" {
+		role = "user"
+	}
+	parts := []string{}
+	if text := ExtractResponsesText(msg["content"]); strings.TrimSpace(text) != "" {
+		parts = append(parts, text)
+	}
+	if list, ok := msg["content"].([]interface{}); ok {
+		for _, item := range list {
+			block, _ := item.(map[string]interface{})
+			if blockType, _ := block["type"].(string); blockType != "refusal" {
+				continue
+			}
+			if refusal, _ := block["refusal"].(string); strings.TrimSpace(refusal) != "" {
+				parts = append(parts, refusal)
+			}
+		}
+	}
+	return map[string]interface{}{
+		"role":    role,
+		"content": strings.Join(parts, "\n"),
+	}
+}
+
+// buildChatMessage converts an untyped input item carrying a chat style
+// role and content.
+func buildChatMessage(msg map[string]interface{}) map[string]interface{} {
+	role, _ := msg["role"].(string)
+	if strings.TrimSpace(role) == "" {
+		role = "user"
+	}
+	content := ExtractResponsesText(msg["content"])
+	message := map[string]interface{}{
+		"role":    role,
+		"content": content,
+	}
+	if role == "tool" {
+		if toolID, ok := msg["tool_call_id"].(string); ok && strings.TrimSpace(toolID) != "" {
+			message["tool_call_id"] = toolID
+		}
+	}
+	if toolCalls, ok := msg["tool_calls"]; ok {
+		message["tool_calls"] = toolCalls
+	}
+	if functionCall, ok := msg["function_call"]; ok {
+		message["function_call"] = functionCall
+	}
+	return message
+}
+
+// ResolveToolCallIDs makes sure every tool message carries a tool_call_id,
+// which OpenAI requires. Missing ids are rejected or filled with the first
+// unanswered call of the most recent assistant tool_calls, falling back to
+// its last call.
+func ResolveToolCallIDs(messages []map[string]interface{}, reject bool) error {
+	pending := []string{}
+	lastID := ""
+	for i, msg := range messages {
+		role, _ := msg["role"].(string)
+		if role == "assistant" {
+			if ids := toolCallIDs(msg["tool_calls"]); len(ids) > 0 {
+				pending = ids
+				lastID = ids[len(ids)-1]
+			}
+			continue
+		}
+		if role != "tool" {
+			continue
+		}
+		if id, _ := msg["tool_call_id"].(string); strings.TrimSpace(id) != "" {
+			pending = removeString(pending, id)
+			continue
+		}
+		if reject {
+			return fmt.Errorf("input message %d is a tool message missing tool_call_id", i)
+		}
+		switch {
+		case len(pending) > 0:
+			msg["tool_call_id"] = pending[0]
+			pending = pending[1:]
+		case lastID != "":
+			msg["tool_call_id"] = lastID
+		default:
+			return fmt.Errorf("input message %d is a tool message missing tool_call_id and no preceding tool call was found", i)
+		}
+	}
+	return nil
+}
+
+func toolCallIDs(toolCalls interface{}) []string {
+	list, _ := toolCalls.([]interface{})
+	ids := make([]string, 0, len(list))
+	for _, item := range list {
+		call, _ := item.(map[string]interface{})
+		if id, _ := call["id"].(string); strings.TrimSpace(id) != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func removeString(list []string, value string) []string {
+	for i, item := range list {
+		if item == value {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func buildToolMessage(msg map[string]interface{}) map[string]interface{} {
+	toolID := ""
+	if v, ok := msg["tool_call_id"].(string); ok {
+		toolID = v
+	}
+	if toolID == "" {
+		if v, ok := msg["call_id"].(string); ok {
+			toolID = v
+		}
+	}
+	if toolID == "" {
+		if v, ok := msg["id"].(string); ok {
+			toolID = v
+		}
+	}
+	content := ""
+	if v, ok := msg["output"].(string); ok {
+		content = v
+	} else if v, ok := msg["content"].(string); ok {
+		content = v
+	} else {
+		content = ExtractResponsesText(msg["content"])
+	}
+	if toolID == "" && strings.TrimSpace(content) == "" {
+		return nil
+	}
+	message := map[string]interface{}{
+		"role":    "tool",
+		"content": content,
+	}
+	if toolID != "" {
+		message["tool_call_id"] = toolID
+	}
+	return message
+}
+
+// ExtractResponsesText joins the text parts of Responses content
+func ExtractResponsesText(content interface{}) string {
+	switch v := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				if text, ok := item.(string); ok && strings.TrimSpace(text) != "" {
+					parts = append(parts, text)
+				}
+				continue
+			}
+			blockType, _ := block["type"].(string)
+			if blockType != "" && blockType != "input_text" && blockType != "text" && blockType != "output_text" {
+				continue
+			}
+			if text, ok := block["text"].(string); ok && strings.TrimSpace(text) != "" {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	case map[string]interface{}:
+		if text, ok := v["text"].(string); ok {
+			return text
+		}
+	}
+	return ""
+}
+
+// BuildResponsesToolCallItems converts OpenAI tool calls into Responses
+// output items.
+func BuildResponsesToolCallItems(toolCalls []model.OpenAIToolCall) []map[string]interface{} {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+	items := make([]map[string]interface{}, 0, len(toolCalls))
+	for _, call := range toolCalls {
+		name := strings.TrimSpace(call.Function.Name)
+		if name == "" && strings.TrimSpace(call.Function.Arguments) == "" {
+			continue
+		}
+		item := map[string]interface{}{
+			"id":        call.ID,
+			"call_id":   call.ID,
+			"type":      "tool_call",
+			"name":      name,
+			"arguments": parseToolCallArguments(call.Function.Arguments),
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return items
+}
+
+func parseToolCallArguments(raw string) interface{} {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return map[string]interface{}{}
+	}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		return raw
+	}
+	return payload
+}
+
+func copyIfPresent(src map[string]interface{}, dst map[string]interface{}, key string) {
+	if val, ok := src[key]; ok {
+		dst[key] = val
+	}
+}
+
+// ConvertOpenAIToResponses converts a chat completion into a Responses API
+// response. messageID and created are supplied by the caller, which owns
+// id synthesis and the clock.
+func (c *Converter) ConvertOpenAIToResponses(openAIResp model.OpenAIResponse, reqModel, messageID string, created int64) map[string]interface{} {
+	modelName := openAIResp.Model
+	if strings.TrimSpace(modelName) == "" {
+		modelName = reqModel
+	}
+
+	var message *model.OpenAIMessage
+	var finishReason string
+	if len(openAIResp.Choices) > 0 {
+		message = openAIResp.Choices[0].Message
+		finishReason = openAIResp.Choices[0].FinishReason
+	}
+
+	outputItems := []interface{}{}
+	messageItem := map[string]interface{}{
+		"id":      messageID,
+		"type":    "message",
+		"role":    "assistant",
+		"content": []interface{}{},
+	}
+
+	if message != nil {
+		text := strings.TrimSpace(c.OpenAIContentToString(message.Content))
+		if text != "" {
+			messageItem["content"] = []interface{}{
+				map[string]interface{}{
+					"type": "output_text",
+					"text": text,
+				},
+			}
+		}
+
+		toolCallItems := BuildResponsesToolCallItems(message.ToolCalls)
+		if len(toolCallItems) > 0 {
+			messageItem["tool_calls"] = toolCallItems
+			for _, item := range toolCallItems {
+				outputItems = append(outputItems, item)
+			}
+		}
+	}
+
+	outputItems = append([]interface{}{messageItem}, outputItems...)
+
+	response := map[string]interface{}{
+		"id":      openAIResp.ID,
+		"object":  "response",
+		"created": created,
+		"model":   modelName,
+		"output":  outputItems,
+		"usage": map[string]interface{}{
+			"input_tokens":  openAIResp.Usage.PromptTokens,
+			"output_tokens": openAIResp.Usage.CompletionTokens,
+			"total_tokens":  openAIResp.Usage.TotalTokens,
+		},
+	}
+
+	if finishReason != "" {
+		response["finish_reason"] = finishReason
+	}
+	if openAIResp.SystemFingerprint != "" {
+		response["system_fingerprint"] = openAIResp.SystemFingerprint
+	}
+
+	return response
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// responsesPayload decodes a Responses API request body
+func responsesPayload(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("bad payload: %v", err)
+	}
+	return payload
+}
+
+func TestConvertResponsesRequestOrdersInstructionsFirst(t *testing.T) {
+	payload := responsesPayload(t, `{
+		"model": "m",
+		"instructions": "Follow the house style.",
+		"input": [
+			{"role": "user", "content": "hi"},
+			{"role": "system", "content": "Answer in French."},
+			{"role": "assistant", "content": "Bonjour"},
+			{"role": "system", "content": "Be brief."}
+		]
+	}`)
+	chatReq, _, err := NewConverter().ConvertResponsesRequest(payload, ResponsesRequestOptions{})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	messages := chatReq["messages"].([]map[string]interface{})
+	want := []map[string]interface{}{
+		{"role": "system", "content": "Follow the house style.\n\nAnswer in French.\n\nBe brief."},
+		{"role": "user", "content": "hi"},
+		{"role": "assistant", "content": "Bonjour"},
+	}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("messages = %#v\nwant %#v", messages, want)
+	}
+}
+
+func TestMergeSystemMessages(t *testing.T) {
+	user := map[string]interface{}{"role": "user", "content": "hi"}
+	for _, tc := range []struct {
+		name         string
+		instructions string
+		messages     []map[string]interface{}
+		want         []map[string]interface{}
+	}{
+		{
+			name:     "no system prompt",
+			messages: []map[string]interface{}{user},
+			want:     []map[string]interface{}{user},
+		},
+		{
+			name:         "instructions only",
+			instructions: "Be kind.",
+			messages:     []map[string]interface{}{user},
+			want:         []map[string]interface{}{{"role": "system", "content": "Be kind."}, user},
+		},
+		{
+			name:         "blank parts skipped",
+			instructions: "  ",
+			messages:     []map[string]interface{}{{"role": "system", "content": ""}, user, {"role": "system", "content": "Only me."}},
+			want:         []map[string]interface{}{{"role": "system", "content": "Only me."}, user},
+		},
+	} {
+		if got := MergeSystemMessages(tc.instructions, tc.messages); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: MergeSystemMessages = %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseResponsesInputReplaysAssistantMessage(t *testing.T) {
+	payload := responsesPayload(t, `{"input": [
+		{"role": "user", "content": [{"type": "input_text", "text": "What is 2+2?"}]},
+		{"type": "message", "id": "msg_1", "status": "completed", "role": "assistant", "content": [
+			{"type": "output_text", "text": "4", "annotations": []},
+			{"type": "refusal", "refusal": "I won't show my work."}
+		]},
+		{"type": "message", "content": [{"type": "input_text", "text": "Thanks"}]}
+	]}`)
+	messages, err := ParseResponsesInput(payload["input"])
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"role": "user", "content": "What is 2+2?"},
+		{"role": "assistant", "content": "4\nI won't show my work."},
+		{"role": "user", "content": "Thanks"},
+	}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("messages = %#v\nwant %#v", messages, want)
+	}
+}
+
+func TestResolveToolCallIDs(t *testing.T) {
+	assistant := func(ids ...string) map[string]interface{} {
+		calls := []interface{}{}
+		for _, id := range ids {
+			calls = append(calls, map[string]interface{}{"id": id, "type": "function"})
+		}
+		return map[string]interface{}{"role": "assistant", "tool_calls": calls}
+	}
+	tool := func(id string) map[string]interface{} {
+		msg := map[string]interface{}{"role": "tool", "content": "ok"}
+		if id != "" {
+			msg["tool_call_id"] = id
+		}
+		return msg
+	}
+	for _, tc := range []struct {
+		name     string
+		messages []map[string]interface{}
+		reject   bool
+		want     []interface{}
+		wantErr  bool
+	}{
+		{name: "attach unanswered calls in order", messages: []map[string]interface{}{assistant("call_a", "call_b"), tool(""), tool("")}, want: []interface{}{"call_a", "call_b"}},
+		{name: "skip answered call", messages: []map[string]interface{}{assistant("call_a", "call_b"), tool("call_a"), tool("")}, want: []interface{}{"call_a", "call_b"}},
+		{name: "fall back to last call", messages: []map[string]interface{}{assistant("call_a"), tool("call_a"), tool("")}, want: []interface{}{"call_a", "call_a"}},
+		{name: "no preceding call", messages: []map[string]interface{}{{"role": "user", "content": "hi"}, tool("")}, wantErr: true},
+		{name: "reject", messages: []map[string]interface{}{assistant("call_a"), tool("")}, reject: true, wantErr: true},
+		{name: "reject keeps explicit ids", messages: []map[string]interface{}{assistant("call_a"), tool("call_a")}, reject: true, want: []interface{}{"call_a"}},
+	} {
+		err := ResolveToolCallIDs(tc.messages, tc.reject)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %t", tc.name, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		var got []interface{}
+		for _, msg := range tc.messages {
+			if msg["role"] == "tool" {
+				got = append(got, msg["tool_call_id"])
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: tool_call_ids = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseResponsesInput(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []map[string]interface{}
+	}{
+		{name: "string", input: `"Tell me a joke"`, want: []map[string]interface{}{
+			{"role": "user", "content": "Tell me a joke"},
+		}},
+		{name: "blank string list item", input: `["hi", "  "]`, want: []map[string]interface{}{
+			{"role": "user", "content": "hi"},
+		}},
+		{name: "message objects", input: `[
+			{"role": "developer", "content": "Be brief."},
+			{"role": "user", "content": [{"type": "input_text", "text": "Hello"}, {"type": "input_text", "text": "there"}]},
+			{"content": "no role"}]`, want: []map[string]interface{}{
+			{"role": "developer", "content": "Be brief."},
+			{"role": "user", "content": "Hello\nthere"},
+			{"role": "user", "content": "no role"},
+		}},
+		{name: "single message object", input: `{"role": "user", "content": "hi"}`, want: []map[string]interface{}{
+			{"role": "user", "content": "hi"},
+		}},
+		{name: "tool outputs", input: `[
+			{"type": "function_call_output", "call_id": "call_1", "output": "{\"temp\":21}"},
+			{"type": "tool_output", "tool_call_id": "call_2", "content": [{"type": "output_text", "text": "done"}]},
+			{"type": "tool_result", "id": "call_3", "content": "ok"},
+			{"type": "function_call_output", "output": ""}]`, want: []map[string]interface{}{
+			{"role": "tool", "tool_call_id": "call_1", "content": `{"temp":21}`},
+			{"role": "tool", "tool_call_id": "call_2", "content": "done"},
+			{"role": "tool", "tool_call_id": "call_3", "content": "ok"},
+		}},
+	} {
+		var input interface{}
+		if err := json.Unmarshal([]byte(tc.input), &input); err != nil {
+			t.Fatalf("%s: bad input: %v", tc.name, err)
+		}
+		messages, err := ParseResponsesInput(input)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(messages, tc.want) {
+			t.Errorf("%s: messages = %#v\nwant %#v", tc.name, messages, tc.want)
+		}
+	}
+	if messages, err := ParseResponsesInput(nil); err != nil || messages != nil {
+		t.Errorf("nil input: messages = %v, err = %v", messages, err)
+	}
+}
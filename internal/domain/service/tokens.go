@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// TokenEstimator estimates the input tokens of a converted chat request.
+// Implementations backed by a real tokenizer can replace the heuristic.
+type TokenEstimator interface {
+	EstimateTokens(messages []map[string]interface{}, tools []map[string]interface{}) int
+}
+
+const (
+	// messageOverheadTokens approximates the role and framing tokens each
+	// chat message costs.
+	messageOverheadTokens = 4
+	// imageTokens is a flat estimate for an image or file part.
+	imageTokens = 85
+)
+
+// HeuristicEstimator approximates tokens without a tokenizer: four ASCII
+// characters per token, one token per non-ASCII character (CJK text is
+// roughly one token per character), plus a small per-message overhead.
+type HeuristicEstimator struct{}
+
+// EstimateTokens implements TokenEstimator
+func (HeuristicEstimator) EstimateTokens(messages []map[string]interface{}, tools []map[string]interface{}) int {
+	counter := &tokenCounter{}
+	for _, msg := range messages {
+		counter.tokens += messageOverheadTokens
+		counter.walk(msg)
+	}
+	for _, tool := range tools {
+		counter.walk(tool)
+	}
+	return counter.total()
+}
+
+// OutputTokenCounter estimates streamed output tokens incrementally with
+// the HeuristicEstimator rules, so split deltas count like the joined text.
+type OutputTokenCounter struct {
+	counter tokenCounter
+}
+
+// Add counts text emitted to the client
+func (o *OutputTokenCounter) Add(text string) {
+	o.counter.addText(text)
+}
+
+// Tokens returns the estimate for everything added so far
+func (o *OutputTokenCounter) Tokens() int {
+	return o.counter.total()
+}
+
+type tokenCounter struct {
+	asciiChars int
+	tokens     int
+}
+
+func (t *tokenCounter) total() int {
+	return t.tokens + (t.asciiChars+3)/4
+}
+
+func (t *tokenCounter) addText(text string) {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		if r < utf8.RuneSelf {
+			t.asciiChars++
+			continue
+		}
+		t.tokens++
+	}
+}
+
+// walk counts every string in v. Image and file parts count as a flat
+// estimate instead of their (often base64) payload.
+func (t *tokenCounter) walk(v interface{}) {
+	switch val := v.(type) {
+	case string:
+		t.addText(val)
+	case []interface{}:
+		for _, item := range val {
+			t.walk(item)
+		}
+	case []map[string]interface{}:
+		for _, item := range val {
+			t.walk(item)
+		}
+	case json.RawMessage:
+		// Tool schemas are forwarded verbatim as raw JSON
+		var decoded interface{}
+		if err := json.Unmarshal(val, &decoded); err == nil {
+			t.walk(decoded)
+		}
+	case map[string]interface{}:
+		if partType, _ := val["type"].(string); partType == "image_url" || partType == "file" {
+			t.tokens += imageTokens
+			return
+		}
+		for key, item := range val {
+			t.addText(key)
+			t.walk(item)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"api-conver/internal/domain/model"
+)
+
+func TestEstimateTokensCountsRawToolSchemas(t *testing.T) {
+	schema := `{"type":"object","properties":{"city":{"type":"string","description":"City name, e.g. Paris"},"unit":{"enum":["celsius","fahrenheit"]}}}`
+	tools := NewConverter().ConvertAnthropicTools([]model.AnthropicToolDefinition{{
+		Name:        "get_weather",
+		InputSchema: json.RawMessage(schema),
+	}})
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decodedTools := []map[string]interface{}{{
+		"type":     "function",
+		"function": map[string]interface{}{"name": "get_weather", "parameters": decoded},
+	}}
+
+	estimator := HeuristicEstimator{}
+	raw, parsed := estimator.EstimateTokens(nil, tools), estimator.EstimateTokens(nil, decodedTools)
+	if raw != parsed {
+		t.Errorf("raw schema counts %d tokens, decoded schema %d", raw, parsed)
+	}
+	nameOnly := estimator.EstimateTokens(nil, []map[string]interface{}{{
+		"type":     "function",
+		"function": map[string]interface{}{"name": "get_weather"},
+	}})
+	if raw <= nameOnly+10 {
+		t.Errorf("tool with schema counts %d tokens, without %d; want the schema counted", raw, nameOnly)
+	}
+}
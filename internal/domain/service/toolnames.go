@@ -0,0 +1,100 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxToolNameLength is the longest function name OpenAI accepts
+const maxToolNameLength = 64
+
+// toolNameMap remembers the OpenAI-safe names given to Anthropic tool names
+// during one request conversion, so returning tool calls can be restored.
+type toolNameMap struct {
+	sanitized map[string]string
+	original  map[string]string
+}
+
+// SanitizeToolName rewrites name to match OpenAI's ^[a-zA-Z0-9_-]{1,64}$:
+// invalid characters become underscores and the result is truncated to 64
+// characters.
+func SanitizeToolName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if isToolNameChar(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+		if b.Len() >= maxToolNameLength {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func isToolNameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+// outboundToolName returns the OpenAI name for an Anthropic tool name and
+// records the mapping. Distinct names sanitizing to the same value get a
+// numeric suffix so they stay distinguishable.
+func (c *Converter) outboundToolName(name string) string {
+	if name == "" {
+		return name
+	}
+	if sanitized, ok := c.toolNames.sanitized[name]; ok {
+		return sanitized
+	}
+	base := SanitizeToolName(name)
+	if base == name {
+		if _, taken := c.toolNames.original[name]; !taken {
+			c.toolNames.record(name, name)
+		}
+		return name
+	}
+	sanitized := base
+	for n := 2; c.toolNames.taken(sanitized); n++ {
+		suffix := "_" + strconv.Itoa(n)
+		sanitized = base[:min(len(base), maxToolNameLength-len(suffix))] + suffix
+	}
+	c.toolNames.record(name, sanitized)
+	return sanitized
+}
+
+// reserveToolNames records the already valid names first, so sanitized
+// names never shadow a tool that is legitimately called that way.
+func (c *Converter) reserveToolNames(names []string) {
+	for _, name := range names {
+		if name != "" && SanitizeToolName(name) == name && !c.toolNames.taken(name) {
+			c.toolNames.record(name, name)
+		}
+	}
+}
+
+func (m *toolNameMap) taken(sanitized string) bool {
+	_, ok := m.original[sanitized]
+	return ok
+}
+
+func (m *toolNameMap) record(name, sanitized string) {
+	if m.sanitized == nil {
+		m.sanitized = map[string]string{}
+		m.original = map[string]string{}
+	}
+	m.sanitized[name] = sanitized
+	m.original[sanitized] = name
+}
+
+// OriginalToolName maps a tool name returned by the upstream back to the
+// Anthropic name it was sanitized from during this converter's request.
+func (c *Converter) OriginalToolName(name string) string {
+	if original, ok := c.toolNames.original[name]; ok {
+		return original
+	}
+	return name
+}
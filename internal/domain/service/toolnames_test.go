@@ -0,0 +1,40 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeToolName(t *testing.T) {
+	for _, tc := range []struct{ name, want string }{
+		{"my.tool name", "my_tool_name"},
+		{"get-weather_v2", "get-weather_v2"},
+		{"", "_"},
+		{strings.Repeat("a", 70), strings.Repeat("a", 64)},
+		{"naïve", "na_ve"},
+	} {
+		if got := SanitizeToolName(tc.name); got != tc.want {
+			t.Errorf("SanitizeToolName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestToolNameRoundTrip(t *testing.T) {
+	c := NewConverter()
+	c.reserveToolNames([]string{"my_tool_name"})
+	for _, tc := range []struct{ name, want string }{
+		{"my.tool name", "my_tool_name_2"},
+		{"my tool.name", "my_tool_name_3"},
+		{"my_tool_name", "my_tool_name"},
+	} {
+		if got := c.outboundToolName(tc.name); got != tc.want {
+			t.Errorf("outboundToolName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+		if got := c.OriginalToolName(tc.want); got != tc.name {
+			t.Errorf("OriginalToolName(%q) = %q, want %q", tc.want, got, tc.name)
+		}
+	}
+	if got := c.OriginalToolName("unknown"); got != "unknown" {
+		t.Errorf("OriginalToolName(unknown) = %q", got)
+	}
+}
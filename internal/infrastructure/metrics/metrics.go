@@ -0,0 +1,371 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTagLength and maxTags cap client supplied tags to keep label
+// cardinality sane: tags first seen once maxTags distinct ones are
+// recorded are counted under OverflowTag.
+const (
+	maxTagLength = 64
+	maxTags      = 100
+)
+
+// OverflowTag labels requests whose tag arrived after the maxTags cap
+const OverflowTag = "other"
+
+// labelEscaper escapes label values as the exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes v as a Prometheus label value. Unlike %q it escapes
+// only backslashes, double quotes and newlines, so other characters reach
+// the scraper unchanged.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// Registry aggregates in-process request metrics and renders them in the
+// Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	tags       map[tagKey]*tagStats
+	tagNames   map[string]struct{}
+	toolRounds map[string]*toolRoundStats
+	queues     map[string]*queueStats
+	upstream   map[upstreamKey]*upstreamStats
+}
+
+type tagKey struct {
+	tag         string
+	statusClass string
+}
+
+type tagStats struct {
+	requests   uint64
+	latencySum float64
+}
+
+type toolRoundStats struct {
+	requests  uint64
+	roundsSum uint64
+	exceeded  uint64
+}
+
+// upstreamKey labels upstream calls by alias, client facing endpoint and
+// the status class of the upstream outcome.
+type upstreamKey struct {
+	alias       string
+	endpoint    string
+	statusClass string
+}
+
+type upstreamStats struct {
+	requests   uint64
+	latencySum float64
+	// buckets counts requests per upstreamBuckets upper bound
+	buckets []uint64
+}
+
+// upstreamBuckets are the latency histogram bounds in seconds
+var upstreamBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Endpoints used as the endpoint label of upstream metrics
+const (
+	EndpointChat      = "chat"
+	EndpointMessages  = "messages"
+	EndpointResponses = "responses"
+	EndpointProxy     = "proxy"
+)
+
+type queueStats struct {
+	depth    int64
+	admitted uint64
+	queued   uint64
+	waitSum  float64
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		tags:       map[tagKey]*tagStats{},
+		tagNames:   map[string]struct{}{},
+		toolRounds: map[string]*toolRoundStats{},
+		queues:     map[string]*queueStats{},
+		upstream:   map[upstreamKey]*upstreamStats{},
+	}
+}
+
+var defaultRegistry = NewRegistry()
+
+// Default returns the process wide registry
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// NormalizeTag trims a client supplied request tag and replaces characters
+// outside [A-Za-z0-9_.-] so it is safe to use as a label value.
+func NormalizeTag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, tag)
+}
+
+// ObserveTag records one request carrying tag with its final status and
+// latency. Empty tags are ignored and new tags beyond the distinct tag cap
+// are folded into OverflowTag.
+func (r *Registry) ObserveTag(tag string, status int, latency time.Duration) {
+	tag = NormalizeTag(tag)
+	if tag == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, seen := r.tagNames[tag]; !seen {
+		if len(r.tagNames) >= maxTags {
+			tag = OverflowTag
+		} else {
+			r.tagNames[tag] = struct{}{}
+		}
+	}
+	key := tagKey{tag: tag, statusClass: StatusClass(status)}
+	stats := r.tags[key]
+	if stats == nil {
+		stats = &tagStats{}
+		r.tags[key] = stats
+	}
+	stats.requests++
+	stats.latencySum += latency.Seconds()
+}
+
+// ObserveToolRounds records the number of tool call rounds in a request's
+// conversation history and whether it exceeded the alias limit.
+func (r *Registry) ObserveToolRounds(alias string, rounds int, exceeded bool) {
+	if alias == "" {
+		alias = "default"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.toolRounds[alias]
+	if stats == nil {
+		stats = &toolRoundStats{}
+		r.toolRounds[alias] = stats
+	}
+	stats.requests++
+	stats.roundsSum += uint64(rounds)
+	if exceeded {
+		stats.exceeded++
+	}
+}
+
+// AddQueueDepth adjusts the number of requests waiting for a concurrency
+// slot on alias.
+func (r *Registry) AddQueueDepth(alias string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue(alias).depth += delta
+}
+
+// ObserveQueueWait records a request admitted past the concurrency limiter
+// of alias, and how long it waited if it had to queue.
+func (r *Registry) ObserveQueueWait(alias string, wait time.Duration, queued bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.queue(alias)
+	stats.admitted++
+	if queued {
+		stats.queued++
+		stats.waitSum += wait.Seconds()
+	}
+}
+
+// queue returns the stats for alias; callers must hold r.mu
+func (r *Registry) queue(alias string) *queueStats {
+	if alias == "" {
+		alias = "default"
+	}
+	stats := r.queues[alias]
+	if stats == nil {
+		stats = &queueStats{}
+		r.queues[alias] = stats
+	}
+	return stats
+}
+
+// EndpointFor maps a client route such as /:alias/v1/messages to the
+// endpoint label of upstream metrics.
+func EndpointFor(route string) string {
+	switch {
+	case strings.HasSuffix(route, "/messages") || strings.HasSuffix(route, "/messages/count_tokens"):
+		return EndpointMessages
+	case strings.HasSuffix(route, "/chat/completions"):
+		return EndpointChat
+	case strings.HasSuffix(route, "/responses"):
+		return EndpointResponses
+	default:
+		return EndpointProxy
+	}
+}
+
+// ObserveUpstream records one upstream call made for alias on behalf of
+// endpoint. A zero status marks a transport error.
+func (r *Registry) ObserveUpstream(alias, endpoint string, status int, latency time.Duration) {
+	if alias == "" {
+		alias = "default"
+	}
+	statusClass := "error"
+	if status != 0 {
+		statusClass = StatusClass(status)
+	}
+	key := upstreamKey{alias: alias, endpoint: endpoint, statusClass: statusClass}
+	seconds := latency.Seconds()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.upstream[key]
+	if stats == nil {
+		stats = &upstreamStats{buckets: make([]uint64, len(upstreamBuckets))}
+		r.upstream[key] = stats
+	}
+	stats.requests++
+	stats.latencySum += seconds
+	for i, bound := range upstreamBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// StatusClass buckets an HTTP status code as "2xx", "4xx" and so on
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// WritePrometheus writes all metrics in the Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	keys := make([]tagKey, 0, len(r.tags))
+	stats := make(map[tagKey]tagStats, len(r.tags))
+	for key, s := range r.tags {
+		keys = append(keys, key)
+		stats[key] = *s
+	}
+	aliases := make([]string, 0, len(r.toolRounds))
+	rounds := make(map[string]toolRoundStats, len(r.toolRounds))
+	for alias, s := range r.toolRounds {
+		aliases = append(aliases, alias)
+		rounds[alias] = *s
+	}
+	queueAliases := make([]string, 0, len(r.queues))
+	queues := make(map[string]queueStats, len(r.queues))
+	for alias, s := range r.queues {
+		queueAliases = append(queueAliases, alias)
+		queues[alias] = *s
+	}
+	upstreamKeys := make([]upstreamKey, 0, len(r.upstream))
+	upstream := make(map[upstreamKey]upstreamStats, len(r.upstream))
+	for key, s := range r.upstream {
+		upstreamKeys = append(upstreamKeys, key)
+		copied := *s
+		copied.buckets = append([]uint64(nil), s.buckets...)
+		upstream[key] = copied
+	}
+	r.mu.Unlock()
+
+	sort.Strings(aliases)
+	sort.Strings(queueAliases)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tag != keys[j].tag {
+			return keys[i].tag < keys[j].tag
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+	sort.Slice(upstreamKeys, func(i, j int) bool {
+		a, b := upstreamKeys[i], upstreamKeys[j]
+		if a.alias != b.alias {
+			return a.alias < b.alias
+		}
+		if a.endpoint != b.endpoint {
+			return a.endpoint < b.endpoint
+		}
+		return a.statusClass < b.statusClass
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP api_conver_tagged_requests_total Requests carrying an X-Request-Tag header.\n")
+	b.WriteString("# TYPE api_conver_tagged_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "api_conver_tagged_requests_total{tag=%s,status_class=%s} %d\n", labelValue(key.tag), labelValue(key.statusClass), stats[key].requests)
+	}
+	b.WriteString("# HELP api_conver_tagged_request_duration_seconds Latency of requests carrying an X-Request-Tag header.\n")
+	b.WriteString("# TYPE api_conver_tagged_request_duration_seconds summary\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "api_conver_tagged_request_duration_seconds_sum{tag=%s,status_class=%s} %g\n", labelValue(key.tag), labelValue(key.statusClass), stats[key].latencySum)
+		fmt.Fprintf(&b, "api_conver_tagged_request_duration_seconds_count{tag=%s,status_class=%s} %d\n", labelValue(key.tag), labelValue(key.statusClass), stats[key].requests)
+	}
+	b.WriteString("# HELP api_conver_tool_call_rounds Tool call rounds in request conversation histories.\n")
+	b.WriteString("# TYPE api_conver_tool_call_rounds summary\n")
+	for _, alias := range aliases {
+		fmt.Fprintf(&b, "api_conver_tool_call_rounds_sum{alias=%s} %d\n", labelValue(alias), rounds[alias].roundsSum)
+		fmt.Fprintf(&b, "api_conver_tool_call_rounds_count{alias=%s} %d\n", labelValue(alias), rounds[alias].requests)
+	}
+	b.WriteString("# HELP api_conver_tool_call_rounds_exceeded_total Requests whose history exceeded max_tool_rounds.\n")
+	b.WriteString("# TYPE api_conver_tool_call_rounds_exceeded_total counter\n")
+	for _, alias := range aliases {
+		fmt.Fprintf(&b, "api_conver_tool_call_rounds_exceeded_total{alias=%s} %d\n", labelValue(alias), rounds[alias].exceeded)
+	}
+	b.WriteString("# HELP api_conver_queue_depth Requests waiting for a max_concurrent slot.\n")
+	b.WriteString("# TYPE api_conver_queue_depth gauge\n")
+	for _, alias := range queueAliases {
+		fmt.Fprintf(&b, "api_conver_queue_depth{alias=%s} %d\n", labelValue(alias), queues[alias].depth)
+	}
+	b.WriteString("# HELP api_conver_queue_admitted_total Requests admitted past the max_concurrent limiter.\n")
+	b.WriteString("# TYPE api_conver_queue_admitted_total counter\n")
+	for _, alias := range queueAliases {
+		fmt.Fprintf(&b, "api_conver_queue_admitted_total{alias=%s} %d\n", labelValue(alias), queues[alias].admitted)
+	}
+	b.WriteString("# HELP api_conver_queue_wait_seconds Time queued requests waited for a max_concurrent slot.\n")
+	b.WriteString("# TYPE api_conver_queue_wait_seconds summary\n")
+	for _, alias := range queueAliases {
+		fmt.Fprintf(&b, "api_conver_queue_wait_seconds_sum{alias=%s} %g\n", labelValue(alias), queues[alias].waitSum)
+		fmt.Fprintf(&b, "api_conver_queue_wait_seconds_count{alias=%s} %d\n", labelValue(alias), queues[alias].queued)
+	}
+	b.WriteString("# HELP api_conver_upstream_requests_total Upstream requests by alias, endpoint and upstream status class.\n")
+	b.WriteString("# TYPE api_conver_upstream_requests_total counter\n")
+	for _, key := range upstreamKeys {
+		fmt.Fprintf(&b, "api_conver_upstream_requests_total{alias=%s,endpoint=%s,status_class=%s} %d\n", labelValue(key.alias), labelValue(key.endpoint), labelValue(key.statusClass), upstream[key].requests)
+	}
+	b.WriteString("# HELP api_conver_upstream_request_duration_seconds Upstream latency; streams are measured until the response headers.\n")
+	b.WriteString("# TYPE api_conver_upstream_request_duration_seconds histogram\n")
+	for _, key := range upstreamKeys {
+		labels := fmt.Sprintf("alias=%s,endpoint=%s,status_class=%s", labelValue(key.alias), labelValue(key.endpoint), labelValue(key.statusClass))
+		stats := upstream[key]
+		for i, bound := range upstreamBuckets {
+			fmt.Fprintf(&b, "api_conver_upstream_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, stats.buckets[i])
+		}
+		fmt.Fprintf(&b, "api_conver_upstream_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, stats.requests)
+		fmt.Fprintf(&b, "api_conver_upstream_request_duration_seconds_sum{%s} %g\n", labels, stats.latencySum)
+		fmt.Fprintf(&b, "api_conver_upstream_request_duration_seconds_count{%s} %d\n", labels, stats.requests)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// render returns the Prometheus exposition of r
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return b.String()
+}
+
+func TestObserveTag(t *testing.T) {
+	r := NewRegistry()
+	r.ObserveTag("checkout", 200, 100*time.Millisecond)
+	r.ObserveTag(" checkout ", 201, 300*time.Millisecond)
+	r.ObserveTag("checkout", 502, time.Second)
+	r.ObserveTag("", 200, time.Second)
+
+	out := render(t, r)
+	for _, line := range []string{
+		`api_conver_tagged_requests_total{tag="checkout",status_class="2xx"} 2`,
+		`api_conver_tagged_requests_total{tag="checkout",status_class="5xx"} 1`,
+		`api_conver_tagged_request_duration_seconds_sum{tag="checkout",status_class="2xx"} 0.4`,
+		`api_conver_tagged_request_duration_seconds_count{tag="checkout",status_class="5xx"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, `tag=""`) {
+		t.Errorf("untagged request recorded:\n%s", out)
+	}
+}
+
+func TestObserveTagCapsDistinctTags(t *testing.T) {
+	r := NewRegistry()
+	for i := 0; i < maxTags; i++ {
+		r.ObserveTag(fmt.Sprintf("tag-%d", i), 200, time.Millisecond)
+	}
+	r.ObserveTag("late-a", 200, time.Millisecond)
+	r.ObserveTag("late-b", 500, time.Millisecond)
+	r.ObserveTag("tag-0", 200, time.Millisecond)
+
+	out := render(t, r)
+	for _, line := range []string{
+		`api_conver_tagged_requests_total{tag="tag-0",status_class="2xx"} 2`,
+		`api_conver_tagged_requests_total{tag="other",status_class="2xx"} 1`,
+		`api_conver_tagged_requests_total{tag="other",status_class="5xx"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "late-") {
+		t.Errorf("tags beyond the cap got their own series:\n%s", out)
+	}
+	if n := strings.Count(out, "api_conver_tagged_requests_total{"); n != maxTags+2 {
+		t.Errorf("%d tagged series, want %d", n, maxTags+2)
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	long := strings.Repeat("x", maxTagLength+10)
+	for in, want := range map[string]string{
+		"  search ":  "search",
+		"":           "",
+		"team/a b\"": "team_a_b_",
+		long:         long[:maxTagLength],
+	} {
+		if got := NormalizeTag(in); got != want {
+			t.Errorf("NormalizeTag(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":        `"plain"`,
+		`back\slash`:   `"back\\slash"`,
+		`say "hi"`:     `"say \"hi\""`,
+		"two\nlines":   `"two\nlines"`,
+		"tab\tand ünï": "\"tab\tand ünï\"",
+		"café/\x01":    "\"café/\x01\"",
+	} {
+		if got := labelValue(in); got != want {
+			t.Errorf("labelValue(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestObserveUpstreamLabels(t *testing.T) {
+	r := NewRegistry()
+	r.ObserveUpstream("zürich \"eu\"", EndpointMessages, 200, 50*time.Millisecond)
+	r.ObserveUpstream("zürich \"eu\"", EndpointMessages, 503, time.Second)
+
+	out := render(t, r)
+	for _, line := range []string{
+		`api_conver_upstream_requests_total{alias="zürich \"eu\"",endpoint="messages",status_class="2xx"} 1`,
+		`api_conver_upstream_requests_total{alias="zürich \"eu\"",endpoint="messages",status_class="5xx"} 1`,
+		`api_conver_upstream_request_duration_seconds_count{alias="zürich \"eu\"",endpoint="messages",status_class="5xx"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+}
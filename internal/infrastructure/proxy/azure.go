@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	neturl "net/url"
+	"strings"
+)
+
+// ProviderAzure selects Azure OpenAI URL and auth conventions
+const ProviderAzure = "azure"
+
+// DefaultAzureAPIVersion is sent when an Azure alias sets no api_version
+const DefaultAzureAPIVersion = "2024-10-21"
+
+func isAzure(cfg *UpstreamConfig) bool {
+	return cfg != nil && strings.EqualFold(cfg.Provider, ProviderAzure)
+}
+
+// buildAzureURL maps an OpenAI path onto an Azure resource endpoint:
+// /v1/chat/completions becomes /openai/deployments/{deployment}/chat/completions
+// and every request carries the api-version query parameter. The
+// deployment is the configured one, else the (already mapped) request
+// model. Requests without either, such as /v1/models, go to /openai.
+func buildAzureURL(baseURL, path, rawQuery string, cfg *UpstreamConfig, body []byte) string {
+	upstreamPath := strings.TrimPrefix(path, "/v1")
+	if !strings.HasPrefix(upstreamPath, "/") {
+		upstreamPath = "/" + upstreamPath
+	}
+	prefix := "/openai"
+	deployment := strings.TrimSpace(cfg.Deployment)
+	if deployment == "" {
+		deployment = requestModel(body)
+	}
+	if deployment != "" {
+		prefix += "/deployments/" + neturl.PathEscape(deployment)
+	}
+
+	query, err := neturl.ParseQuery(rawQuery)
+	if err != nil {
+		query = neturl.Values{}
+	}
+	if query.Get("api-version") == "" {
+		apiVersion := strings.TrimSpace(cfg.APIVersion)
+		if apiVersion == "" {
+			apiVersion = DefaultAzureAPIVersion
+		}
+		query.Set("api-version", apiVersion)
+	}
+	return strings.TrimSuffix(baseURL, "/") + prefix + upstreamPath + "?" + query.Encode()
+}
+
+// requestModel returns the model field of a JSON request body, if any
+func requestModel(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(payload.Model)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestBuildAzureURL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		baseURL  string
+		path     string
+		rawQuery string
+		cfg      UpstreamConfig
+		body     string
+		want     string
+	}{
+		{
+			name:    "configured deployment",
+			baseURL: "https://res.openai.azure.com/",
+			path:    "/v1/chat/completions",
+			cfg:     UpstreamConfig{Deployment: "gpt4o-prod", APIVersion: "2024-06-01"},
+			body:    `{"model":"gpt-4o"}`,
+			want:    "https://res.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version=2024-06-01",
+		},
+		{
+			name:    "deployment from the request model",
+			baseURL: "https://res.openai.azure.com",
+			path:    "/v1/chat/completions",
+			body:    `{"model":"my model"}`,
+			want:    "https://res.openai.azure.com/openai/deployments/my%20model/chat/completions?api-version=" + DefaultAzureAPIVersion,
+		},
+		{
+			name:    "no deployment",
+			baseURL: "https://res.openai.azure.com",
+			path:    "/v1/models",
+			want:    "https://res.openai.azure.com/openai/models?api-version=" + DefaultAzureAPIVersion,
+		},
+		{
+			name:     "client api-version and query kept",
+			baseURL:  "https://res.openai.azure.com",
+			path:     "/v1/embeddings",
+			rawQuery: "api-version=2025-01-01-preview&foo=bar",
+			cfg:      UpstreamConfig{Deployment: "embed", APIVersion: "2024-06-01"},
+			want:     "https://res.openai.azure.com/openai/deployments/embed/embeddings?api-version=2025-01-01-preview&foo=bar",
+		},
+		{
+			name:    "path without /v1",
+			baseURL: "https://res.openai.azure.com",
+			path:    "chat/completions",
+			cfg:     UpstreamConfig{Deployment: "d"},
+			want:    "https://res.openai.azure.com/openai/deployments/d/chat/completions?api-version=" + DefaultAzureAPIVersion,
+		},
+	} {
+		cfg := tc.cfg
+		if got := buildAzureURL(tc.baseURL, tc.path, tc.rawQuery, &cfg, []byte(tc.body)); got != tc.want {
+			t.Errorf("%s: buildAzureURL = %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAzureRequestHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cfg        UpstreamConfig
+		wantAPIKey string
+	}{
+		{name: "default header", cfg: UpstreamConfig{APIKey: "az-key-1"}, wantAPIKey: "az-key-1"},
+		{name: "configured header", cfg: UpstreamConfig{APIKey: "az-key-2", AuthHeader: "api-key"}, wantAPIKey: "az-key-2"},
+	} {
+		transport := &stubTransport{}
+		client := newTestClient(t, transport)
+		cfg := tc.cfg
+		cfg.BaseURL = "https://res.openai.azure.com"
+		cfg.Provider = ProviderAzure
+		cfg.Deployment = "prod"
+
+		c := newTestContext("POST", "/v1/chat/completions", "{}", "Authorization", "Bearer client-token", "api-key", "client-key")
+		if _, _, _, err := client.ProxyRequest(c, []byte(`{"model":"gpt-4o"}`), "POST", "/v1/chat/completions", &cfg); err != nil {
+			t.Fatalf("%s: proxy: %v", tc.name, err)
+		}
+		req, _ := transport.last(t)
+		if got := req.Header.Get("api-key"); got != tc.wantAPIKey {
+			t.Errorf("%s: api-key = %q, want %q", tc.name, got, tc.wantAPIKey)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("%s: Authorization = %q, want the client's dropped", tc.name, got)
+		}
+		if got := req.URL.String(); got != "https://res.openai.azure.com/openai/deployments/prod/chat/completions?api-version="+DefaultAzureAPIVersion {
+			t.Errorf("%s: URL = %s", tc.name, got)
+		}
+	}
+
+	// Without a configured key the client's api-key passes through
+	transport := &stubTransport{}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{BaseURL: "https://res.openai.azure.com", Provider: ProviderAzure, AuthHeader: "api-key"}
+	c := newTestContext("POST", "/v1/chat/completions", "{}", "api-key", "client-key")
+	if _, _, _, err := client.ProxyRequest(c, []byte(`{"model":"gpt-4o"}`), "POST", "/v1/chat/completions", cfg); err != nil {
+		t.Fatalf("passthrough: proxy: %v", err)
+	}
+	if req, _ := transport.last(t); req.Header.Get("api-key") != "client-key" {
+		t.Errorf("passthrough: api-key = %q, want client-key", req.Header.Get("api-key"))
+	}
+}
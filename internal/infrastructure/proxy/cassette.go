@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CassetteRecord forwards requests upstream and saves each interaction.
+	CassetteRecord = "record"
+	// CassetteReplay serves saved interactions without contacting upstream.
+	CassetteReplay = "replay"
+)
+
+// Cassette records upstream interactions to files and replays them, so
+// integration tests and demos can run without a live upstream. Request
+// headers are never written, which keeps API keys out of the files.
+type Cassette struct {
+	mode string
+	dir  string
+}
+
+type cassetteEntry struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body"`
+}
+
+type cassetteResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// NewCassette validates mode and returns a cassette storing files in dir.
+// An empty mode disables recording and returns nil.
+func NewCassette(mode, dir string) (*Cassette, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return nil, nil
+	case CassetteRecord, CassetteReplay:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	if strings.TrimSpace(dir) == "" {
+		dir = "cassettes"
+	}
+	if mode == CassetteRecord {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create cassette dir: %w", err)
+		}
+	}
+	return &Cassette{mode: mode, dir: dir}, nil
+}
+
+// Replaying reports whether the cassette serves saved interactions
+func (c *Cassette) Replaying() bool {
+	return c != nil && c.mode == CassetteReplay
+}
+
+// Transport wraps next so requests are recorded or replayed
+func (c *Cassette) Transport(next http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &cassetteTransport{cassette: c, next: next}
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	next     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	path := t.cassette.path(req.Method, req.URL.RequestURI(), body)
+
+	if t.cassette.mode == CassetteReplay {
+		return t.replay(req, path)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	entry := cassetteEntry{
+		Request: cassetteRequest{
+			Method: req.Method,
+			URL:    req.URL.RequestURI(),
+			Body:   string(body),
+		},
+		Response: cassetteResponse{
+			Status: resp.StatusCode,
+			Header: resp.Header,
+			Body:   string(respBody),
+		},
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return nil, fmt.Errorf("write cassette: %w", err)
+	}
+	return resp, nil
+}
+
+func (t *cassetteTransport) replay(req *http.Request, path string) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, req.URL.RequestURI())
+		}
+		return nil, err
+	}
+	var entry cassetteEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	header := entry.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, http.StatusText(entry.Response.Status)),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(entry.Response.Body)),
+		ContentLength: int64(len(entry.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// path names the cassette file for a request by hashing its method, URL
+// and body, so the same request always maps to the same recording.
+func (c *Cassette) path(method, url string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method)
+	h.Write([]byte{0})
+	io.WriteString(h, url)
+	h.Write([]byte{0})
+	h.Write(body)
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))[:32]+".json")
+}
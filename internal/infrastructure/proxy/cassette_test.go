@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCassetteRecordThenReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1"}
+	request := []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	const answer = `{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`
+
+	recorder, err := NewCassette(CassetteRecord, dir)
+	if err != nil {
+		t.Fatalf("record cassette: %v", err)
+	}
+	live := &stubTransport{respond: func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, answer), nil
+	}}
+	client := NewClient(WithTransport(live), WithCassette(recorder))
+	t.Cleanup(client.Close)
+	body, status, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), request, "POST", "/v1/chat/completions", cfg)
+	if err != nil || status != http.StatusOK || string(body) != answer {
+		t.Fatalf("record: status = %d, body = %s, err = %v", status, body, err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("recorded %d files, want 1", len(files))
+	}
+
+	player, err := NewCassette(CassetteReplay, dir)
+	if err != nil {
+		t.Fatalf("replay cassette: %v", err)
+	}
+	offline := &stubTransport{respond: func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("upstream contacted during replay")
+	}}
+	client = NewClient(WithTransport(offline), WithCassette(player))
+	t.Cleanup(client.Close)
+	body, status, headers, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), request, "POST", "/v1/chat/completions", cfg)
+	if err != nil || status != http.StatusOK || string(body) != answer {
+		t.Fatalf("replay: status = %d, body = %s, err = %v", status, body, err)
+	}
+	if got := headers.Get("Content-Type"); got != "application/json" {
+		t.Errorf("replayed Content-Type = %q", got)
+	}
+	resp, err := client.ProxyStream(newTestContext("POST", "/v1/chat/completions", ""), request, "POST", "/v1/chat/completions", cfg)
+	if err != nil {
+		t.Fatalf("replay stream: %v", err)
+	}
+	streamed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(streamed) != answer {
+		t.Errorf("replayed stream body = %s", streamed)
+	}
+	if len(offline.requests) != 0 {
+		t.Errorf("replay sent %d requests upstream, want 0", len(offline.requests))
+	}
+
+	_, _, _, err = client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), []byte(`{"model":"other"}`), "POST", "/v1/chat/completions", cfg)
+	if err == nil {
+		t.Error("replaying an unrecorded request succeeded, want an error")
+	}
+}
+
+func TestNewCassetteRejectsUnknownMode(t *testing.T) {
+	if _, err := NewCassette("rewind", t.TempDir()); err == nil {
+		t.Error("NewCassette accepted an unknown mode")
+	}
+}
@@ -2,48 +2,189 @@ package proxy
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/infrastructure/metrics"
 )
 
+// DefaultUserAgent identifies the proxy to upstreams instead of forwarding
+// the client's User-Agent.
+const DefaultUserAgent = "api-conver"
+
+// DefaultTimeout bounds non-streaming upstream requests when the alias does
+// not configure its own timeout.
+const DefaultTimeout = 60 * time.Second
+
+// DefaultAuxTimeout bounds auxiliary upstream requests, such as model
+// lookups and warmup probes, which should fail fast.
+const DefaultAuxTimeout = 10 * time.Second
+
 type UpstreamConfig struct {
 	BaseURL    string
 	APIKey     string
 	AuthHeader string
 	AuthPrefix string
+	// APIKeys are used round-robin, one per request, instead of APIKey
+	// when set.
+	APIKeys []string
+	// FallbackBaseURL receives the request again when BaseURL fails with a
+	// transport error or 5xx. Empty disables failover.
+	FallbackBaseURL string
+	// Alias labels the upstream metrics of requests made with this config.
+	Alias string
+	// Headers are set on every upstream request, overriding client,
+	// User-Agent and auth headers of the same name; Accept-Encoding is left
+	// to the transport. RemoveHeaders strips the named client headers
+	// before forwarding.
+	Headers       map[string]string
+	RemoveHeaders []string
+	// Timeout bounds a non-streaming request including reading the body.
+	// Zero uses DefaultTimeout.
+	Timeout time.Duration
+	// StreamHeaderTimeout bounds how long a streaming request waits for
+	// the upstream response headers. Zero waits indefinitely.
+	StreamHeaderTimeout time.Duration
+	// UserAgent overrides the User-Agent sent upstream.
+	UserAgent string
+	// BasePathMode controls how request paths join the base URL path; see
+	// BasePathAuto, BasePathReplace and BasePathAppend.
+	BasePathMode string
+	// LogLevel controls upstream response logging: "off", "error" (failed
+	// responses only), "info" (no bodies) or "debug" (with bodies, default).
+	LogLevel string
+	// LogBodies allows the "error" and "debug" levels to log bodies.
+	// Without it only status lines are logged.
+	LogBodies bool
+	// LogPrettyJSON indents logged outbound request bodies
+	LogPrettyJSON bool
+	// Provider "azure" rewrites request paths to Azure OpenAI deployment
+	// URLs with APIVersion and sends the key in the api-key header.
+	// Deployment overrides the deployment taken from the request model.
+	Provider   string
+	APIVersion string
+	Deployment string
 }
 
+const (
+	// BasePathAuto replaces the request's /v1 prefix when the base URL
+	// already ends in a version segment such as /v1 or /api/v3.
+	BasePathAuto = "auto"
+	// BasePathReplace always replaces the /v1 prefix with the base path.
+	BasePathReplace = "replace"
+	// BasePathAppend always appends the full request path.
+	BasePathAppend = "append"
+)
+
+const (
+	LogLevelOff   = "off"
+	LogLevelError = "error"
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
 type Client struct {
-	client *http.Client
+	client          *http.Client
+	cassette        *Cassette
+	streamIdle      time.Duration
+	streamTransport *streamTransports
+	transport       http.RoundTripper
+	keys            keyRotation
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithCassette records or replays upstream interactions through cassette
+func WithCassette(cassette *Cassette) ClientOption {
+	return func(c *Client) {
+		c.cassette = cassette
+	}
+}
+
+// WithStreamIdleConnTimeout closes idle streaming connections after d and
+// reaps unused streaming transports. Zero uses DefaultStreamIdleConnTimeout.
+func WithStreamIdleConnTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.streamIdle = d
+	}
+}
+
+// WithTransport sends every upstream request, streaming or not, through
+// transport, e.g. a mock upstream in tests. Stream header timeouts are then
+// left to the transport.
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.transport = transport
+	}
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.client = &http.Client{Transport: c.cassette.Transport(c.transport)}
+	c.streamTransport = newStreamTransports(c.streamIdle)
+	go c.streamTransport.run()
+	return c
+}
+
+// Close stops the idle connection reaper and closes idle streaming
+// connections.
+func (c *Client) Close() {
+	c.streamTransport.close()
 }
 
-func NewClient() *Client {
-	return &Client{
-		client: &http.Client{Timeout: 60 * time.Second},
+// requestTimeout returns the non-streaming timeout configured for cfg
+func requestTimeout(cfg *UpstreamConfig) time.Duration {
+	if cfg != nil && cfg.Timeout > 0 {
+		return cfg.Timeout
 	}
+	return DefaultTimeout
 }
 
-// ProxyRequest makes a proxy request to upstream
+// ProxyRequest makes a proxy request to upstream, failing over to the
+// fallback base URL when the primary errors or answers 5xx.
 func (c *Client) ProxyRequest(ctx *gin.Context, body []byte, method string, upstreamPath string, cfg *UpstreamConfig) ([]byte, int, http.Header, error) {
-	baseURL := c.getBaseURL(cfg)
-	url := c.buildUpstreamURL(baseURL, upstreamPath, ctx.Request.URL.RawQuery)
+	statusCode := 0
+	defer observeUpstream(ctx, cfg, time.Now(), &statusCode)
+	respBody, statusCode, headers, err := c.proxyRequest(ctx, body, method, upstreamPath, cfg)
+	fallback := fallbackConfig(cfg)
+	if fallback == nil || !shouldFailOver(ctx, statusCode, err) {
+		return respBody, statusCode, headers, err
+	}
+	logFailover(cfg, statusCode, err)
+	respBody, statusCode, headers, err = c.proxyRequest(ctx, body, method, upstreamPath, fallback)
+	logFallbackResult(fallback, statusCode, err)
+	return respBody, statusCode, headers, err
+}
 
-	req, err := http.NewRequestWithContext(ctx.Request.Context(), method, url, bytes.NewReader(body))
+func (c *Client) proxyRequest(ctx *gin.Context, body []byte, method string, upstreamPath string, cfg *UpstreamConfig) ([]byte, int, http.Header, error) {
+	req, err := c.newUpstreamRequest(ctx, body, method, upstreamPath, cfg)
 	if err != nil {
 		return nil, 0, nil, err
 	}
-
-	c.copyRequestHeaders(req, ctx.Request)
-	if req.Header.Get("Content-Type") == "" && len(body) > 0 {
-		req.Header.Set("Content-Type", "application/json")
-	}
-	c.applyAuthHeader(req, ctx.Request, cfg)
+	reqCtx, cancel := context.WithTimeout(req.Context(), requestTimeout(cfg))
+	defer cancel()
+	req = req.WithContext(reqCtx)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -55,19 +196,199 @@ func (c *Client) ProxyRequest(ctx *gin.Context, body []byte, method string, upst
 	if err != nil {
 		return nil, 0, nil, err
 	}
+	respBody, err = decodeBody(resp.Header.Get("Content-Encoding"), respBody)
+	if err != nil {
+		return nil, 0, nil, err
+	}
 
-	log.Printf("upstream response: method=%s path=%s status=%d encoding=%s content-type=%s body=%s",
-		method, upstreamPath, resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Type"),
-		truncateBody(respBody, 2000),
-	)
+	c.logResponse(cfg, method, upstreamPath, req.Header.Get(RequestIDHeader), resp, respBody)
 
+	// The body is returned decoded, so its encoding headers no longer apply
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
 	return respBody, resp.StatusCode, resp.Header, nil
 }
 
-// ProxyStream makes a streaming proxy request to upstream
+// decodeBody undoes a gzip or deflate Content-Encoding. Brotli is out of
+// scope: it has no decoder in the standard library, the proxy never
+// advertises br upstream, and an upstream sending it anyway is reported as
+// unsupported rather than handed on as bytes no converter can parse.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// HTTP deflate is zlib wrapped, but some servers send raw deflate
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream content-encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode %s upstream response: %w", encoding, err)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s upstream response: %w", encoding, err)
+	}
+	return decoded, nil
+}
+
+// ProxyStream makes a streaming proxy request to upstream. Failover to the
+// fallback base URL happens before any of the response is consumed, so a
+// stream that already started is never switched.
 func (c *Client) ProxyStream(ctx *gin.Context, body []byte, method string, upstreamPath string, cfg *UpstreamConfig) (*http.Response, error) {
+	statusCode := 0
+	defer observeUpstream(ctx, cfg, time.Now(), &statusCode)
+	resp, err := c.proxyStream(ctx, body, method, upstreamPath, cfg)
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	fallback := fallbackConfig(cfg)
+	if fallback == nil || !shouldFailOver(ctx, statusCode, err) {
+		return resp, err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	logFailover(cfg, statusCode, err)
+	resp, err = c.proxyStream(ctx, body, method, upstreamPath, fallback)
+	statusCode = 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	logFallbackResult(fallback, statusCode, err)
+	return resp, err
+}
+
+func (c *Client) proxyStream(ctx *gin.Context, body []byte, method string, upstreamPath string, cfg *UpstreamConfig) (*http.Response, error) {
+	req, err := c.newUpstreamRequest(ctx, body, method, upstreamPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var headerTimeout time.Duration
+	if cfg != nil && cfg.StreamHeaderTimeout > 0 {
+		headerTimeout = cfg.StreamHeaderTimeout
+	}
+	var transport http.RoundTripper = c.transport
+	if transport == nil {
+		transport = c.streamTransport.get(headerTimeout)
+	}
+	client := &http.Client{
+		Timeout:   0,
+		Transport: c.cassette.Transport(transport),
+	}
+	return client.Do(req)
+}
+
+// observeUpstream records the outcome of an upstream call started at start;
+// statusCode is read when the call returns and is zero on transport errors.
+func observeUpstream(ctx *gin.Context, cfg *UpstreamConfig, start time.Time, statusCode *int) {
+	alias := ""
+	if cfg != nil {
+		alias = cfg.Alias
+	}
+	metrics.Default().ObserveUpstream(alias, metrics.EndpointFor(ctx.FullPath()), *statusCode, time.Since(start))
+}
+
+// fallbackConfig returns cfg pointed at its fallback base URL, or nil when
+// no fallback is configured.
+func fallbackConfig(cfg *UpstreamConfig) *UpstreamConfig {
+	if cfg == nil || strings.TrimSpace(cfg.FallbackBaseURL) == "" {
+		return nil
+	}
+	fallback := *cfg
+	fallback.BaseURL = cfg.FallbackBaseURL
+	fallback.FallbackBaseURL = ""
+	return &fallback
+}
+
+// shouldFailOver reports whether a primary upstream result warrants trying
+// the fallback: a transport error or 5xx, unless the client went away.
+func shouldFailOver(ctx *gin.Context, statusCode int, err error) bool {
+	if ctx.Request.Context().Err() != nil {
+		return false
+	}
+	return err != nil || statusCode >= http.StatusInternalServerError
+}
+
+func logFailover(cfg *UpstreamConfig, statusCode int, err error) {
+	log.Printf("upstream %s failed (status=%d err=%v), failing over to %s", cfg.BaseURL, statusCode, err, cfg.FallbackBaseURL)
+}
+
+func logFallbackResult(fallback *UpstreamConfig, statusCode int, err error) {
+	if err != nil {
+		log.Printf("fallback upstream %s failed: %v", fallback.BaseURL, err)
+		return
+	}
+	log.Printf("request served by fallback upstream %s: status=%d", fallback.BaseURL, statusCode)
+}
+
+// Warmup opens a connection to each upstream so the first proxied request
+// skips DNS and TLS setup. Failures are logged and otherwise ignored.
+func (c *Client) Warmup(ctx context.Context, baseURLs []string) {
+	if c.cassette.Replaying() {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, baseURL := range baseURLs {
+		baseURL = strings.TrimSpace(baseURL)
+		if baseURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(baseURL string) {
+			defer wg.Done()
+			reqCtx, cancel := context.WithTimeout(ctx, DefaultAuxTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodHead, baseURL, nil)
+			if err != nil {
+				log.Printf("warmup %s failed: %v", baseURL, err)
+				return
+			}
+			req.Header.Set("User-Agent", DefaultUserAgent)
+			resp, err := c.client.Do(req)
+			if err != nil {
+				log.Printf("warmup %s failed: %v", baseURL, err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf("warmup %s: status=%d", baseURL, resp.StatusCode)
+		}(baseURL)
+	}
+	wg.Wait()
+}
+
+// IsTimeout reports whether err was caused by an upstream timeout
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// newUpstreamRequest builds the outbound request with client headers, the
+// configured User-Agent, upstream auth and alias headers applied.
+func (c *Client) newUpstreamRequest(ctx *gin.Context, body []byte, method string, upstreamPath string, cfg *UpstreamConfig) (*http.Request, error) {
 	baseURL := c.getBaseURL(cfg)
-	url := c.buildUpstreamURL(baseURL, upstreamPath, ctx.Request.URL.RawQuery)
+	basePathMode := ""
+	if cfg != nil {
+		basePathMode = cfg.BasePathMode
+	}
+	url := c.buildUpstreamURL(baseURL, upstreamPath, ctx.Request.URL.RawQuery, basePathMode)
+	if isAzure(cfg) {
+		url = buildAzureURL(baseURL, upstreamPath, ctx.Request.URL.RawQuery, cfg, body)
+	}
 
 	req, err := http.NewRequestWithContext(ctx.Request.Context(), method, url, bytes.NewReader(body))
 	if err != nil {
@@ -75,13 +396,37 @@ func (c *Client) ProxyStream(ctx *gin.Context, body []byte, method string, upstr
 	}
 
 	c.copyRequestHeaders(req, ctx.Request)
+	if cfg != nil {
+		for _, name := range cfg.RemoveHeaders {
+			req.Header.Del(name)
+		}
+	}
 	if req.Header.Get("Content-Type") == "" && len(body) > 0 {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set("User-Agent", c.getUserAgent(cfg))
+	req.Header.Set(RequestIDHeader, RequestID(ctx))
 	c.applyAuthHeader(req, ctx.Request, cfg)
+	if cfg != nil {
+		for name, value := range cfg.Headers {
+			// The transport negotiates encodings decodeBody can undo
+			if strings.EqualFold(name, "Accept-Encoding") {
+				continue
+			}
+			req.Header.Set(name, value)
+		}
+	}
+	c.logRequest(cfg, method, upstreamPath, req.Header.Get(RequestIDHeader), body)
+	return req, nil
+}
 
-	client := &http.Client{Timeout: 0}
-	return client.Do(req)
+func (c *Client) getUserAgent(cfg *UpstreamConfig) string {
+	if cfg != nil {
+		if userAgent := strings.TrimSpace(cfg.UserAgent); userAgent != "" {
+			return userAgent
+		}
+	}
+	return DefaultUserAgent
 }
 
 func (c *Client) getBaseURL(cfg *UpstreamConfig) string {
@@ -94,9 +439,27 @@ func (c *Client) getBaseURL(cfg *UpstreamConfig) string {
 	return "https://api.openai.com/v1"
 }
 
-func (c *Client) buildUpstreamURL(baseURL, path, rawQuery string) string {
+// versionSuffix matches base URLs ending in an API version segment such as
+// /v1, /v3 or /v1beta.
+var versionSuffix = regexp.MustCompile(`/v[0-9]+[a-z0-9]*$`)
+
+// stripVersionPrefix reports whether the request's leading /v1 should be
+// replaced by the base URL path rather than appended to it.
+func stripVersionPrefix(baseURL, mode string) bool {
+	switch mode {
+	case BasePathAppend:
+		return false
+	case BasePathReplace:
+		parsed, err := neturl.Parse(baseURL)
+		return err == nil && strings.Trim(parsed.Path, "/") != ""
+	default:
+		return versionSuffix.MatchString(baseURL)
+	}
+}
+
+func (c *Client) buildUpstreamURL(baseURL, path, rawQuery, basePathMode string) string {
 	upstreamPath := path
-	if strings.HasSuffix(baseURL, "/v1") && strings.HasPrefix(upstreamPath, "/v1") {
+	if (upstreamPath == "/v1" || strings.HasPrefix(upstreamPath, "/v1/")) && stripVersionPrefix(baseURL, basePathMode) {
 		upstreamPath = strings.TrimPrefix(upstreamPath, "/v1")
 		if upstreamPath == "" {
 			upstreamPath = "/"
@@ -149,8 +512,10 @@ func (c *Client) copyRequestHeaders(dst *http.Request, src *http.Request) {
 func (c *Client) applyAuthHeader(req *http.Request, incoming *http.Request, cfg *UpstreamConfig) {
 	var apiKey, authHeader, authPrefix string
 
+	if keys := apiKeys(cfg); len(keys) > 0 {
+		apiKey = c.keys.next(keys)
+	}
 	if cfg != nil {
-		apiKey = strings.TrimSpace(cfg.APIKey)
 		authHeader = strings.TrimSpace(cfg.AuthHeader)
 		authPrefix = strings.TrimSpace(cfg.AuthPrefix)
 	}
@@ -159,15 +524,23 @@ func (c *Client) applyAuthHeader(req *http.Request, incoming *http.Request, cfg
 	if apiKey == "" {
 		apiKey = getEnvFirst([]string{"OPENAI_API_KEY", "IFLOW_API_KEY"}, "")
 	}
+	if authHeader == "" && isAzure(cfg) {
+		authHeader = "api-key"
+	}
 	if authHeader == "" {
 		authHeader = getEnvFirst([]string{"OPENAI_AUTH_HEADER", "IFLOW_AUTH_HEADER"}, "Authorization")
 	}
-	if authPrefix == "" {
+	if authPrefix == "" && !isAzure(cfg) {
 		authPrefix = getEnvFirst([]string{"OPENAI_AUTH_PREFIX", "IFLOW_AUTH_PREFIX"}, "Bearer")
 	}
 
 	req.Header.Del(authHeader)
 	if apiKey != "" {
+		if isAzure(cfg) {
+			// Azure gets the key as api-key; drop the client's Authorization
+			// so Azure does not try to validate it
+			req.Header.Del("Authorization")
+		}
 		if authPrefix != "" {
 			req.Header.Set(authHeader, authPrefix+" "+apiKey)
 			return
@@ -183,6 +556,53 @@ func (c *Client) applyAuthHeader(req *http.Request, incoming *http.Request, cfg
 	}
 }
 
+// logRequest logs the outbound body at the "debug" level when body logging
+// is enabled, indented when LogPrettyJSON is set and the body is JSON.
+func (c *Client) logRequest(cfg *UpstreamConfig, method string, upstreamPath string, requestID string, body []byte) {
+	if cfg == nil || !cfg.LogBodies || len(body) == 0 {
+		return
+	}
+	if level := strings.ToLower(strings.TrimSpace(cfg.LogLevel)); level != "" && level != LogLevelDebug {
+		return
+	}
+	if cfg.LogPrettyJSON {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = indented.Bytes()
+		}
+	}
+	log.Printf("upstream request: request_id=%s method=%s path=%s body=%s",
+		requestID, method, upstreamPath, RedactSecrets(truncateBody(body, 2000), configSecrets(cfg)...),
+	)
+}
+
+// logResponse logs an upstream response according to the configured level.
+// Bodies are only logged when body logging is enabled, and always with
+// credentials masked.
+func (c *Client) logResponse(cfg *UpstreamConfig, method string, upstreamPath string, requestID string, resp *http.Response, body []byte) {
+	level := LogLevelDebug
+	if cfg != nil && strings.TrimSpace(cfg.LogLevel) != "" {
+		level = strings.ToLower(strings.TrimSpace(cfg.LogLevel))
+	}
+	failed := resp.StatusCode < 200 || resp.StatusCode > 299
+	switch level {
+	case LogLevelOff:
+		return
+	case LogLevelError:
+		if !failed {
+			return
+		}
+	}
+	line := fmt.Sprintf("upstream response: request_id=%s method=%s path=%s status=%d encoding=%s content-type=%s",
+		requestID, method, upstreamPath, resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Type"),
+	)
+	if level == LogLevelInfo || cfg == nil || !cfg.LogBodies {
+		log.Print(line)
+		return
+	}
+	log.Printf("%s body=%s", line, RedactSecrets(truncateBody(body, 2000), configSecrets(cfg)...))
+}
+
 func getEnvFirst(keys []string, fallback string) string {
 	for _, key := range keys {
 		if val := strings.TrimSpace(getEnv(key)); val != "" {
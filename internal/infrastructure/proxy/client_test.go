@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// stubTransport records outbound requests and answers through respond
+type stubTransport struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	respond  func(req *http.Request) (*http.Response, error)
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.bodies = append(s.bodies, body)
+	s.mu.Unlock()
+	if s.respond == nil {
+		return stubResponse(http.StatusOK, `{"ok":true}`), nil
+	}
+	return s.respond(req)
+}
+
+// last returns the most recent outbound request and its body
+func (s *stubTransport) last(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("no upstream request")
+	}
+	return s.requests[len(s.requests)-1], s.bodies[len(s.bodies)-1]
+}
+
+func stubResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// newTestClient builds a client whose upstream is transport
+func newTestClient(t *testing.T, transport http.RoundTripper) *Client {
+	t.Helper()
+	client := NewClient(WithTransport(transport))
+	t.Cleanup(client.Close)
+	return client
+}
+
+// newTestContext builds a gin context for an incoming request; headers are
+// name, value pairs.
+func newTestContext(method, target, body string, headers ...string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		c.Request.Header.Set(headers[i], headers[i+1])
+	}
+	return c
+}
+
+// captureLog collects the standard logger's output for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestLogLevels(t *testing.T) {
+	for _, tc := range []struct {
+		level      string
+		logBodies  bool
+		status     int
+		wantLine   bool
+		wantBodies bool
+	}{
+		{level: "", logBodies: true, status: 200, wantLine: true, wantBodies: true},
+		{level: LogLevelDebug, logBodies: false, status: 200, wantLine: true},
+		{level: LogLevelInfo, logBodies: true, status: 200, wantLine: true},
+		{level: LogLevelError, logBodies: true, status: 200},
+		{level: LogLevelError, logBodies: true, status: 500, wantLine: true, wantBodies: true},
+		{level: LogLevelOff, logBodies: true, status: 500},
+	} {
+		logs := captureLog(t)
+		transport := &stubTransport{respond: func(*http.Request) (*http.Response, error) {
+			return stubResponse(tc.status, `{"answer":"response-body"}`), nil
+		}}
+		client := newTestClient(t, transport)
+		cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1", LogLevel: tc.level, LogBodies: tc.logBodies}
+
+		if _, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), []byte(`{"question":"request-body"}`), "POST", "/v1/chat/completions", cfg); err != nil {
+			t.Fatalf("proxy: %v", err)
+		}
+		out := logs.String()
+		if got := strings.Contains(out, "upstream response:"); got != tc.wantLine {
+			t.Errorf("level %q status %d: response line logged = %t, want %t:\n%s", tc.level, tc.status, got, tc.wantLine, out)
+		}
+		if got := strings.Contains(out, "response-body"); got != tc.wantBodies {
+			t.Errorf("level %q status %d: response body logged = %t, want %t:\n%s", tc.level, tc.status, got, tc.wantBodies, out)
+		}
+		wantRequest := tc.logBodies && (tc.level == "" || tc.level == LogLevelDebug)
+		if got := strings.Contains(out, "request-body"); got != wantRequest {
+			t.Errorf("level %q: request body logged = %t, want %t:\n%s", tc.level, got, wantRequest, out)
+		}
+	}
+}
+
+func TestProxyRequestTimeout(t *testing.T) {
+	transport := &stubTransport{respond: func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1", Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), []byte(`{}`), "POST", "/v1/chat/completions", cfg)
+	if err == nil || !IsTimeout(err) {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, want it cut at the 50ms timeout", elapsed)
+	}
+}
+
+func TestRequestTimeoutDefault(t *testing.T) {
+	if got := requestTimeout(nil); got != DefaultTimeout {
+		t.Errorf("requestTimeout(nil) = %s, want %s", got, DefaultTimeout)
+	}
+	if got := requestTimeout(&UpstreamConfig{Timeout: 3 * time.Second}); got != 3*time.Second {
+		t.Errorf("requestTimeout = %s, want 3s", got)
+	}
+}
+
+func TestBuildUpstreamURLBasePaths(t *testing.T) {
+	client := &Client{}
+	for _, tc := range []struct {
+		baseURL string
+		path    string
+		query   string
+		mode    string
+		want    string
+	}{
+		{baseURL: "https://host/v1", path: "/v1/chat/completions", want: "https://host/v1/chat/completions"},
+		{baseURL: "https://host/api/v3", path: "/v1/chat/completions", want: "https://host/api/v3/chat/completions"},
+		{baseURL: "https://host/v1beta/openai", path: "/v1/chat/completions", want: "https://host/v1beta/openai/v1/chat/completions"},
+		{baseURL: "https://host/openai/v1beta", path: "/v1/models", query: "limit=5", want: "https://host/openai/v1beta/models?limit=5"},
+		{baseURL: "https://host", path: "/v1/chat/completions", want: "https://host/v1/chat/completions"},
+		{baseURL: "https://host/proxy", path: "/v1/chat/completions", want: "https://host/proxy/v1/chat/completions"},
+		{baseURL: "https://host/proxy", path: "/v1/chat/completions", mode: BasePathReplace, want: "https://host/proxy/chat/completions"},
+		{baseURL: "https://host", path: "/v1/chat/completions", mode: BasePathReplace, want: "https://host/v1/chat/completions"},
+		{baseURL: "https://host/api/v3", path: "/v1/chat/completions", mode: BasePathAppend, want: "https://host/api/v3/v1/chat/completions"},
+		{baseURL: "https://host/api/v3", path: "/v1", want: "https://host/api/v3/"},
+		{baseURL: "https://host/api/v3", path: "/v10/other", want: "https://host/api/v3/v10/other"},
+	} {
+		if got := client.buildUpstreamURL(tc.baseURL, tc.path, tc.query, tc.mode); got != tc.want {
+			t.Errorf("buildUpstreamURL(%q, %q, mode %q) = %q, want %q", tc.baseURL, tc.path, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestLogPrettyJSON(t *testing.T) {
+	body := []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	for _, tc := range []struct {
+		pretty bool
+		want   string
+	}{
+		{pretty: false, want: `body={"model":"m","messages":[{"role":"user","content":"hi"}]}`},
+		{pretty: true, want: "body={\n  \"model\": \"m\",\n  \"messages\": [\n    {\n      \"role\": \"user\",\n      \"content\": \"hi\"\n    }\n  ]\n}"},
+	} {
+		logs := captureLog(t)
+		client := newTestClient(t, &stubTransport{})
+		cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1", LogBodies: true, LogPrettyJSON: tc.pretty}
+
+		if _, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), body, "POST", "/v1/chat/completions", cfg); err != nil {
+			t.Fatalf("proxy: %v", err)
+		}
+		if out := logs.String(); !strings.Contains(out, tc.want+"\n") {
+			t.Errorf("pretty=%t: request body not logged as\n%s\nin:\n%s", tc.pretty, tc.want, out)
+		}
+	}
+
+	// Bodies that are not JSON are logged as they are
+	logs := captureLog(t)
+	client := newTestClient(t, &stubTransport{})
+	cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1", LogBodies: true, LogPrettyJSON: true}
+	if _, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), []byte("not json"), "POST", "/v1/chat/completions", cfg); err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	if !strings.Contains(logs.String(), "body=not json\n") {
+		t.Errorf("non-JSON body not logged verbatim:\n%s", logs)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"ok":true}`))
+	zw.Close()
+	var zl bytes.Buffer
+	zlw := zlib.NewWriter(&zl)
+	zlw.Write([]byte(`{"ok":true}`))
+	zlw.Close()
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{encoding: "", body: []byte(`{"ok":true}`)},
+		{encoding: "identity", body: []byte(`{"ok":true}`)},
+		{encoding: "gzip", body: gz.Bytes()},
+		{encoding: "X-Gzip", body: gz.Bytes()},
+		{encoding: "deflate", body: zl.Bytes()},
+	} {
+		decoded, err := decodeBody(tc.encoding, tc.body)
+		if err != nil || string(decoded) != `{"ok":true}` {
+			t.Errorf("decodeBody(%q) = %q, %v", tc.encoding, decoded, err)
+		}
+	}
+
+	// Brotli is out of scope and reported instead of passed on
+	if _, err := decodeBody("br", []byte{0x0b}); err == nil || !strings.Contains(err.Error(), `unsupported upstream content-encoding "br"`) {
+		t.Errorf("decodeBody(br) err = %v, want unsupported", err)
+	}
+}
+
+func TestUpstreamRequestNeverAdvertisesBrotli(t *testing.T) {
+	transport := &stubTransport{}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{
+		BaseURL: "http://upstream.test/v1",
+		Headers: map[string]string{"Accept-Encoding": "br", "X-Kept": "yes"},
+	}
+
+	c := newTestContext("POST", "/v1/chat/completions", "{}", "Accept-Encoding", "br, gzip")
+	if _, _, _, err := client.ProxyRequest(c, []byte(`{}`), "POST", "/v1/chat/completions", cfg); err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	req, _ := transport.last(t)
+	if got := req.Header.Get("Accept-Encoding"); got != "" {
+		t.Errorf("Accept-Encoding = %q, want it left to the transport", got)
+	}
+	if req.Header.Get("X-Kept") != "yes" {
+		t.Errorf("other alias headers dropped: %v", req.Header)
+	}
+}
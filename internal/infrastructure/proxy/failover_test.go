@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// hostResponder answers by upstream host: the primary fails the way fail
+// says, the fallback succeeds.
+func hostResponder(fail func() (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "primary.test" {
+			return fail()
+		}
+		return stubResponse(http.StatusOK, `{"served_by":"fallback"}`), nil
+	}
+}
+
+func TestProxyRequestFailsOver(t *testing.T) {
+	cfg := &UpstreamConfig{BaseURL: "http://primary.test/v1", FallbackBaseURL: "http://fallback.test/v1"}
+	for _, tc := range []struct {
+		name string
+		fail func() (*http.Response, error)
+	}{
+		{name: "connection error", fail: func() (*http.Response, error) { return nil, errors.New("connection refused") }},
+		{name: "5xx", fail: func() (*http.Response, error) { return stubResponse(http.StatusBadGateway, `{"error":"down"}`), nil }},
+	} {
+		logs := captureLog(t)
+		transport := &stubTransport{respond: hostResponder(tc.fail)}
+		client := newTestClient(t, transport)
+
+		respBody, status, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", "{}"), []byte(`{"model":"m"}`), "POST", "/v1/chat/completions", cfg)
+		if err != nil || status != http.StatusOK || !strings.Contains(string(respBody), "fallback") {
+			t.Fatalf("%s: status %d, err %v, body %s", tc.name, status, err, respBody)
+		}
+		if len(transport.requests) != 2 {
+			t.Fatalf("%s: %d upstream requests, want primary then fallback", tc.name, len(transport.requests))
+		}
+		if host := transport.requests[1].URL.String(); host != "http://fallback.test/v1/chat/completions" {
+			t.Errorf("%s: fallback URL = %s", tc.name, host)
+		}
+		if body := string(transport.bodies[1]); body != `{"model":"m"}` {
+			t.Errorf("%s: fallback body = %s, want the original request", tc.name, body)
+		}
+		if !strings.Contains(logs.String(), "request served by fallback upstream http://fallback.test/v1") {
+			t.Errorf("%s: log does not name the serving upstream:\n%s", tc.name, logs)
+		}
+	}
+}
+
+func TestProxyRequestNoFailoverOn4xx(t *testing.T) {
+	transport := &stubTransport{respond: hostResponder(func() (*http.Response, error) {
+		return stubResponse(http.StatusBadRequest, `{"error":"bad"}`), nil
+	})}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{BaseURL: "http://primary.test/v1", FallbackBaseURL: "http://fallback.test/v1"}
+
+	_, status, _, _ := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", "{}"), []byte(`{}`), "POST", "/v1/chat/completions", cfg)
+	if status != http.StatusBadRequest || len(transport.requests) != 1 {
+		t.Errorf("status %d after %d requests, want the primary's 400 only", status, len(transport.requests))
+	}
+}
+
+func TestProxyStreamFailsOver(t *testing.T) {
+	transport := &stubTransport{respond: hostResponder(func() (*http.Response, error) {
+		return stubResponse(http.StatusServiceUnavailable, `{"error":"down"}`), nil
+	})}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{BaseURL: "http://primary.test/v1", FallbackBaseURL: "http://fallback.test/v1"}
+
+	resp, err := client.ProxyStream(newTestContext("POST", "/v1/chat/completions", "{}"), []byte(`{}`), "POST", "/v1/chat/completions", cfg)
+	if err != nil {
+		t.Fatalf("ProxyStream: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "fallback") {
+		t.Errorf("status %d: %s, want the fallback's answer", resp.StatusCode, body)
+	}
+}
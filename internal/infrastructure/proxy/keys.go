@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// keyRotation hands out API keys round-robin. Each distinct key list has
+// its own cursor, so aliases rotate independently and a reloaded list
+// starts over. Safe for concurrent use.
+type keyRotation struct {
+	cursors sync.Map // joined key list -> *atomic.Uint64
+}
+
+// next returns the key to use for the next request
+func (r *keyRotation) next(keys []string) string {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	cursor, _ := r.cursors.LoadOrStore(strings.Join(keys, "\n"), new(atomic.Uint64))
+	n := cursor.(*atomic.Uint64).Add(1) - 1
+	return keys[n%uint64(len(keys))]
+}
+
+// apiKeys returns the configured keys, preferring APIKeys over APIKey
+func apiKeys(cfg *UpstreamConfig) []string {
+	if cfg == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(cfg.APIKeys))
+	for _, key := range cfg.APIKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		if key := strings.TrimSpace(cfg.APIKey); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
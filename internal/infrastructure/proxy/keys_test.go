@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAPIKeysRoundRobin(t *testing.T) {
+	transport := &stubTransport{}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{
+		BaseURL:    "http://upstream.test/v1",
+		APIKey:     "sk-ignored",
+		APIKeys:    []string{"sk-1", " sk-2 ", "", "sk-3"},
+		AuthHeader: "Authorization",
+		AuthPrefix: "Bearer",
+	}
+
+	var got []string
+	for i := 0; i < 7; i++ {
+		c := newTestContext("POST", "/v1/chat/completions", "{}", "Authorization", "Bearer client-key")
+		if _, _, _, err := client.ProxyRequest(c, []byte(`{}`), "POST", "/v1/chat/completions", cfg); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		req, _ := transport.last(t)
+		got = append(got, req.Header.Get("Authorization"))
+	}
+	want := []string{"Bearer sk-1", "Bearer sk-2", "Bearer sk-3", "Bearer sk-1", "Bearer sk-2", "Bearer sk-3", "Bearer sk-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Authorization headers = %q\nwant %q", got, want)
+	}
+}
+
+func TestAPIKeySingle(t *testing.T) {
+	transport := &stubTransport{}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{BaseURL: "http://upstream.test/v1", APIKey: "sk-only", AuthHeader: "Authorization", AuthPrefix: "Bearer"}
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", "{}"), []byte(`{}`), "POST", "/v1/chat/completions", cfg); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if req, _ := transport.last(t); req.Header.Get("Authorization") != "Bearer sk-only" {
+			t.Errorf("request %d: Authorization = %q", i, req.Header.Get("Authorization"))
+		}
+	}
+}
+
+func TestKeyRotationConcurrent(t *testing.T) {
+	var rotation keyRotation
+	keys := []string{"a", "b", "c"}
+	const perKey = 1000
+	counts := map[string]int{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perKey*len(keys)/10; i++ {
+				key := rotation.next(keys)
+				mu.Lock()
+				counts[key]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, key := range keys {
+		if counts[key] != perKey {
+			t.Errorf("key %s used %d times, want %d: %v", key, counts[key], perKey, counts)
+		}
+	}
+	// An unrelated key list keeps its own cursor
+	if key := rotation.next([]string{"x", "y"}); key != "x" {
+		t.Errorf("new list starts at %q, want x", key)
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redactedSecret replaces secrets in log output
+const redactedSecret = "[REDACTED]"
+
+// Token shapes masked in logged text regardless of configuration
+var (
+	bearerToken = regexp.MustCompile(`(?i)\b(Bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	secretKey   = regexp.MustCompile(`\b(sk-)[A-Za-z0-9_-]{8,}`)
+)
+
+// RedactSecrets masks the given secrets, bearer tokens and sk- style keys
+// in text before it is logged.
+func RedactSecrets(text string, secrets ...string) string {
+	for _, secret := range secrets {
+		// Very short values would mask unrelated text
+		if secret = strings.TrimSpace(secret); len(secret) >= 4 {
+			text = strings.ReplaceAll(text, secret, redactedSecret)
+		}
+	}
+	text = bearerToken.ReplaceAllString(text, "${1}"+redactedSecret)
+	return secretKey.ReplaceAllString(text, "${1}"+redactedSecret)
+}
+
+// configSecrets returns the credentials of cfg that must never be logged
+func configSecrets(cfg *UpstreamConfig) []string {
+	secrets := apiKeys(cfg)
+	if key := getEnvFirst([]string{"OPENAI_API_KEY", "IFLOW_API_KEY"}, ""); key != "" {
+		secrets = append(secrets, key)
+	}
+	return secrets
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		secrets []string
+		want    string
+	}{
+		{text: `Authorization: Bearer abc.def-123`, want: `Authorization: Bearer [REDACTED]`},
+		{text: `{"key":"sk-proj-abcdefgh1234"}`, want: `{"key":"sk-[REDACTED]"}`},
+		{text: `api-key=az-custom-key-42`, secrets: []string{"az-custom-key-42"}, want: `api-key=[REDACTED]`},
+		// Short configured values would mask unrelated text
+		{text: `abc is fine`, secrets: []string{"abc"}, want: `abc is fine`},
+		{text: `ask-me anything`, want: `ask-me anything`},
+	} {
+		if got := RedactSecrets(tc.text, tc.secrets...); got != tc.want {
+			t.Errorf("RedactSecrets(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestLoggedKeysMasked(t *testing.T) {
+	logs := captureLog(t)
+	transport := &stubTransport{respond: func(*http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusUnauthorized, `{"error":"invalid key az-secret-value-9 (Bearer leaked-token)"}`), nil
+	}}
+	client := newTestClient(t, transport)
+	cfg := &UpstreamConfig{
+		BaseURL:    "http://upstream.test/v1",
+		APIKey:     "az-secret-value-9",
+		AuthHeader: "api-key",
+		Provider:   ProviderAzure,
+		LogLevel:   LogLevelDebug,
+		LogBodies:  true,
+	}
+
+	body := []byte(`{"messages":[{"role":"user","content":"my key is sk-user-0123456789"}]}`)
+	if _, _, _, err := client.ProxyRequest(newTestContext("POST", "/v1/chat/completions", ""), body, "POST", "/v1/chat/completions", cfg); err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "upstream response:") || !strings.Contains(out, "my key is") {
+		t.Fatalf("bodies were not logged:\n%s", out)
+	}
+	for _, secret := range []string{"az-secret-value-9", "leaked-token", "sk-user-0123456789"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log leaks %q:\n%s", secret, out)
+		}
+	}
+	if req, _ := transport.last(t); req.Header.Get("api-key") != "az-secret-value-9" {
+		t.Errorf("upstream api-key = %q, masking must only affect logs", req.Header.Get("api-key"))
+	}
+}
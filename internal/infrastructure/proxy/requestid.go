@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the id correlating a client request with its
+// upstream requests and log lines.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey stores the request id in the gin context
+const requestIDKey = "request_id"
+
+// requestIDSeq disambiguates ids should the random source ever fail
+var requestIDSeq atomic.Uint64
+
+// RequestID returns the id of the client request, taking the client's
+// X-Request-ID or generating one on first use. The id is echoed on the
+// client response.
+func RequestID(ctx *gin.Context) string {
+	if id := ctx.GetString(requestIDKey); id != "" {
+		return id
+	}
+	id := strings.TrimSpace(ctx.GetHeader(RequestIDHeader))
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx.Set(requestIDKey, id)
+	ctx.Header(RequestIDHeader, id)
+	return id
+}
+
+func newRequestID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "req_" + strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + strconv.FormatUint(requestIDSeq.Add(1), 10)
+	}
+	return "req_" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultStreamIdleConnTimeout closes streaming connections that stayed
+// idle this long when no timeout is configured.
+const DefaultStreamIdleConnTimeout = 90 * time.Second
+
+// streamTransports shares streaming transports across requests, one per
+// response header timeout, and reaps the ones that went unused.
+type streamTransports struct {
+	mu          sync.Mutex
+	idleTimeout time.Duration
+	transports  map[time.Duration]*streamTransport
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+type streamTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+func newStreamTransports(idleTimeout time.Duration) *streamTransports {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultStreamIdleConnTimeout
+	}
+	return &streamTransports{
+		idleTimeout: idleTimeout,
+		transports:  map[time.Duration]*streamTransport{},
+		stop:        make(chan struct{}),
+	}
+}
+
+// get returns the shared transport for headerTimeout, creating it on first
+// use. Idle connections close after the configured idle timeout.
+func (s *streamTransports) get(headerTimeout time.Duration) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.transports[headerTimeout]
+	if entry == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = headerTimeout
+		transport.IdleConnTimeout = s.idleTimeout
+		entry = &streamTransport{transport: transport}
+		s.transports[headerTimeout] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.transport
+}
+
+// reap closes the idle connections of transports unused for the idle
+// timeout and forgets them. In-flight streams are not affected.
+func (s *streamTransports) reap(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.transports {
+		if now.Sub(entry.lastUsed) < s.idleTimeout {
+			continue
+		}
+		entry.transport.CloseIdleConnections()
+		delete(s.transports, key)
+	}
+}
+
+// run reaps unused transports every half idle timeout until closed
+func (s *streamTransports) run() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.reap(now)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops the reaper and closes every idle streaming connection
+func (s *streamTransports) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.transports {
+		entry.transport.CloseIdleConnections()
+		delete(s.transports, key)
+	}
+}
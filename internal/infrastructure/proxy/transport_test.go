@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamIdleConnectionsClosedAfterTimeout(t *testing.T) {
+	var closed int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	client := NewClient(WithStreamIdleConnTimeout(100 * time.Millisecond))
+	defer client.Close()
+	cfg := &UpstreamConfig{BaseURL: upstream.URL + "/v1"}
+	resp, err := client.ProxyStream(newTestContext("POST", "/v1/chat/completions", ""), []byte(`{"stream":true}`), "POST", "/v1/chat/completions", cfg)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The finished stream leaves its keep-alive connection idle
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&closed) != 0 {
+		t.Fatal("connection closed before the idle timeout")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle streaming connection still open after the timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamTransportsReapUnused(t *testing.T) {
+	transports := newStreamTransports(time.Minute)
+	defer transports.close()
+	first := transports.get(0)
+	if again := transports.get(0); again != first {
+		t.Fatal("get returned a new transport for the same header timeout")
+	}
+	if first.IdleConnTimeout != time.Minute {
+		t.Errorf("IdleConnTimeout = %s, want 1m", first.IdleConnTimeout)
+	}
+	transports.get(5 * time.Second)
+
+	transports.reap(time.Now().Add(30 * time.Second))
+	if len(transports.transports) != 2 {
+		t.Fatalf("reaped %d transports used within the timeout", 2-len(transports.transports))
+	}
+	transports.reap(time.Now().Add(2 * time.Minute))
+	if len(transports.transports) != 0 {
+		t.Errorf("%d unused transports survived the reaper", len(transports.transports))
+	}
+	if transports.get(0) == first {
+		t.Error("a reaped transport was reused")
+	}
+}
+
+func TestStreamIdleConnTimeoutDefault(t *testing.T) {
+	if got := newStreamTransports(0).idleTimeout; got != DefaultStreamIdleConnTimeout {
+		t.Errorf("idle timeout = %s, want %s", got, DefaultStreamIdleConnTimeout)
+	}
+}
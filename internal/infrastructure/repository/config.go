@@ -19,9 +19,12 @@ func (r *ConfigRepository) IsValidAlias(alias string) bool {
 	return config.IsValidAlias(alias)
 }
 
-// GetDefaultModel returns the default model from configuration
+// GetDefaultModel returns the global default model from configuration
 func (r *ConfigRepository) GetDefaultModel() string {
-	return config.Get().Defaults.Port
+	if model := config.Get().Defaults.DefaultModel; model != "" {
+		return model
+	}
+	return "tstars2.0"
 }
 
 // GetAliasDefaultModel returns the default model for an alias, or global default
@@ -29,5 +32,5 @@ func (r *ConfigRepository) GetAliasDefaultModel(alias string) string {
 	if cfg := r.GetAliasConfig(alias); cfg != nil && cfg.DefaultModel != "" {
 		return cfg.DefaultModel
 	}
-	return "tstars2.0"
+	return r.GetDefaultModel()
 }
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"api-conver/internal/config"
+)
+
+func loadConfig(t *testing.T, yaml string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := config.Load(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+}
+
+func TestGetDefaultModel(t *testing.T) {
+	repo := NewConfigRepository()
+
+	loadConfig(t, `
+defaults:
+  port: "8080"
+  default_model: "gpt-4o-mini"
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+    default_model: "alias-model"
+  b:
+    base_url: "http://upstream.test/v1"
+`)
+	if got := repo.GetDefaultModel(); got != "gpt-4o-mini" {
+		t.Errorf("GetDefaultModel = %q, want gpt-4o-mini", got)
+	}
+	if got := repo.GetAliasDefaultModel("a"); got != "alias-model" {
+		t.Errorf("GetAliasDefaultModel(a) = %q, want alias-model", got)
+	}
+	if got := repo.GetAliasDefaultModel("b"); got != "gpt-4o-mini" {
+		t.Errorf("GetAliasDefaultModel(b) = %q, want the global default", got)
+	}
+
+	loadConfig(t, `
+defaults:
+  port: "8080"
+aliases:
+  a:
+    base_url: "http://upstream.test/v1"
+`)
+	if got := repo.GetDefaultModel(); got != "tstars2.0" {
+		t.Errorf("GetDefaultModel without default_model = %q, want tstars2.0", got)
+	}
+}
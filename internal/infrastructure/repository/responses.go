@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+// ResponseStore keeps completed Responses API objects in memory until
+// they expire, so they can be retrieved by id later. Safe for concurrent
+// use.
+type ResponseStore struct {
+	mu      sync.Mutex
+	entries map[string]storedResponse
+}
+
+type storedResponse struct {
+	alias    string
+	response map[string]interface{}
+	expires  time.Time
+}
+
+func NewResponseStore() *ResponseStore {
+	return &ResponseStore{entries: map[string]storedResponse{}}
+}
+
+// Save stores response under id for alias until now+ttl, replacing any
+// earlier response with the same id. Expired entries are dropped on the
+// way.
+func (s *ResponseStore) Save(alias, id string, response map[string]interface{}, now time.Time, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+	s.entries[id] = storedResponse{alias: alias, response: response, expires: now.Add(ttl)}
+}
+
+// Find returns the unexpired response stored under id by alias
+func (s *ResponseStore) Find(alias, id string, now time.Time) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || entry.alias != alias {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(s.entries, id)
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// Delete removes the response stored under id by alias and reports whether
+// an unexpired one existed.
+func (s *ResponseStore) Delete(alias, id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || entry.alias != alias {
+		return false
+	}
+	delete(s.entries, id)
+	return now.Before(entry.expires)
+}
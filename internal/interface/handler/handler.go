@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"crypto/subtle"
 	"log"
 	"net/http"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"api-conver/internal/application/usecase"
 	"api-conver/internal/config"
+	"api-conver/internal/infrastructure/metrics"
 )
 
 // ChatHandler handles OpenAI /v1/chat/completions requests
@@ -81,6 +83,28 @@ func (h *ResponsesHandler) HandleAlias(c *gin.Context) {
 	h.uc.HandleResponses(c, alias)
 }
 
+// HandleGet handles GET /v1/responses/:id
+func (h *ResponsesHandler) HandleGet(c *gin.Context) {
+	h.uc.HandleGetResponse(c, "")
+}
+
+// HandleGetAlias handles GET /:alias/v1/responses/:id
+func (h *ResponsesHandler) HandleGetAlias(c *gin.Context) {
+	alias := c.Param("alias")
+	h.uc.HandleGetResponse(c, alias)
+}
+
+// HandleDelete handles DELETE /v1/responses/:id
+func (h *ResponsesHandler) HandleDelete(c *gin.Context) {
+	h.uc.HandleDeleteResponse(c, "")
+}
+
+// HandleDeleteAlias handles DELETE /:alias/v1/responses/:id
+func (h *ResponsesHandler) HandleDeleteAlias(c *gin.Context) {
+	alias := c.Param("alias")
+	h.uc.HandleDeleteResponse(c, alias)
+}
+
 // MessagesHandler handles Anthropic /v1/messages requests
 type MessagesHandler struct {
 	uc *usecase.ProxyUseCase
@@ -116,6 +140,17 @@ func (h *MessagesHandler) HandleAlias(c *gin.Context) {
 	h.uc.HandleAnthropic(c, alias)
 }
 
+// HandleCountTokens handles POST /v1/messages/count_tokens
+func (h *MessagesHandler) HandleCountTokens(c *gin.Context) {
+	h.uc.HandleCountTokens(c, "")
+}
+
+// HandleCountTokensAlias handles POST /:alias/v1/messages/count_tokens
+func (h *MessagesHandler) HandleCountTokensAlias(c *gin.Context) {
+	alias := c.Param("alias")
+	h.uc.HandleCountTokens(c, alias)
+}
+
 // ProxyHandler handles generic /v1/* proxy requests
 type ProxyHandler struct {
 	uc *usecase.ProxyUseCase
@@ -169,6 +204,37 @@ func (h *ProxyHandler) HandleAliasFallback(c *gin.Context) {
 	h.uc.HandleProxy(c, alias)
 }
 
+// ModelsHandler handles OpenAI /v1/models requests
+type ModelsHandler struct {
+	uc *usecase.ProxyUseCase
+}
+
+func NewModelsHandler(uc *usecase.ProxyUseCase) *ModelsHandler {
+	return &ModelsHandler{uc: uc}
+}
+
+// Handle handles GET /v1/models
+func (h *ModelsHandler) Handle(c *gin.Context) {
+	h.uc.HandleModels(c, "")
+}
+
+// HandleAlias handles GET /:alias/v1/models
+func (h *ModelsHandler) HandleAlias(c *gin.Context) {
+	alias := c.Param("alias")
+	h.uc.HandleModels(c, alias)
+}
+
+// HandleGet handles GET /v1/models/*id
+func (h *ModelsHandler) HandleGet(c *gin.Context) {
+	h.uc.HandleModel(c, "")
+}
+
+// HandleGetAlias handles GET /:alias/v1/models/*id
+func (h *ModelsHandler) HandleGetAlias(c *gin.Context) {
+	alias := c.Param("alias")
+	h.uc.HandleModel(c, alias)
+}
+
 // HealthHandler handles health check requests
 type HealthHandler struct{}
 
@@ -186,6 +252,68 @@ func (h *HealthHandler) HandleAlias(c *gin.Context) {
 	c.String(http.StatusOK, "ok")
 }
 
+// MetricsHandler exposes in-process metrics
+type MetricsHandler struct {
+	registry *metrics.Registry
+}
+
+func NewMetricsHandler(registry *metrics.Registry) *MetricsHandler {
+	return &MetricsHandler{registry: registry}
+}
+
+// Handle handles GET /metrics
+func (h *MetricsHandler) Handle(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := h.registry.WritePrometheus(c.Writer); err != nil {
+		log.Printf("write metrics failed: %v", err)
+	}
+}
+
+// AdminHandler handles operator endpoints guarded by the admin token
+type AdminHandler struct{}
+
+func NewAdminHandler() *AdminHandler {
+	return &AdminHandler{}
+}
+
+// HandleReload handles POST /admin/reload by reloading the config file
+func (h *AdminHandler) HandleReload(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+	cfg, err := config.Reload(config.Path())
+	if err != nil {
+		log.Printf("config reload failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("config reloaded from %s: generation=%d aliases=%d", config.Path(), cfg.Generation, len(cfg.Aliases))
+	c.JSON(http.StatusOK, gin.H{
+		"aliases":    len(cfg.Aliases),
+		"generation": cfg.Generation,
+	})
+}
+
+// authorizeAdmin checks the admin token sent as a Bearer token or in
+// X-Admin-Token. Admin endpoints are disabled while no token is configured.
+func authorizeAdmin(c *gin.Context) bool {
+	token := config.Get().Defaults.AdminToken
+	if token == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "admin endpoints are disabled"})
+		return false
+	}
+	provided := c.GetHeader("X-Admin-Token")
+	if provided == "" {
+		provided = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return false
+	}
+	return true
+}
+
 func getAliasFromPath(c *gin.Context) string {
 	path := c.Request.URL.Path
 	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
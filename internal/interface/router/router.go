@@ -1,37 +1,67 @@
 package router
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"api-conver/internal/application/usecase"
+	"api-conver/internal/config"
+	"api-conver/internal/infrastructure/metrics"
 	"api-conver/internal/interface/handler"
 )
 
+// RequestTagHeader lets clients attribute requests to a feature in metrics
+// and logs.
+const RequestTagHeader = "X-Request-Tag"
+
 // New creates a new Gin router
 func New() *gin.Engine {
 	engine := gin.New()
 
 	// Middleware
 	engine.Use(gin.Recovery())
-	engine.Use(gin.Logger())
+	engine.Use(gin.LoggerWithFormatter(logFormatter))
+	engine.Use(headerLimits())
+	engine.Use(configGeneration())
+	engine.Use(requestTagMetrics(metrics.Default()))
 
 	// Create handlers
 	proxyUC := usecase.NewProxyUseCase()
+	if config.Get().Defaults.Warmup {
+		go proxyUC.Warmup(context.Background())
+	}
 	chatHandler := handler.NewChatHandler(proxyUC)
 	responsesHandler := handler.NewResponsesHandler(proxyUC)
 	messagesHandler := handler.NewMessagesHandler(proxyUC)
 	proxyHandler := handler.NewProxyHandler(proxyUC)
+	modelsHandler := handler.NewModelsHandler(proxyUC)
 	healthHandler := handler.NewHealthHandler()
+	metricsHandler := handler.NewMetricsHandler(metrics.Default())
+	adminHandler := handler.NewAdminHandler()
 
 	// Health check routes
 	engine.GET("/healthz", healthHandler.Handle)
+	engine.GET("/metrics", metricsHandler.Handle)
+
+	// Admin routes, disabled unless an admin token is configured
+	engine.POST("/admin/reload", adminHandler.HandleReload)
 
 	// Legacy routes (no alias)
 	v1 := engine.Group("/v1")
 	{
 		v1.POST("/chat/completions", chatHandler.Handle)
 		v1.POST("/responses", responsesHandler.Handle)
+		v1.GET("/responses/:id", responsesHandler.HandleGet)
+		v1.DELETE("/responses/:id", responsesHandler.HandleDelete)
 		v1.POST("/messages", messagesHandler.Handle)
+		v1.POST("/messages/count_tokens", messagesHandler.HandleCountTokens)
+		v1.GET("/models", modelsHandler.Handle)
+		v1.GET("/models/*id", modelsHandler.HandleGet)
 		v1.POST("", proxyHandler.Handle)
 		v1.POST("/", proxyHandler.Handle)
 	}
@@ -47,7 +77,12 @@ func New() *gin.Engine {
 		{
 			v1Alias.POST("/chat/completions", chatHandler.HandleAlias)
 			v1Alias.POST("/responses", responsesHandler.HandleAlias)
+			v1Alias.GET("/responses/:id", responsesHandler.HandleGetAlias)
+			v1Alias.DELETE("/responses/:id", responsesHandler.HandleDeleteAlias)
 			v1Alias.POST("/messages", messagesHandler.HandleAlias)
+			v1Alias.POST("/messages/count_tokens", messagesHandler.HandleCountTokensAlias)
+			v1Alias.GET("/models", modelsHandler.HandleAlias)
+			v1Alias.GET("/models/*id", modelsHandler.HandleGetAlias)
 			v1Alias.POST("", proxyHandler.HandleAlias)
 			v1Alias.POST("/", proxyHandler.HandleAlias)
 		}
@@ -58,3 +93,90 @@ func New() *gin.Engine {
 
 	return engine
 }
+
+// Header limits applied when the config leaves them unset
+const (
+	DefaultMaxHeaderCount = 100
+	DefaultMaxHeaderBytes = 32 << 10
+)
+
+// headerLimits rejects requests whose headers exceed the configured count
+// or total size with 431 Request Header Fields Too Large.
+func headerLimits() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaults := config.Get().Defaults
+		maxCount := defaults.MaxHeaderCount
+		if maxCount <= 0 {
+			maxCount = DefaultMaxHeaderCount
+		}
+		maxBytes := defaults.MaxHeaderBytes
+		if maxBytes <= 0 {
+			maxBytes = DefaultMaxHeaderBytes
+		}
+
+		count, size := 0, 0
+		for name, values := range c.Request.Header {
+			count += len(values)
+			for _, value := range values {
+				size += len(name) + len(value)
+			}
+		}
+		if count > maxCount || size > maxBytes {
+			log.Printf("rejecting %s %s: %d headers, %d bytes (limits %d, %d)", c.Request.Method, c.Request.URL.Path, count, size, maxCount, maxBytes)
+			c.AbortWithStatusJSON(http.StatusRequestHeaderFieldsTooLarge, gin.H{"error": "request headers too large"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ConfigGenerationKey holds the config generation a request started with
+const ConfigGenerationKey = "config_generation"
+
+// configGeneration records the config generation serving each request and
+// logs when the config was reloaded while the request was in flight.
+func configGeneration() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		gen := config.CurrentGeneration()
+		c.Set(ConfigGenerationKey, gen)
+		c.Next()
+		if current := config.CurrentGeneration(); current != gen {
+			log.Printf("config reloaded mid-request: %s %s started on generation %d, finished on %d", c.Request.Method, c.Request.URL.Path, gen, current)
+		}
+	}
+}
+
+// logFormatter is gin's default access log line with the config generation
+// appended.
+func logFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	gen, _ := param.Keys[ConfigGenerationKey].(uint64)
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v | gen=%d\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		gen,
+		param.ErrorMessage,
+	)
+}
+
+// requestTagMetrics records latency and status per X-Request-Tag
+func requestTagMetrics(registry *metrics.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tag := metrics.NormalizeTag(c.GetHeader(RequestTagHeader))
+		if tag == "" {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+		registry.ObserveTag(tag, c.Writer.Status(), latency)
+		log.Printf("request tag=%s %s %s status=%d latency=%s", tag, c.Request.Method, c.Request.URL.Path, c.Writer.Status(), latency)
+	}
+}
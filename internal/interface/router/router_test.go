@@ -0,0 +1,358 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"api-conver/internal/config"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestRouter loads yaml as the active config and builds the router on it
+func newTestRouter(t *testing.T, yaml string) *gin.Engine {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := config.Load(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return New()
+}
+
+// serve sends one request through engine; headers are name, value pairs
+func serve(engine http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestModelRoutesAcceptSlashedIDs(t *testing.T) {
+	engine := newTestRouter(t, `
+defaults:
+  alias: a
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+    model_map:
+      org/model: "upstream-model"
+`)
+	for _, target := range []string{"/v1/models/org/model", "/a/v1/models/org/model"} {
+		resp := serve(engine, http.MethodGet, target, "")
+		if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"id":"org/model"`) {
+			t.Errorf("GET %s: status = %d: %s", target, resp.Code, resp.Body.String())
+		}
+	}
+	for _, target := range []string{"/v1/models/org/missing", "/a/v1/models/missing"} {
+		if resp := serve(engine, http.MethodGet, target, ""); resp.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", target, resp.Code)
+		}
+	}
+	if resp := serve(engine, http.MethodGet, "/a/v1/models", ""); resp.Code != http.StatusOK {
+		t.Errorf("GET /a/v1/models: status = %d", resp.Code)
+	}
+}
+
+func TestRequestTagMetrics(t *testing.T) {
+	engine := newTestRouter(t, `
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+`)
+	tag := "router-test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	for i := 0; i < 3; i++ {
+		serve(engine, http.MethodGet, "/healthz", "", RequestTagHeader, tag)
+	}
+	serve(engine, http.MethodGet, "/healthz", "")
+
+	metrics := serve(engine, http.MethodGet, "/metrics", "").Body.String()
+	want := `api_conver_tagged_requests_total{tag="` + tag + `",status_class="2xx"} 3`
+	if !strings.Contains(metrics, want+"\n") {
+		t.Errorf("missing %s in:\n%s", want, metrics)
+	}
+}
+
+func TestResponsesEndToEnd(t *testing.T) {
+	var gotPath, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(body)
+		if strings.Contains(gotBody, `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, `data: {"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`+"\n\n")
+			io.WriteString(w, `data: {"id":"chatcmpl-1","model":"m","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`+"\n\n")
+			io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	defer upstream.Close()
+	engine := newTestRouter(t, `
+aliases:
+  a:
+    base_url: "`+upstream.URL+`/v1"
+`)
+
+	for _, target := range []string{"/v1/responses", "/a/v1/responses"} {
+		resp := serve(engine, http.MethodPost, target, `{"model":"m","input":"hi"}`, "Content-Type", "application/json")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("POST %s: status = %d: %s", target, resp.Code, resp.Body.String())
+		}
+		if gotPath != "/v1/chat/completions" || !strings.Contains(gotBody, `"content":"hi"`) {
+			t.Errorf("POST %s: upstream got %s %s", target, gotPath, gotBody)
+		}
+		var response map[string]interface{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &response); err != nil {
+			t.Fatalf("POST %s: response is not JSON: %s", target, resp.Body.String())
+		}
+		if response["object"] != "response" || !strings.Contains(resp.Body.String(), `"text":"Hello"`) {
+			t.Errorf("POST %s: response = %s", target, resp.Body.String())
+		}
+	}
+
+	resp := serve(engine, http.MethodPost, "/a/v1/responses", `{"model":"m","input":"hi","stream":true}`, "Content-Type", "application/json")
+	if resp.Code != http.StatusOK || !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("stream: status = %d, Content-Type = %q", resp.Code, resp.Header().Get("Content-Type"))
+	}
+	body := resp.Body.String()
+	for _, want := range []string{"event: response.created", `"delta":"Hel"`, `"delta":"lo"`, "event: response.completed"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("stream: missing %s in:\n%s", want, body)
+		}
+	}
+	if !strings.HasSuffix(strings.TrimSpace(body), "data: [DONE]") {
+		t.Errorf("stream does not end with [DONE]:\n%s", body)
+	}
+}
+
+func TestConfigGenerationInRequestLogs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("aliases: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var access, logs bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(output)
+
+	engine := gin.New()
+	engine.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter, Output: &access}))
+	engine.Use(configGeneration())
+	engine.GET("/steady", func(c *gin.Context) { c.Status(http.StatusOK) })
+	engine.GET("/reload", func(c *gin.Context) {
+		if _, err := config.Reload(path); err != nil {
+			t.Errorf("reload: %v", err)
+		}
+		c.Status(http.StatusOK)
+	})
+
+	serve(engine, http.MethodGet, "/steady", "")
+	if want := fmt.Sprintf("gen=%d\n", loaded.Generation); !strings.Contains(access.String(), want) {
+		t.Errorf("access log %q does not carry %q", access.String(), want)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("unexpected log output: %s", logs.String())
+	}
+
+	access.Reset()
+	serve(engine, http.MethodGet, "/reload", "")
+	if want := fmt.Sprintf("gen=%d\n", loaded.Generation); !strings.Contains(access.String(), want) {
+		t.Errorf("access log %q does not carry the starting generation %q", access.String(), want)
+	}
+	want := fmt.Sprintf("config reloaded mid-request: GET /reload started on generation %d, finished on %d", loaded.Generation, loaded.Generation+1)
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("log %q does not contain %q", logs.String(), want)
+	}
+}
+
+func TestAdminReloadAddsAlias(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("CONFIG_PATH", path)
+	t.Setenv("ADMIN_TOKEN", "")
+	const before = `
+defaults:
+  admin_token: "s3cret"
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+`
+	if err := os.WriteFile(path, []byte(before), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	engine := New()
+	if config.IsValidAlias("b") {
+		t.Fatal("alias b exists before the reload")
+	}
+
+	after := before + `
+  b:
+    base_url: "http://127.0.0.1:1/v1"
+    default_model: "b-model"
+`
+	if err := os.WriteFile(path, []byte(after), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if resp := serve(engine, http.MethodPost, "/admin/reload", ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want 401", resp.Code)
+	}
+	if resp := serve(engine, http.MethodPost, "/admin/reload", "", "Authorization", "Bearer wrong"); resp.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", resp.Code)
+	}
+	if config.IsValidAlias("b") {
+		t.Fatal("unauthorized reload took effect")
+	}
+
+	resp := serve(engine, http.MethodPost, "/admin/reload", "", "Authorization", "Bearer s3cret")
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"aliases":2`) {
+		t.Fatalf("reload: status = %d: %s", resp.Code, resp.Body.String())
+	}
+	if !config.IsValidAlias("b") {
+		t.Fatal("alias b unknown after the reload")
+	}
+	if resp := serve(engine, http.MethodGet, "/b/v1/models", ""); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"id":"b-model"`) {
+		t.Errorf("GET /b/v1/models: status = %d: %s", resp.Code, resp.Body.String())
+	}
+
+	if err := os.WriteFile(path, []byte("aliases: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if resp := serve(engine, http.MethodPost, "/admin/reload", "", "X-Admin-Token", "s3cret"); resp.Code != http.StatusInternalServerError {
+		t.Errorf("invalid config: status = %d, want 500", resp.Code)
+	}
+	if !config.IsValidAlias("b") {
+		t.Error("a failed reload dropped the active config")
+	}
+}
+
+func TestAdminReloadDisabledWithoutToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	engine := newTestRouter(t, `
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+`)
+	if resp := serve(engine, http.MethodPost, "/admin/reload", "", "Authorization", "Bearer anything"); resp.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.Code)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	engine := newTestRouter(t, `
+defaults:
+  max_header_count: 5
+  max_header_bytes: 200
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+`)
+	manyHeaders := func(n int) []string {
+		var headers []string
+		for i := 0; i < n; i++ {
+			headers = append(headers, fmt.Sprintf("X-Extra-%d", i), "v")
+		}
+		return headers
+	}
+	for _, tc := range []struct {
+		name    string
+		headers []string
+		want    int
+	}{
+		{name: "within limits", headers: manyHeaders(5), want: http.StatusOK},
+		{name: "too many headers", headers: manyHeaders(6), want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "too large", headers: []string{"X-Big", strings.Repeat("x", 200)}, want: http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		resp := serve(engine, http.MethodGet, "/healthz", "", tc.headers...)
+		if resp.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.Code, tc.want)
+		}
+		if tc.want == http.StatusRequestHeaderFieldsTooLarge && !strings.Contains(resp.Body.String(), "request headers too large") {
+			t.Errorf("%s: body = %s", tc.name, resp.Body)
+		}
+	}
+
+	// Without configured limits the defaults apply
+	engine = newTestRouter(t, `
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+`)
+	if resp := serve(engine, http.MethodGet, "/healthz", "", manyHeaders(DefaultMaxHeaderCount)...); resp.Code != http.StatusOK {
+		t.Errorf("default limit: %d headers: status = %d", DefaultMaxHeaderCount, resp.Code)
+	}
+	if resp := serve(engine, http.MethodGet, "/healthz", "", manyHeaders(DefaultMaxHeaderCount+1)...); resp.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("default limit: %d headers: status = %d, want 431", DefaultMaxHeaderCount+1, resp.Code)
+	}
+}
+
+func TestResponseRetrievalRoutes(t *testing.T) {
+	engine := newTestRouter(t, `
+aliases:
+  a:
+    base_url: "http://127.0.0.1:1/v1"
+    store_responses: true
+`)
+	for _, target := range []string{"/v1/responses/resp_missing", "/a/v1/responses/resp_missing"} {
+		resp := serve(engine, http.MethodGet, target, "")
+		if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), `"Response with id 'resp_missing' not found."`) {
+			t.Errorf("GET %s: status = %d: %s", target, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestMetricsScrapeCountsUpstreamRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	alias := "metrics" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	engine := newTestRouter(t, `
+aliases:
+  `+alias+`:
+    base_url: "`+upstream.URL+`/v1"
+`)
+	counter := `api_conver_upstream_requests_total{alias="` + alias + `",endpoint="messages",status_class="2xx"} `
+
+	for i := 1; i <= 2; i++ {
+		resp := serve(engine, http.MethodPost, "/"+alias+"/v1/messages", `{"model":"m","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`, "Content-Type", "application/json")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, resp.Code, resp.Body.String())
+		}
+		scrape := serve(engine, http.MethodGet, "/metrics", "")
+		if scrape.Code != http.StatusOK || !strings.HasPrefix(scrape.Header().Get("Content-Type"), "text/plain") {
+			t.Fatalf("scrape: status = %d, Content-Type = %q", scrape.Code, scrape.Header().Get("Content-Type"))
+		}
+		if want := counter + strconv.Itoa(i); !strings.Contains(scrape.Body.String(), want+"\n") {
+			t.Errorf("after %d requests: missing %s in:\n%s", i, want, scrape.Body.String())
+		}
+	}
+}